@@ -33,6 +33,29 @@ type Block struct {
 	Flags             []string           `json:"f"`
 	Transactions      []BlockTransaction `json:"t"`
 	StateHash         string             `json:"s"`
+	Version           uint               `json:"v,omitempty"` // 0 for the original blocks
+	MerkleRoot        string             `json:"m,omitempty"` // since version 2
+}
+
+// CurrentBlockVersion is the version of newly mined blocks. The hash of the blocks of
+// version 2 and later is computed only from their CompactBlockHeader, the StateHash
+// of the blocks of version 3 and later is the root of the state tree, and blocks of
+// version 4 and later use the canonical JSON encoding for hashing. Since version 5, the
+// miner fee of a transaction is deducted from its sender's balance, and older blocks
+// can't have transactions with a fee.
+const CurrentBlockVersion = 5
+
+// CompactBlockHeader is the part of a block which commits to all of it, since the
+// transactions are committed to by their Merkle root. It's enough to verify the
+// proof of work and the chain of blocks.
+type CompactBlockHeader struct {
+	Version           uint     `json:"v"`
+	PreviousBlockHash string   `json:"p"`
+	TimeUTC           int64    `json:"T"`
+	Nonce             uint     `json:"n"`
+	Flags             []string `json:"f"`
+	MerkleRoot        string   `json:"m"`
+	StateHash         string   `json:"s"`
 }
 
 var GenesisBlock = BlockWithHeader{
@@ -56,7 +79,38 @@ var GenesisBlock = BlockWithHeader{
 	},
 }
 
-const GenesisBlockDifficulty = 8 // number of zero bits
+// MedianTimeBlocks is the number of previous blocks whose median timestamp a new block's timestamp must exceed
+const MedianTimeBlocks = 11
+
+// MaxFutureBlockTime is how far in the future (in seconds) a block's timestamp may be
+const MaxFutureBlockTime = 15 * 60
+
+// MinBlockVersions are the lowest versions of the blocks from the given heights on, so
+// that the rules of the newer versions can't be avoided by mining older ones. The
+// blocks of the chain before the heights keep the versions they were mined with.
+var MinBlockVersions = []struct {
+	Height  int
+	Version uint
+}{
+	{10000, 5},
+}
+
+// Returns an error if a block of the version can't be at the height
+func checkBlockVersion(hash string, version uint, height int) error {
+	if version > CurrentBlockVersion {
+		return fmt.Errorf("Block %s has an unknown version %d", hash, version)
+	}
+	for _, m := range MinBlockVersions {
+		if height >= m.Height && version < m.Version {
+			return fmt.Errorf("Block %s at %d has version %d, expecting at least %d", hash, height, version, m.Version)
+		}
+	}
+	return nil
+}
+
+// GenesisBlockDifficulty is the initial difficulty (number of zero bits) of the blockchain.
+// The genesis block itself is exempt from the proof of work check.
+const GenesisBlockDifficulty = 8
 
 func (b *Block) Serialise(w io.Writer) error {
 	jb := b.getBlockData()
@@ -70,27 +124,46 @@ func (b *Block) Serialise(w io.Writer) error {
 	return nil
 }
 
-func (b *Block) Hash() []byte {
+// Returns the hash of the block. Blocks whose header can't be encoded, e.g. because
+// of a nonce which isn't exactly representable in canonical JSON, can't be hashed.
+func (b *Block) Hash() ([]byte, error) {
+	if b.Version >= 2 {
+		h := b.CompactHeader()
+		return h.Hash()
+	}
 	h := sha512.New512_256()
 	err := b.Serialise(h)
 	if err != nil {
-		log.Panicln("Cannot hash block:", err)
+		return nil, fmt.Errorf("Cannot hash block: %s", err.Error())
 	}
-	return h.Sum(nil)
+	return h.Sum(nil), nil
 }
 
-// Adjusts nonce so that the hash of the block begins with "diff" zero bits
-func (b *Block) Mine(diff int) string {
-	for {
-		h := b.Hash()
-		if countStartZeroBits(h) == diff {
-			return mustEncodeBase64URL(h)
-		}
-		b.Nonce++
-		if b.Nonce%10000 == 0 {
-			fmt.Println(b.Nonce)
+// Returns the header of a block of version 2 or later
+func (b *Block) CompactHeader() CompactBlockHeader {
+	return CompactBlockHeader{
+		Version:           b.Version,
+		PreviousBlockHash: b.PreviousBlockHash,
+		TimeUTC:           b.TimeUTC,
+		Nonce:             b.Nonce,
+		Flags:             b.Flags,
+		MerkleRoot:        b.MerkleRoot,
+		StateHash:         b.StateHash,
+	}
+}
+
+// Returns the hash of the header, which is the hash of the block
+func (h *CompactBlockHeader) Hash() ([]byte, error) {
+	if h.Version >= 4 {
+		data, err := canonicalJSON(h)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot hash block header: %s", err.Error())
 		}
+		hash := sha512.Sum512_256(data)
+		return hash[:], nil
 	}
+	hash := sha512.Sum512_256(jsonifyWhateverToBytes(h))
+	return hash[:], nil
 }
 
 func (b *Block) getBlockData() []byte {
@@ -118,12 +191,22 @@ func (btx *BlockTransaction) VerifyBasics() (Tx, error) {
 	}
 	isCoinbase := inStringSlice("coinbase", tx.Flags)
 
+	// Coinbase transactions aren't signed, so their payload could claim any key
+	if isCoinbase && len(tx.Data) > 0 && btx.TxHash != GenesisBlock.Transactions[0].TxHash {
+		return tx, fmt.Errorf("Coinbase tx %s can't have a payload", btx.TxHash)
+	}
 	if len(tx.Data) > 0 {
 		// XXX: there are payloads without _id, e.g. key rotation
 		_, ok := tx.Data["_id"]
 		if !ok {
 			return tx, fmt.Errorf("Missing _id in tx data: %s", btx.TxHash)
 		}
+		if err = tx.Data.checkReservedKeys(); err != nil {
+			return tx, fmt.Errorf("Invalid tx data: %s: %s", btx.TxHash, err.Error())
+		}
+	}
+	if tx.Version >= 2 && !isCanonicalJSON(txDataBytes) {
+		return tx, fmt.Errorf("Tx %s of version %d is not in the canonical JSON encoding", btx.TxHash, tx.Version)
 	}
 	if !isCoinbase {
 		// All tx except coinbase are signed
@@ -150,7 +233,7 @@ func initGenesis() {
 		if mustEncodeBase64URL(txHash[:]) != btx.TxHash {
 			log.Fatalln("Unexpected genesis block tx hash. Expecting", mustEncodeBase64URL(txHash[:]), "got", btx.TxHash)
 		}
-		k, err := DecodePublicKeyString(tx.Data["_key"])
+		k, err := DecodePublicKeyString(tx.Data.getString("_key"))
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -175,15 +258,13 @@ func initGenesis() {
 		log.Fatalln("Unexpected genesis state hash. Expecting", strStateHash, "got", GenesisBlock.StateHash)
 	}
 
-	bHash := GenesisBlock.Block.Hash()
+	bHash, err := GenesisBlock.Block.Hash()
+	if err != nil {
+		log.Fatalln("Genesis block has failed hash check:", err)
+	}
 	if mustEncodeBase64URL(bHash) != GenesisBlock.BlockHeader.Hash {
 		log.Fatalln("Genesis block has failed hash check. Expecting", mustEncodeBase64URL(bHash), "got", GenesisBlock.BlockHeader.Hash)
 	}
-	if countStartZeroBits(bHash) != GenesisBlockDifficulty {
-		GenesisBlock.Mine(GenesisBlockDifficulty)
-		log.Println("Mined nonce:", GenesisBlock.Nonce)
-		log.Fatalln("Genesis block difficulty mismatch.")
-	}
 	log.Println("Genesis block ok.")
 }
 
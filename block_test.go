@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestCheckBlockVersion(t *testing.T) {
+	for _, m := range MinBlockVersions {
+		for _, v := range []struct {
+			version uint
+			height  int
+			ok      bool
+		}{
+			{0, m.Height - 1, true},
+			{m.Version - 1, m.Height - 1, true},
+			{m.Version - 1, m.Height, false},
+			{0, m.Height + 1, false},
+			{m.Version, m.Height, true},
+			{CurrentBlockVersion, m.Height, true},
+			{CurrentBlockVersion + 1, 1, false},
+		} {
+			if err := checkBlockVersion("x", v.version, v.height); (err == nil) != v.ok {
+				t.Errorf("Version %d at %d: expecting ok=%v, got %v", v.version, v.height, v.ok, err)
+			}
+		}
+	}
+}
+
+// Returns a block with the template's transactions, whose coinbase transaction carries
+// the payload and claims to be from the signer
+func (c *testChain) coinbasePayloadBlock(reward, signer *WalletKey, doc PublishedData) (BlockWithHeader, int) {
+	c.t.Helper()
+	t := c.template(reward)
+	tx := Tx{}
+	if err := json.Unmarshal([]byte(t.Block.Transactions[0].TxData), &tx); err != nil {
+		c.t.Fatal(err)
+	}
+	tx.SigningPubKey = signer.Public
+	tx.Data = doc
+	txJSONBytes := mustCanonicalJSON(tx)
+	t.Block.Transactions[0] = BlockTransaction{TxHash: getTxHashStr(txJSONBytes), TxData: string(txJSONBytes)}
+	return c.solve(t), t.Height
+}
+
+func TestCoinbasePayloadRejected(t *testing.T) {
+	c := newTestChain(t)
+	victim := getTestKey("victim")
+	attacker := getTestKey("attacker")
+	c.mine(victim)
+	c.publish(victim, PublishedData{"_id": "_intro", "_key": victim.Public, "_name": "victim"})
+	c.mine(victim)
+
+	b, height := c.coinbasePayloadBlock(attacker, victim, PublishedData{"_id": "_intro", "_key": victim.Public, "_newkey": attacker.Public})
+	if _, err := b.Transactions[0].VerifyBasics(); err == nil {
+		t.Error("Coinbase tx with a payload verified")
+	}
+	err := acceptBlock(b, height)
+	if err == nil || !strings.Contains(err.Error(), "can't have a payload") {
+		t.Fatal("Expecting the block to be rejected for its coinbase payload, got", err)
+	}
+	if c.height() != height-1 {
+		t.Error("Chain has grown to", c.height())
+	}
+	dbtx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbtx.Rollback()
+	if p, err := dbGetPublisherbyKey(dbtx, victim.Public, height); err != nil || p.Name != "victim" {
+		t.Error("Victim's key doesn't belong to its publisher any more:", p, err)
+	}
+	if p, err := dbGetPublisherbyKey(dbtx, attacker.Public, height); err == nil {
+		t.Error("Attacker's key belongs to publisher", p.ID)
+	}
+}
+
+func TestCoinbaseControlPayloadsRejected(t *testing.T) {
+	c := newTestChain(t)
+	victim := getTestKey("victim")
+	attacker := getTestKey("attacker")
+	c.mine(victim)
+	c.publish(victim, PublishedData{"_id": "_intro", "_key": victim.Public, "_name": "victim"})
+	c.mine(victim)
+
+	for _, doc := range []PublishedData{
+		{"_id": "_delkey", "_delkey": victim.Public},
+		{"_id": "_delkey", "_delkey": victim.Public, "_delfrom": "1"},
+		{"_id": "_vouch", "_vouchtx": GenesisBlock.Transactions[0].TxHash},
+		{"_id": "_follow", "_follow": "1"},
+		{"_id": "_trust", "_trust": "1", "_trustlevel": "full"},
+		{"_id": "_handle", "_handle": "victim"},
+	} {
+		b, height := c.coinbasePayloadBlock(attacker, victim, doc)
+		err := acceptBlock(b, height)
+		if err == nil || !strings.Contains(err.Error(), "can't have a payload") {
+			t.Errorf("Expecting the block with %v to be rejected for its coinbase payload, got %v", doc, err)
+		}
+	}
+	dbtx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbtx.Rollback()
+	p, err := dbGetPublisherbyKey(dbtx, victim.Public, c.height()+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.RevokedBlock != 0 {
+		t.Error("Victim's key is revoked from", p.RevokedBlock)
+	}
+}
+
+func TestUnhashableBlockRejected(t *testing.T) {
+	c := newTestChain(t)
+	miner := getTestKey("miner")
+	tpl := c.template(miner)
+	b := tpl.Block
+	b.Nonce = 1<<60 + 1
+	b.BlockHeader.Hash = "unhashable"
+	if _, err := b.Block.Hash(); err == nil {
+		t.Fatal("Block with a nonce of", b.Nonce, "was hashed")
+	}
+	if err := acceptBlock(b, tpl.Height); err == nil {
+		t.Error("Block with a nonce of", b.Nonce, "was accepted")
+	}
+	// The chain isn't left locked
+	c.mine(miner)
+
+	lc := lightChain{{Hash: GenesisBlock.BlockHeader.Hash, Header: GenesisBlock.Block.CompactHeader()}}
+	if _, err := lc.appendHeader(lightHeader{Height: 1, Hash: b.BlockHeader.Hash, Header: b.Block.CompactHeader()}); err == nil {
+		t.Error("Light client accepted a header with a nonce of", b.Nonce)
+	}
+}
+
+func TestOldTxVersionRejected(t *testing.T) {
+	c := newTestChain(t)
+	sender := getTestKey("sender")
+	c.mine(sender)
+	btx := c.signTx(sender, Tx{Version: 1, Outputs: []TxOutput{{PubKey: getTestKey("recipient").Public, Amount: 1}}})
+	// Version 1 transactions needn't be in the canonical encoding
+	btx.TxData = strings.Replace(btx.TxData, ",", ", ", -1)
+	btx.TxHash = getTxHashStr([]byte(btx.TxData))
+	sig, err := sender.SignRaw([]byte(btx.TxData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	btx.Signature = mustEncodeBase64URL(sig)
+
+	_, err = acceptTx(btx)
+	if re, ok := err.(*txRejectError); !ok || re.Reason != txRejectInvalid {
+		t.Error("Expecting the pool to reject a version 1 tx, got", err)
+	}
+	tpl := c.template(sender)
+	tpl.Block.Transactions = append(tpl.Block.Transactions, btx)
+	b := c.solve(tpl)
+	err = acceptBlock(b, tpl.Height)
+	if err == nil || !strings.Contains(err.Error(), "older than version") {
+		t.Error("Expecting a block to be rejected for a version 1 tx, got", err)
+	}
+}
+
+func TestFeeBeforeVersion5Rejected(t *testing.T) {
+	c := newTestChain(t)
+	sender := getTestKey("sender")
+	c.mine(sender)
+	c.send(sender, Tx{Outputs: []TxOutput{{PubKey: getTestKey("recipient").Public, Amount: OneCoin}}, MinerFeeAmount: OneCoin})
+	tpl := c.template(sender)
+	tpl.Block.Version = 4
+	b := c.solve(tpl)
+	err := acceptBlock(b, tpl.Height)
+	if err == nil || !strings.Contains(err.Error(), "miner fee") {
+		t.Error("Expecting a version 4 block to be rejected for a tx with a fee, got", err)
+	}
+	c.mine(sender)
+	if balance := c.balance(sender); balance != 2*getCoinbaseAtHeight(1)-OneCoin {
+		t.Error("Expecting the fee to be paid by the sender to itself, got a balance of", balance)
+	}
+}
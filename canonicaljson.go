@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// The canonical JSON encoding is the JSON Canonicalization Scheme (JCS) of RFC 8785,
+// which every JSON implementation can produce with little effort:
+//
+//   - no whitespace
+//   - the keys of objects are sorted by their UTF-16 code units, and must be unique
+//   - strings are in UTF-8, escaping only `"`, `\` and the control characters below
+//     U+0020, as \b, \f, \n, \r, \t or \u00xx (lower-case hex)
+//   - numbers are IEEE 754 doubles, written like JavaScript's Number.toString()
+//     does: 4.50 as 4.5, 1E30 as 1e+30, 0.000001 as 0.000001, 1e-7 as 1e-7 and -0 as 0
+//   - numbers whose value, not only their form, would change are rejected rather than
+//     rounded: 12345678901234567890 would be written as 12345678901234567000, and
+//     0.30000000000000001 as 0.3
+//
+// Since transaction version 2, the transaction JSON which is signed and hashed must be
+// in the canonical encoding, and since block version 4, so are the block header which
+// is hashed and the values of the state tree leaves, and older transactions are only
+// valid in older blocks.
+//
+// The test vectors in canonicaljson_test.go are there for implementors too.
+
+// Returns the canonical JSON encoding of whatever encoding/json can encode
+func canonicalJSON(i interface{}) ([]byte, error) {
+	data, err := json.Marshal(i)
+	if err != nil {
+		return nil, err
+	}
+	return canonicaliseJSON(data)
+}
+
+// Like canonicalJSON, but panics on errors, like jsonifyWhateverToBytes
+func mustCanonicalJSON(i interface{}) []byte {
+	data, err := canonicalJSON(i)
+	if err != nil {
+		log.Panic(err)
+	}
+	return data
+}
+
+// Returns the canonical encoding of a JSON document
+func canonicaliseJSON(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("Unexpected data after the JSON document")
+	}
+	var buf bytes.Buffer
+	if err := writeCanonicalJSON(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Returns true if the JSON document is in the canonical encoding. Documents with
+// duplicate keys or invalid UTF-8 aren't, since they don't survive decoding.
+func isCanonicalJSON(data []byte) bool {
+	out, err := canonicaliseJSON(data)
+	return err == nil && bytes.Equal(out, data)
+}
+
+func writeCanonicalJSON(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case json.Number:
+		f, err := strconv.ParseFloat(string(v), 64)
+		if err != nil {
+			return fmt.Errorf("Invalid number %s: %s", v, err.Error())
+		}
+		s, err := formatCanonicalJSONNumber(f)
+		if err != nil {
+			return err
+		}
+		if !isSameJSONNumber(string(v), s) {
+			return fmt.Errorf("The number %s can't be encoded exactly, it would become %s", v, s)
+		}
+		buf.WriteString(s)
+	case string:
+		writeCanonicalJSONString(buf, v)
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanonicalJSON(buf, e); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return lessUTF16(keys[i], keys[j]) })
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeCanonicalJSONString(buf, k)
+			buf.WriteByte(':')
+			if err := writeCanonicalJSON(buf, v[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("Unexpected JSON value type %T", v)
+	}
+	return nil
+}
+
+func writeCanonicalJSONString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(buf, `\u%04x`, r)
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	buf.WriteByte('"')
+}
+
+// Compares strings by their UTF-16 code units
+func lessUTF16(a, b string) bool {
+	ua := utf16.Encode([]rune(a))
+	ub := utf16.Encode([]rune(b))
+	for i := 0; i < len(ua) && i < len(ub); i++ {
+		if ua[i] != ub[i] {
+			return ua[i] < ub[i]
+		}
+	}
+	return len(ua) < len(ub)
+}
+
+// Returns true if the JSON number a has the value of the canonical number b. Zeros are
+// compared by their digits, so the exponent of e.g. 1e-1000000000, which is parsed as
+// 0, isn't expanded.
+func isSameJSONNumber(a, b string) bool {
+	if b == "0" {
+		// -0, 0.0 and 0e5 are 0, but 1e-400 isn't
+		mantissa := strings.TrimLeft(a, "-")
+		if i := strings.IndexAny(mantissa, "eE"); i >= 0 {
+			mantissa = mantissa[:i]
+		}
+		return strings.Trim(mantissa, "0.") == ""
+	}
+	ra, ok := new(big.Rat).SetString(a)
+	if !ok {
+		return false
+	}
+	rb, ok := new(big.Rat).SetString(b)
+	return ok && ra.Cmp(rb) == 0
+}
+
+// Formats the number like JavaScript's Number.toString() (ECMA-262, 7.1.12.1)
+func formatCanonicalJSONNumber(f float64) (string, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", fmt.Errorf("Invalid number %v", f)
+	}
+	if f == 0 {
+		return "0", nil
+	}
+	sign := ""
+	if f < 0 {
+		sign = "-"
+		f = -f
+	}
+	// The shortest digits which identify the number, and its decimal exponent n, such
+	// that the number is 0.digits * 10^n
+	e := strconv.FormatFloat(f, 'e', -1, 64)
+	mantissa, exp := e[:strings.IndexByte(e, 'e')], e[strings.IndexByte(e, 'e')+1:]
+	digits := strings.Replace(mantissa, ".", "", 1)
+	n, err := strconv.Atoi(exp)
+	if err != nil {
+		return "", err
+	}
+	n++
+	k := len(digits)
+	switch {
+	case k <= n && n <= 21:
+		return sign + digits + strings.Repeat("0", n-k), nil
+	case 0 < n && n <= 21:
+		return sign + digits[:n] + "." + digits[n:], nil
+	case -6 < n && n <= 0:
+		return sign + "0." + strings.Repeat("0", -n) + digits, nil
+	}
+	s := digits[:1]
+	if k > 1 {
+		s += "." + digits[1:]
+	}
+	if n-1 >= 0 {
+		return fmt.Sprintf("%s%se+%d", sign, s, n-1), nil
+	}
+	return fmt.Sprintf("%s%se%d", sign, s, n-1), nil
+}
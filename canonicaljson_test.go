@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+)
+
+// Canonical encodings of JSON documents
+var canonicalJSONVectors = []struct {
+	in  string
+	out string
+}{
+	// From RFC 8785, but with 333333333.3333333, since 333333333.33333329 is rejected
+	{`{"numbers": [333333333.3333333, 1E30, 4.50, 2e-3, 0.000000000000000000000000001], "string": "\u20ac$\u000F\u000aA'\u0042\u0022\u005c\\\"\/", "literals": [null, true, false]}`,
+		"{\"literals\":[null,true,false],\"numbers\":[333333333.3333333,1e+30,4.5,0.002,1e-27],\"string\":\"\u20ac$\\u000f\\nA'B\\\"\\\\\\\\\\\"/\"}"},
+	{`{"\u20ac": "Euro Sign", "\r": "Carriage Return", "\ufb33": "Hebrew Letter Dalet With Dagesh", "1": "One", "\ud83d\ude00": "Emoji: Grinning Face", "\u0080": "Control", "\u00f6": "Latin Small Letter O With Diaeresis"}`,
+		"{\"\\r\":\"Carriage Return\",\"1\":\"One\",\"\u0080\":\"Control\",\"\u00f6\":\"Latin Small Letter O With Diaeresis\",\"\u20ac\":\"Euro Sign\",\"\U0001f600\":\"Emoji: Grinning Face\",\"\ufb33\":\"Hebrew Letter Dalet With Dagesh\"}"},
+	// Nested objects, HTML characters and line separators are not escaped
+	{`{"b": {"z": [], "a": {}}, "a": "<&>\u2028"}`, "{\"a\":\"<&>\u2028\",\"b\":{\"a\":{},\"z\":[]}}"},
+	// A transaction
+	{`{"v": 2, "k": "WkmxP_985UGG-7rMC5gFSUcwSgq_gdJPoCe5eaOvSHIY", "n": 7, "f": null, "o": [{"k": "WqnzZhKoL4kO3l5RD3nkK7JB6Z65HE5HE_sF8Eyhvumg", "a": 5000, "d": ""}], "m": 100, "d": {"_id": "report", "year": 2024, "tags": ["a", "b"]}}`,
+		`{"d":{"_id":"report","tags":["a","b"],"year":2024},"f":null,"k":"WkmxP_985UGG-7rMC5gFSUcwSgq_gdJPoCe5eaOvSHIY","m":100,"n":7,"o":[{"a":5000,"d":"","k":"WqnzZhKoL4kO3l5RD3nkK7JB6Z65HE5HE_sF8Eyhvumg"}],"v":2}`},
+}
+
+// Canonical encodings of the IEEE 754 doubles with the given bits, from RFC 8785
+var canonicalJSONNumberVectors = []struct {
+	bits uint64
+	out  string
+}{
+	{0x0000000000000000, "0"},
+	{0x8000000000000000, "0"},
+	{0x0000000000000001, "5e-324"},
+	{0x8000000000000001, "-5e-324"},
+	{0x7fefffffffffffff, "1.7976931348623157e+308"},
+	{0xffefffffffffffff, "-1.7976931348623157e+308"},
+	{0x4340000000000000, "9007199254740992"},
+	{0xc340000000000000, "-9007199254740992"},
+	{0x4430000000000000, "295147905179352830000"},
+	{0x44b52d02c7e14af5, "9.999999999999997e+22"},
+	{0x44b52d02c7e14af6, "1e+23"},
+	{0x44b52d02c7e14af7, "1.0000000000000001e+23"},
+	{0x444b1ae4d6e2ef4e, "999999999999999700000"},
+	{0x444b1ae4d6e2ef4f, "999999999999999900000"},
+	{0x444b1ae4d6e2ef50, "1e+21"},
+	{0x3eb0c6f7a0b5ed8c, "9.999999999999997e-7"},
+	{0x3eb0c6f7a0b5ed8d, "0.000001"},
+	{0x41b3de4355555553, "333333333.3333332"},
+	{0x41b3de4355555554, "333333333.33333325"},
+	{0x41b3de4355555555, "333333333.3333333"},
+	{0x41b3de4355555556, "333333333.3333334"},
+	{0x41b3de4355555557, "333333333.33333343"},
+	{0xbecbf647612f3696, "-0.0000033333333333333333"},
+	{0x43143ff3c1cb0959, "1424953923781206.2"},
+}
+
+// The hash of the transaction in the last canonicalJSONVectors entry
+const canonicalJSONVectorTxHash = "WWQuO8Os-wKlcjVARn_9cF1t8CDuyiF5KK3hLMTjH1w"
+
+// JSON documents which have no canonical encoding
+var canonicalJSONInvalidVectors = []string{
+	`{"a": 12345678901234567890}`,
+	`[0.30000000000000001]`,
+	`[333333333.33333329]`,
+	`[9007199254740993]`,
+	`[1e-400]`,
+	`[1e400]`,
+	`{} {}`,
+}
+
+// JSON documents which aren't in the canonical encoding, although they look alike
+var canonicalJSONNonCanonicalVectors = []string{
+	`{"a":1,"a":1}`,
+	`{"b":1,"a":2}`,
+	`{"a": 1}`,
+	`[4.50]`,
+	`["\u0041"]`,
+	"[\"\xff\"]",
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	for _, v := range canonicalJSONVectors {
+		out, err := canonicaliseJSON([]byte(v.in))
+		if err != nil {
+			t.Errorf("%s: %s", v.in, err)
+			continue
+		}
+		if string(out) != v.out {
+			t.Errorf("%s: expecting %s, got %s", v.in, v.out, out)
+		}
+		if !isCanonicalJSON(out) {
+			t.Errorf("%s is not canonical", out)
+		}
+	}
+}
+
+func TestCanonicalJSONInvalid(t *testing.T) {
+	for _, in := range canonicalJSONInvalidVectors {
+		if out, err := canonicaliseJSON([]byte(in)); err == nil {
+			t.Errorf("%s: expecting an error, got %s", in, out)
+		}
+	}
+}
+
+func TestIsCanonicalJSON(t *testing.T) {
+	for _, in := range canonicalJSONNonCanonicalVectors {
+		if isCanonicalJSON([]byte(in)) {
+			t.Errorf("%s is not canonical", in)
+		}
+	}
+}
+
+func TestCanonicalJSONNumbers(t *testing.T) {
+	for _, v := range canonicalJSONNumberVectors {
+		out, err := formatCanonicalJSONNumber(math.Float64frombits(v.bits))
+		if err != nil || out != v.out {
+			t.Errorf("%#016x: expecting %s, got %s %v", v.bits, v.out, out, err)
+		}
+	}
+	for _, in := range []string{"4.50", "1E30", "-0", "0.0", "0e999999999", "2e-3", "0.1", "9007199254740992"} {
+		out, err := canonicaliseJSON([]byte(in))
+		if err != nil {
+			t.Errorf("%s: %s", in, err)
+			continue
+		}
+		f := 0.0
+		fmt.Sscan(in, &f)
+		if s, _ := formatCanonicalJSONNumber(f); string(out) != s {
+			t.Errorf("%s: expecting %s, got %s", in, s, out)
+		}
+	}
+}
+
+func TestCanonicalJSONTxHash(t *testing.T) {
+	tx := Tx{}
+	if err := json.Unmarshal([]byte(canonicalJSONVectors[len(canonicalJSONVectors)-1].in), &tx); err != nil {
+		t.Fatal(err)
+	}
+	if h := getTxHashStr(mustCanonicalJSON(tx)); h != canonicalJSONVectorTxHash {
+		t.Errorf("Expecting %s, got %s", canonicalJSONVectorTxHash, h)
+	}
+}
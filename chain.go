@@ -0,0 +1,250 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// chainLock serialises modifications of the blockchain database, i.e. block
+// imports from the miner and from the peers, and mempool changes done by the node.
+var chainLock = WithMutex{}
+
+// chainTipVersion is incremented whenever the last block of the main chain changes
+var chainTipVersion int64
+
+func chainTipChanged() {
+	atomic.AddInt64(&chainTipVersion, 1)
+}
+
+func getChainTipVersion() int64 {
+	return atomic.LoadInt64(&chainTipVersion)
+}
+
+// Validates a block which came from outside of this node (e.g. from a peer), saves it
+// into the data directory and imports it into the database. If the block extends a
+// fork, it is kept, and the chain is reorganised to the fork if the fork has more
+// cumulative work than the main chain.
+// Blocks whose previous block is unknown are kept in the orphan pool, and errOrphanBlock
+// is returned. They are accepted when their previous block gets accepted.
+func acceptBlock(b BlockWithHeader, height int) error {
+	var err error
+	chainLock.With(func() {
+		err = acceptBlockLocked(b, height)
+	})
+	if err == errOrphanBlock {
+		addOrphanBlock(b, height)
+	}
+	if err != nil {
+		return err
+	}
+	p2pAnnounceBlock(b.BlockHeader.Hash, height)
+	for _, o := range takeOrphanBlocks(b.BlockHeader.Hash) {
+		if err := acceptBlock(o.block, o.height); err != nil {
+			log.Println("Rejected orphan block", o.block.BlockHeader.Hash, err)
+		}
+	}
+	return nil
+}
+
+func acceptBlockLocked(b BlockWithHeader, height int) error {
+	if dbExistsBlockTree(b.BlockHeader.Hash) {
+		return nil
+	}
+	hash, err := b.Block.Hash()
+	if err != nil {
+		return err
+	}
+	if mustEncodeBase64URL(hash) != b.BlockHeader.Hash {
+		return fmt.Errorf("Block hash doesn't match block data: %s", b.BlockHeader.Hash)
+	}
+	if err := checkBlockVersion(b.BlockHeader.Hash, b.Version, height); err != nil {
+		return err
+	}
+	if err := b.Block.verifyMerkleRoot(); err != nil {
+		return err
+	}
+	parent, err := dbGetBlockTreeEntry(db, b.PreviousBlockHash)
+	if err == sql.ErrNoRows {
+		return errOrphanBlock
+	}
+	if err != nil {
+		return err
+	}
+	if height != parent.Height+1 {
+		return fmt.Errorf("Block %s at %d has an invalid height, expecting %d", b.BlockHeader.Hash, height, parent.Height+1)
+	}
+	lastHeight, lastHash, err := dbGetLastBlock()
+	if err != nil {
+		return err
+	}
+	if b.PreviousBlockHash == lastHash {
+		err = dataDirSaveBlock(b, height)
+		if err != nil {
+			return err
+		}
+		err = dbImportBlock(b.Block.getBlockData(), height, b.BlockHeader.Hash)
+		if err != nil {
+			dataDirDeleteBlock(b, height)
+			return err
+		}
+		chainTipChanged()
+		trustBlocksChanged([]BlockWithHeader{b})
+		log.Println("Accepted block", b.BlockHeader.Hash, "at", height)
+		return nil
+	}
+
+	// The block is in a fork
+	err = dbCheckBlockHeader(db, b, parent)
+	if err != nil {
+		return err
+	}
+	err = dataDirSaveForkBlock(b, height)
+	if err != nil {
+		return err
+	}
+	e, err := dbAddBlockTreeEntry(db, b, height)
+	if err != nil {
+		dataDirDeleteForkBlock(height, b.BlockHeader.Hash)
+		return err
+	}
+	log.Println("Accepted fork block", b.BlockHeader.Hash, "at", height)
+	last, err := dbGetBlockTreeEntry(db, lastHash)
+	if err != nil {
+		return err
+	}
+	if e.Work.Cmp(last.Work) <= 0 {
+		return nil
+	}
+	log.Println("Fork at", height, "has more work than the main chain at", lastHeight, ", reorganising")
+	return reorganiseChain(b.BlockHeader.Hash)
+}
+
+// Switches the main chain to the one ending with the given block. Blocks are disconnected
+// from the main chain back to the common ancestor, and the blocks of the fork are connected,
+// all in a single database transaction.
+func reorganiseChain(newTipHash string) error {
+	// Collect the fork blocks, from the fork point to the new tip
+	fork := []*blockTreeEntry{}
+	hash := newTipHash
+	for !dbExistsBlockByHash(hash) {
+		e, err := dbGetBlockTreeEntry(db, hash)
+		if err != nil {
+			return err
+		}
+		fork = append([]*blockTreeEntry{e}, fork...)
+		hash = e.PreviousHash
+	}
+	forkHeight, err := dbGetBlockHeight(hash)
+	if err != nil {
+		return err
+	}
+	lastHeight, _, err := dbGetLastBlock()
+	if err != nil {
+		return err
+	}
+	if lastHeight-forkHeight >= stateTreeKeptRoots {
+		return fmt.Errorf("Cannot reorganise the chain %d blocks deep, the state trees are only kept for the last %d blocks", lastHeight-forkHeight, stateTreeKeptRoots)
+	}
+
+	dbtx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	disconnected := []BlockWithHeader{}
+	connected := []BlockWithHeader{}
+	for height := lastHeight; height > forkHeight; height-- {
+		b, err := dbDisconnectBlock(dbtx, height)
+		if err != nil {
+			dbtx.Rollback()
+			return fmt.Errorf("Cannot disconnect block at %d: %s", height, err.Error())
+		}
+		disconnected = append(disconnected, b)
+	}
+	for _, e := range fork {
+		b, err := dataDirLoadBlock(e.Height, e.Hash)
+		if err == nil {
+			err = dbImportCheckedBlock(dbtx, b, e.Height, e.Hash)
+		}
+		if err != nil {
+			dbtx.Rollback()
+			log.Println("Invalid fork block", e.Hash, "at", e.Height, err)
+			dbDeleteForkBlock(e.Hash)
+			return err
+		}
+		connected = append(connected, b)
+	}
+	if err = dbRevalidateDisconnectedUtxs(dbtx, disconnected); err != nil {
+		dbtx.Rollback()
+		return err
+	}
+	if err = dbtx.Commit(); err != nil {
+		return err
+	}
+	chainTipChanged()
+	trustChainReorganised()
+
+	for i, b := range disconnected {
+		if err = dataDirMoveBlockToForks(lastHeight-i, b.BlockHeader.Hash); err != nil {
+			log.Println(err)
+		}
+	}
+	for _, e := range fork {
+		if err = dataDirMoveBlockFromForks(e.Height, e.Hash); err != nil {
+			log.Println(err)
+		}
+	}
+	log.Println("Reorganised the chain: disconnected", len(disconnected), "blocks, connected", len(fork), "blocks, new last block", newTipHash)
+	return nil
+}
+
+// Deletes a fork block and all its descendants
+func dbDeleteForkBlock(hash string) {
+	children := []string{}
+	rows, err := db.Query("SELECT hash FROM block_tree WHERE prev_hash=?", hash)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for rows.Next() {
+		child := ""
+		if rows.Scan(&child) == nil {
+			children = append(children, child)
+		}
+	}
+	rows.Close()
+	for _, child := range children {
+		dbDeleteForkBlock(child)
+	}
+	e, err := dbGetBlockTreeEntry(db, hash)
+	if err != nil {
+		return
+	}
+	db.Exec("DELETE FROM block_tree WHERE hash=?", hash)
+	dataDirDeleteForkBlock(e.Height, hash)
+}
+
+// Validates a transaction which came from outside of this node and adds it to the
+// pool of unconfirmed transactions. Returns true if the transaction is new. Invalid
+// transactions are rejected with a txRejectError.
+func acceptTx(btx BlockTransaction) (bool, error) {
+	added := false
+	var err error
+	chainLock.With(func() {
+		var dbtx *sql.Tx
+		dbtx, err = db.Begin()
+		if err != nil {
+			return
+		}
+		added, err = dbAddUtx(dbtx, btx)
+		if err != nil {
+			dbtx.Rollback()
+			return
+		}
+		if err = dbtx.Commit(); err == nil && added {
+			mempoolChanged()
+		}
+	})
+	return added, err
+}
@@ -0,0 +1,73 @@
+package main
+
+import "testing"
+
+func TestReorganiseChain(t *testing.T) {
+	miner := getTestKey("miner")
+	other := getTestKey("other")
+	bob := getTestKey("bob")
+	carol := getTestKey("carol")
+
+	// The fork, mined on another node
+	c := newTestChain(t)
+	b1 := c.mine(miner)
+	c.send(miner, Tx{Outputs: []TxOutput{{PubKey: carol.Public, Amount: 50 * OneCoin}}})
+	fork := []BlockWithHeader{c.mine(other), c.mine(other), c.mine(other)}
+	forkRoot, err := dbGetStateTreeRoot(db, c.height())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c = newTestChain(t)
+	if err = acceptBlock(b1, 1); err != nil {
+		t.Fatal(err)
+	}
+	c.publish(miner, PublishedData{"_id": "_intro", "_key": miner.Public, "_name": "miner"})
+	kept := c.send(miner, Tx{Outputs: []TxOutput{{PubKey: bob.Public, Amount: 30 * OneCoin}}})
+	c.mine(other)
+	dropped := c.send(miner, Tx{Outputs: []TxOutput{{PubKey: bob.Public, Amount: 60 * OneCoin}}})
+	c.mine(other)
+
+	for i, b := range fork {
+		if err = acceptBlock(b, 2+i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, hash, _ := dbGetLastBlock(); hash != fork[2].BlockHeader.Hash {
+		t.Fatal("The chain hasn't been reorganised to the fork")
+	}
+	root, err := dbGetStateTreeRoot(db, c.height())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(root) != string(forkRoot) {
+		t.Error("The state after the reorganisation differs from the fork's")
+	}
+	if c.balance(miner) != 50*OneCoin || c.balance(bob) != 0 || c.balance(carol) != 50*OneCoin {
+		t.Error("Unexpected balances after the reorganisation:", c.balance(miner), c.balance(bob), c.balance(carol))
+	}
+	dbtx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbtx.Rollback()
+	if _, err = dbGetPublisherbyKey(dbtx, miner.Public, c.height()+1); err == nil {
+		t.Error("The publisher introduced in a disconnected block still exists")
+	}
+
+	// The intro has the nonce of the fork's tx, and the last tx exceeds the balance on the fork
+	pending := map[string]bool{}
+	utxs, err := dbGetSenderUtxs(dbtx, miner.Public, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, btx := range utxs {
+		pending[btx.TxHash] = true
+	}
+	if len(pending) != 1 || !pending[kept.TxHash] {
+		t.Error("Expecting only", kept.TxHash, "to be pending, got", pending)
+	}
+	if !dbIsDroppedUtx(dropped.TxHash) {
+		t.Error("The tx which is invalid on the fork isn't dropped")
+	}
+}
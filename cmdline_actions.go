@@ -6,11 +6,14 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -23,13 +26,37 @@ func showHelp() {
 	fmt.Println("\tcreatewallet\tCreates a new wallet file. Expected arguments: filename wallet_name password.")
 	fmt.Println("\tcreatekey\tCreates a new key in the current wallet (", path.Join(*dataDir, *walletFileName), "). Expected arguments: key_name password.")
 	fmt.Println("\t\t\tNote: key_name is the publisher name when the key gets introduced in the blockchain.")
-	fmt.Println("\tsignjson\tSigns a JSON document string with the specified key. Expected arguments: key_name password json_document.")
+	fmt.Println("\tsignjson\tSigns the canonical encoding of a JSON document string with the specified key. Expected arguments: key_name password json_document.")
+	fmt.Println("\tcanonicaljson\tPrints the canonical encoding of a JSON document string, and its hash. Expected arguments: json_document.")
 	fmt.Println("\tlistkeys\tLists the keys in the current wallet.")
 	fmt.Println("\tsend\tSends coins in a transactions, with optional JSON document. Expected arguments: from_key password to_key amount [json_document].")
+	fmt.Println("\tlistpending\tLists the pending (unconfirmed) transactions.")
+	fmt.Println("\tdroppending\tRemoves a pending transaction, and the later ones from its sender. Expected arguments: tx_hash.")
+	fmt.Println("\tbumpfee\t\tReplaces a pending transaction with one with a higher fee. Expected arguments: key_name password tx_hash fee.")
+	fmt.Println("\trotatekey\tReplaces the key of a publisher with another key from the wallet. Expected arguments: key_name password new_key_name.")
+	fmt.Println("\trevokekey\tRevokes a key of a publisher, from the given or the next block on. Expected arguments: key_name password revoked_key [from_block].")
+	fmt.Println("\tvouch\t\tVouches for a transaction, as the publisher of the key. Expected arguments: key_name password tx_hash.")
+	fmt.Println("\tunvouch\t\tWithdraws a vouch for a transaction. Expected arguments: key_name password tx_hash.")
+	fmt.Println("\tfollow\t\tFollows a publisher, as the publisher of the key. Expected arguments: key_name password publisher_id.")
+	fmt.Println("\tunfollow\tStops following a publisher. Expected arguments: key_name password publisher_id.")
+	fmt.Println("\ttrust\t\tSets the trust in a publisher to none, marginal or full. Expected arguments: key_name password publisher_id level.")
+	fmt.Println("\tregisterhandle\tRegisters or renews a handle for the publisher of the key, for a fee. Expected arguments: key_name password handle.")
+	fmt.Println("\ttransferhandle\tTransfers a handle to another publisher. Expected arguments: key_name password handle publisher_id.")
+	fmt.Println("\tgetdoc\t\tPrints the latest or the given version of a publisher's document. Expected arguments: publisher doc_id [version].")
+	fmt.Println("\tdocversions\tLists the versions of a publisher's document. Expected arguments: publisher doc_id.")
+	fmt.Println("\tdocdiff\t\tPrints the differences between two versions of a publisher's document, by default the latest one and the one before it. Expected arguments: publisher doc_id [from_version [to_version]].")
+	fmt.Println("\tdoccontent\tPrints the signed transaction with a document, exactly as it was published, and verifies it. Expected arguments: tx_hash.")
+	fmt.Println("\tqrcode\t\tWrites the QR code of the verification URI of a transaction, or of the latest version of a publisher's document, to a .png or .svg file. Expected arguments: tx_hash|publisher [doc_id] filename.")
+	fmt.Println("\tsync\t\tDownloads missing blocks from the peers given with -peers, then exits.")
+	fmt.Println("\tminer\t\tMines blocks for a node, using its mining API. Expected arguments: node_url reward_address.")
+	fmt.Println("\tlightsync\tDownloads and verifies the block headers from a node, as a light client. Expected arguments: node_url.")
+	fmt.Println("\tverifydoc\tVerifies the latest version of a publisher's document with proofs from a node, as a light client. Expected arguments: node_url publisher_key|@handle doc_id [tx_hash], or node_url and the wot:// verification URI of a transaction.")
 	fmt.Println()
 	fmt.Println("Notes:")
 	fmt.Println("* If started without a command specified, a blockchain node will be started.")
 	fmt.Println("* The json_document argument (where applicable) is literally a JSON string.")
+	fmt.Println("* Public key arguments can be given as @handle, which stands for the current key of the handle's publisher.")
+	fmt.Println("* The publisher argument (where applicable) is a publisher id, any of its public keys or its @handle.")
 }
 
 func processSimpleCmdLineActions() bool {
@@ -56,6 +83,56 @@ func processSimpleCmdLineActions() bool {
 		}
 		fmt.Println(fmt.Sprintf("Created a key named '%s'", w.Keys[0].Name))
 		return true
+	} else if cmd == "canonicaljson" {
+		if flag.NArg() != 2 {
+			fmt.Println("Expecting arguments: json_document")
+			os.Exit(1)
+		}
+		data, err := canonicaliseJSON([]byte(flag.Arg(1)))
+		if err != nil {
+			fmt.Println("Invalid JSON document:", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(data))
+		fmt.Println("Hash:", getTxHashStr(data))
+		return true
+	} else if cmd == "miner" {
+		if flag.NArg() != 3 {
+			fmt.Println("Expecting arguments: node_url reward_address")
+			os.Exit(1)
+		}
+		// An @handle is resolved by the node
+		if _, err := DecodePublicKeyString(flag.Arg(2)); err != nil && !strings.HasPrefix(flag.Arg(2), "@") {
+			fmt.Println("Invalid reward address:", flag.Arg(2))
+			os.Exit(1)
+		}
+		externalMiner(flag.Arg(1), flag.Arg(2))
+		return true
+	} else if cmd == "lightsync" {
+		if flag.NArg() != 2 {
+			fmt.Println("Expecting arguments: node_url")
+			os.Exit(1)
+		}
+		c, err := lightSync(flag.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Synced headers up to block", len(c)-1, c[len(c)-1].Hash)
+		return true
+	} else if cmd == "verifydoc" {
+		var err error
+		if strings.HasPrefix(flag.Arg(2), "wot://") && flag.NArg() == 3 {
+			err = lightVerifyURI(flag.Arg(1), flag.Arg(2))
+		} else if flag.NArg() == 4 || flag.NArg() == 5 {
+			err = lightVerifyDocument(flag.Arg(1), flag.Arg(2), flag.Arg(3), flag.Arg(4), "")
+		} else {
+			fmt.Println("Expecting arguments: node_url publisher_key|@handle doc_id [tx_hash], or node_url wot://uri")
+			os.Exit(1)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return true
 	} else if cmd == "createkey" {
 		if flag.NArg() != 3 {
 			fmt.Println("Expecting arguments: key_name password")
@@ -87,11 +164,12 @@ func processSimpleCmdLineActions() bool {
 
 		initWallet(false)
 
-		var ii interface{}
-		err := json.Unmarshal(jsonToSign, &ii)
+		// The canonical encoding of the document is signed
+		jsonToSign, err := canonicaliseJSON(jsonToSign)
 		if err != nil {
 			log.Fatal(err)
 		}
+		fmt.Println(string(jsonToSign))
 
 		if len(currentWallet.Keys) < 1 {
 			log.Fatal("No keys in current wallet")
@@ -145,9 +223,17 @@ func processCmdLineActions() bool {
 			fmt.Println("Expecting arguments: from_key password to_key amount [json_document]")
 			os.Exit(1)
 		}
-		fromKeyStr := flag.Arg(1)
+		fromKeyStr, err := dbResolvePubKey(db, flag.Arg(1))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 		fromKeyPassword := flag.Arg(2)
-		toKeyStr := flag.Arg(3)
+		toKeyStr, err := dbResolvePubKey(db, flag.Arg(3))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 		amountStr := flag.Arg(4)
 		jsonDoc := flag.Arg(5) // optional
 		var fromKey *WalletKey
@@ -201,9 +287,12 @@ func processCmdLineActions() bool {
 			fmt.Println("No state to send from:", fromKeyStr)
 			os.Exit(1)
 		}
-		newNonce = states[fromKeyStr].Nonce + 1
+		newNonce, err = dbGetNextNonce(dbtx, fromKeyStr)
+		if err != nil {
+			log.Fatal(err)
+		}
 		tx := Tx{Data: doc, SigningPubKey: fromKeyStr, PubKeyNonce: newNonce, Version: CurrentTxVersion, Outputs: []TxOutput{TxOutput{PubKey: toKeyStr, Amount: amountInt}}}
-		txJSONBytes := jsonifyWhateverToBytes(tx)
+		txJSONBytes := mustCanonicalJSON(tx)
 		err = fromKey.UnlockPrivateKey(fromKeyPassword)
 		if err != nil {
 			log.Fatal(err)
@@ -214,11 +303,451 @@ func processCmdLineActions() bool {
 		}
 		strSig := mustEncodeBase64URL(sig)
 		btx := BlockTransaction{TxHash: getTxHashStr(txJSONBytes), TxData: string(txJSONBytes), Signature: strSig}
-		_, err = dbtx.Exec("INSERT INTO utx(hash, ts, tx) VALUES (?, ?, ?)", btx.TxHash, time.Now().Unix(), jsonifyWhatever(btx))
+		_, err = dbAddUtx(dbtx, btx)
+		if re, ok := err.(*txRejectError); ok {
+			fmt.Printf("Transaction rejected (%s): %s\n", re.Reason, re.Message)
+			os.Exit(1)
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
+		fmt.Println("Transaction", btx.TxHash, "is pending")
+		return true
+	} else if cmd == "listpending" {
+		rows, err := db.Query("SELECT hash, sender, nonce, fee, size, ts FROM utx ORDER BY sender, nonce")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var hash, sender string
+			var nonce, fee uint64
+			var size int
+			var ts int64
+			if err = rows.Scan(&hash, &sender, &nonce, &fee, &size, &ts); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("%s %s nonce=%d fee=%.*f size=%d age=%v\n", hash, sender, nonce, CoinDecimals, float64(fee)/OneCoin, size, time.Since(time.Unix(ts, 0)).Round(time.Second))
+		}
+		return true
+	} else if cmd == "droppending" {
+		if flag.NArg() != 2 {
+			fmt.Println("Expecting arguments: tx_hash")
+			os.Exit(1)
+		}
+		dbtx, err := db.Begin()
+		if err != nil {
+			log.Fatal(err)
+		}
+		hashes, err := dbDropUtx(dbtx, flag.Arg(1))
+		if err == sql.ErrNoRows {
+			fmt.Println("No pending transaction", flag.Arg(1))
+			os.Exit(1)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = dbtx.Commit(); err != nil {
+			log.Fatal(err)
+		}
+		for _, hash := range hashes {
+			fmt.Println("Dropped", hash)
+		}
+		return true
+	} else if cmd == "bumpfee" {
+		if flag.NArg() != 5 {
+			fmt.Println("Expecting arguments: key_name password tx_hash fee")
+			os.Exit(1)
+		}
+		keyName := flag.Arg(1)
+		keyPassword := flag.Arg(2)
+		txHash := flag.Arg(3)
+		f, err := strconv.ParseFloat(flag.Arg(4), 32)
+		if err != nil || f < 0 {
+			fmt.Println("Invalid fee:", flag.Arg(4))
+			os.Exit(1)
+		}
+		var key *WalletKey
+		for kid := range currentWallet.Keys {
+			if currentWallet.Keys[kid].Name == keyName || currentWallet.Keys[kid].Public == keyName {
+				key = &(currentWallet.Keys[kid])
+			}
+		}
+		if key == nil {
+			fmt.Println("The key_name argument must be in the current wallet")
+			os.Exit(1)
+		}
+		btx, err := dbGetUtx(txHash)
+		if err != nil {
+			fmt.Println("No pending transaction", txHash)
+			os.Exit(1)
+		}
+		tx := Tx{}
+		if err = json.Unmarshal([]byte(btx.TxData), &tx); err != nil {
+			log.Fatal(err)
+		}
+		if tx.SigningPubKey != key.Public {
+			fmt.Println("The transaction is not signed by", keyName)
+			os.Exit(1)
+		}
+		tx.MinerFeeAmount = uint64(f * OneCoin)
+		txJSONBytes := mustCanonicalJSON(tx)
+		if err = key.UnlockPrivateKey(keyPassword); err != nil {
+			log.Fatal(err)
+		}
+		sig, err := key.SignRaw(txJSONBytes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		newBtx := BlockTransaction{TxHash: getTxHashStr(txJSONBytes), TxData: string(txJSONBytes), Signature: mustEncodeBase64URL(sig)}
+		dbtx, err := db.Begin()
+		if err != nil {
+			log.Fatal(err)
+		}
+		_, err = dbAddUtx(dbtx, newBtx)
+		if re, ok := err.(*txRejectError); ok {
+			dbtx.Rollback()
+			fmt.Printf("Transaction rejected (%s): %s\n", re.Reason, re.Message)
+			os.Exit(1)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = dbtx.Commit(); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Transaction", txHash, "replaced with", newBtx.TxHash)
+		return true
+	} else if cmd == "rotatekey" {
+		if flag.NArg() != 4 {
+			fmt.Println("Expecting arguments: key_name password new_key_name")
+			os.Exit(1)
+		}
+		key := findWalletKey(flag.Arg(1))
+		newKey := findWalletKey(flag.Arg(3))
+		if key == nil || newKey == nil {
+			fmt.Println("The key_name and new_key_name arguments must be in the current wallet")
+			os.Exit(1)
+		}
+		txHash := publishPayload(key, flag.Arg(2), PublishedData{"_id": "_intro", "_key": key.Public, "_newkey": newKey.Public})
+		fmt.Println("Key rotation", txHash, "from", key.Public, "to", newKey.Public, "is pending")
+		return true
+	} else if cmd == "revokekey" {
+		if flag.NArg() != 4 && flag.NArg() != 5 {
+			fmt.Println("Expecting arguments: key_name password revoked_key [from_block]")
+			os.Exit(1)
+		}
+		key := findWalletKey(flag.Arg(1))
+		if key == nil {
+			fmt.Println("The key_name argument must be in the current wallet")
+			os.Exit(1)
+		}
+		revokedKey, err := dbResolvePubKey(db, flag.Arg(3))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if k := findWalletKey(revokedKey); k != nil {
+			revokedKey = k.Public
+		}
+		doc := PublishedData{"_id": "_delkey", "_delkey": revokedKey}
+		if flag.NArg() == 5 {
+			doc["_delfrom"] = flag.Arg(4)
+		}
+		txHash := publishPayload(key, flag.Arg(2), doc)
+		fmt.Println("Key revocation", txHash, "of", revokedKey, "is pending")
+		return true
+	} else if cmd == "vouch" || cmd == "unvouch" {
+		if flag.NArg() != 4 {
+			fmt.Println("Expecting arguments: key_name password tx_hash")
+			os.Exit(1)
+		}
+		key := findWalletKey(flag.Arg(1))
+		if key == nil {
+			fmt.Println("The key_name argument must be in the current wallet")
+			os.Exit(1)
+		}
+		txHash := publishPayload(key, flag.Arg(2), PublishedData{"_id": "_" + cmd, "_" + cmd + "tx": flag.Arg(3)})
+		fmt.Println("Transaction", txHash, "is pending")
+		return true
+	} else if cmd == "follow" || cmd == "unfollow" {
+		if flag.NArg() != 4 {
+			fmt.Println("Expecting arguments: key_name password publisher_id")
+			os.Exit(1)
+		}
+		key := findWalletKey(flag.Arg(1))
+		if key == nil {
+			fmt.Println("The key_name argument must be in the current wallet")
+			os.Exit(1)
+		}
+		txHash := publishPayload(key, flag.Arg(2), PublishedData{"_id": "_" + cmd, "_" + cmd: flag.Arg(3)})
+		fmt.Println("Transaction", txHash, "is pending")
+		return true
+	} else if cmd == "trust" {
+		if flag.NArg() != 5 {
+			fmt.Println("Expecting arguments: key_name password publisher_id level")
+			os.Exit(1)
+		}
+		key := findWalletKey(flag.Arg(1))
+		if key == nil {
+			fmt.Println("The key_name argument must be in the current wallet")
+			os.Exit(1)
+		}
+		txHash := publishPayload(key, flag.Arg(2), PublishedData{"_id": "_trust", "_trust": flag.Arg(3), "_trustlevel": flag.Arg(4)})
+		fmt.Println("Transaction", txHash, "is pending")
+		return true
+	} else if cmd == "registerhandle" {
+		if flag.NArg() != 4 {
+			fmt.Println("Expecting arguments: key_name password handle")
+			os.Exit(1)
+		}
+		key := findWalletKey(flag.Arg(1))
+		if key == nil {
+			fmt.Println("The key_name argument must be in the current wallet")
+			os.Exit(1)
+		}
+		name := strings.TrimPrefix(flag.Arg(3), "@")
+		txHash := publishPayload(key, flag.Arg(2), PublishedData{"_id": "_handle", "_handle": name})
+		fmt.Println("Registration", txHash, "of", "@"+name, "is pending")
+		return true
+	} else if cmd == "transferhandle" {
+		if flag.NArg() != 5 {
+			fmt.Println("Expecting arguments: key_name password handle publisher_id")
+			os.Exit(1)
+		}
+		key := findWalletKey(flag.Arg(1))
+		if key == nil {
+			fmt.Println("The key_name argument must be in the current wallet")
+			os.Exit(1)
+		}
+		name := strings.TrimPrefix(flag.Arg(3), "@")
+		txHash := publishPayload(key, flag.Arg(2), PublishedData{"_id": "_handle", "_handle": name, "_handleto": flag.Arg(4)})
+		fmt.Println("Transfer", txHash, "of", "@"+name, "is pending")
+		return true
+	} else if cmd == "getdoc" {
+		if flag.NArg() != 3 && flag.NArg() != 4 {
+			fmt.Println("Expecting arguments: publisher doc_id [version]")
+			os.Exit(1)
+		}
+		publisherID, docID, versions := getDocumentCmdArgs(flag.Args()[1:])
+		d, err := dbGetDocumentVersion(publisherID, docID, versions[0])
+		if err == sql.ErrNoRows {
+			fmt.Println(getDocumentNotFound(publisherID, docID, versions[0]))
+			os.Exit(1)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Publisher:", d.PublisherID, d.PublisherName)
+		fmt.Println("Document:", d.ID)
+		if d.Latest {
+			fmt.Println("Version:", d.Version, "(latest)")
+		} else {
+			fmt.Println("Version:", d.Version)
+		}
+		fmt.Println("Signed by:", d.PubKey)
+		if d.Revoked {
+			fmt.Println("WARNING: the publisher has revoked the key which signed the document")
+		}
+		fmt.Println("Tx:", d.TxHash)
+		fmt.Println("Block:", d.Block)
+		fmt.Println("Data:", jsonifyWhatever(d.Data))
+		return true
+	} else if cmd == "docversions" {
+		if flag.NArg() != 3 {
+			fmt.Println("Expecting arguments: publisher doc_id")
+			os.Exit(1)
+		}
+		publisherID, docID, _ := getDocumentCmdArgs(flag.Args()[1:])
+		docs, err := dbGetDocumentVersions(publisherID, docID)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(docs) == 0 {
+			fmt.Println(getDocumentNotFound(publisherID, docID, 0))
+			os.Exit(1)
+		}
+		for _, d := range docs {
+			flags := ""
+			if d.Latest {
+				flags += " latest"
+			}
+			if d.Revoked {
+				flags += " revoked"
+			}
+			fmt.Printf("%d block=%d %s %s%s\n", d.Version, d.Block, d.TxHash, d.PubKey, flags)
+		}
+		return true
+	} else if cmd == "docdiff" {
+		if flag.NArg() < 3 || flag.NArg() > 5 {
+			fmt.Println("Expecting arguments: publisher doc_id [from_version [to_version]]")
+			os.Exit(1)
+		}
+		publisherID, docID, versions := getDocumentCmdArgs(flag.Args()[1:])
+		diff, err := dbDiffDocumentVersions(publisherID, docID, versions[0], versions[1])
+		if err == sql.ErrNoRows {
+			fmt.Println("Publisher", publisherID, "has no such versions of document", docID)
+			os.Exit(1)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Document", diff.ID, "of publisher", diff.PublisherID, "from version", diff.From, "to", diff.To)
+		keys := []string{}
+		for key := range diff.Removed {
+			keys = append(keys, key)
+		}
+		for key := range diff.Added {
+			keys = append(keys, key)
+		}
+		for key := range diff.Changed {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if v, ok := diff.Removed[key]; ok {
+				fmt.Println("-", key+":", jsonifyWhatever(v))
+			} else if v, ok := diff.Added[key]; ok {
+				fmt.Println("+", key+":", jsonifyWhatever(v))
+			} else {
+				fmt.Println("~", key+":", jsonifyWhatever(diff.Changed[key].From), "->", jsonifyWhatever(diff.Changed[key].To))
+			}
+		}
+		return true
+	} else if cmd == "doccontent" {
+		if flag.NArg() != 2 {
+			fmt.Println("Expecting arguments: tx_hash")
+			os.Exit(1)
+		}
+		c, err := dbGetDocumentContent(flag.Arg(1))
+		if err == sql.ErrNoRows {
+			fmt.Println("Tx", flag.Arg(1), "has no document in the main chain")
+			os.Exit(1)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Tx:", c.TxHash)
+		fmt.Println("Block:", c.Height, c.BlockHash, "at index", c.Index)
+		fmt.Println("Data:", c.TxData)
+		fmt.Println("Signature:", c.Signature)
+		if err = c.verify(); err != nil {
+			fmt.Println("Invalid:", err)
+			os.Exit(1)
+		}
+		fmt.Println("The data matches the hash, and the signature is valid")
+		return true
+	} else if cmd == "qrcode" {
+		if flag.NArg() != 3 && flag.NArg() != 4 {
+			fmt.Println("Expecting arguments: tx_hash|publisher [doc_id] filename")
+			os.Exit(1)
+		}
+		filename := flag.Arg(flag.NArg() - 1)
+		var uri string
+		var err error
+		if flag.NArg() == 3 {
+			uri, err = dbGetTxVerificationURI(flag.Arg(1))
+			if err == sql.ErrNoRows {
+				fmt.Println("Tx", flag.Arg(1), "is neither in the main chain nor pending")
+				os.Exit(1)
+			}
+		} else {
+			publisherID, docID, _ := getDocumentCmdArgs(flag.Args()[1:3])
+			uri, err = dbGetDocumentVerificationURI(publisherID, docID)
+			if err == sql.ErrNoRows {
+				fmt.Println(getDocumentNotFound(publisherID, docID, 0))
+				os.Exit(1)
+			}
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		img, _, err := getQRImage(uri, strings.TrimPrefix(path.Ext(filename), "."), qrDefaultScale)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if err = ioutil.WriteFile(filename, img, 0644); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(uri)
+		fmt.Println("Written to", filename)
+		return true
+	} else if cmd == "sync" {
+		p2pSyncAndExit()
 		return true
 	}
 	return false
 }
+
+// Returns the publisher id, the document id and the optional versions from the
+// arguments of the document commands, or exits
+func getDocumentCmdArgs(args []string) (int, string, [2]int) {
+	publisherID, err := dbResolvePublisherID(db, args[0])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	versions := [2]int{}
+	for i, arg := range args[2:] {
+		if versions[i], err = strconv.Atoi(arg); err != nil || versions[i] < 1 {
+			fmt.Println("Invalid version:", arg)
+			os.Exit(1)
+		}
+	}
+	return publisherID, args[1], versions
+}
+
+// Returns the key in the current wallet with the given name, public key or @handle
+func findWalletKey(name string) *WalletKey {
+	if strings.HasPrefix(name, "@") {
+		pubKey, err := dbResolvePubKey(db, name)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		name = pubKey
+	}
+	for kid := range currentWallet.Keys {
+		if currentWallet.Keys[kid].Name == name || currentWallet.Keys[kid].Public == name {
+			return &(currentWallet.Keys[kid])
+		}
+	}
+	return nil
+}
+
+// Signs a transaction with only the payload document, adds it to the pending
+// transactions and returns its hash. Exits if it's rejected.
+func publishPayload(key *WalletKey, password string, doc PublishedData) string {
+	dbtx, err := db.Begin()
+	if err != nil {
+		log.Fatal(err)
+	}
+	nonce, err := dbGetNextNonce(dbtx, key.Public)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tx := Tx{Data: doc, SigningPubKey: key.Public, PubKeyNonce: nonce, Version: CurrentTxVersion, Outputs: []TxOutput{}}
+	txJSONBytes := mustCanonicalJSON(tx)
+	if err = key.UnlockPrivateKey(password); err != nil {
+		log.Fatal(err)
+	}
+	sig, err := key.SignRaw(txJSONBytes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	btx := BlockTransaction{TxHash: getTxHashStr(txJSONBytes), TxData: string(txJSONBytes), Signature: mustEncodeBase64URL(sig)}
+	_, err = dbAddUtx(dbtx, btx)
+	if re, ok := err.(*txRejectError); ok {
+		dbtx.Rollback()
+		fmt.Printf("Transaction rejected (%s): %s\n", re.Reason, re.Message)
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = dbtx.Commit(); err != nil {
+		log.Fatal(err)
+	}
+	return btx.TxHash
+}
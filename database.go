@@ -1,29 +1,36 @@
 package main
 
 import (
-	"compress/gzip"
 	"crypto/sha512"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"math/big"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 const sqliteDatabaseName = "wot.sqlite3"
 
+// dbSchemaVersion is increased on every incompatible change of the database schema.
+// The database is then rebuilt from the block files.
+const dbSchemaVersion = 21
+
 var dbTables = map[string]string{
 	"block": `
 	CREATE TABLE IF NOT EXISTS block (
 		height     		INTEGER PRIMARY KEY,
 		hash       		TEXT NOT NULL UNIQUE,
-		ts		 		INTEGER
+		ts		 		INTEGER,
+		state_root		TEXT
 	)`,
 	"publisher": `
 	CREATE TABLE IF NOT EXISTS publisher (
@@ -37,19 +44,32 @@ var dbTables = map[string]string{
 		publisher_id 	INTEGER NOT NULL REFERENCES publisher(id),
 		pubkey			TEXT NOT NULL,
 		since_block		INTEGER NOT NULL REFERENCES block(height),
-		to_block		INTEGER REFERENCES block(height)
+		to_block		INTEGER REFERENCES block(height),
+		revoked_block	INTEGER REFERENCES block(height)
 	)`,
 	"fact": `
 	CREATE TABLE IF NOT EXISTS fact (
 		publisher_id 	INTEGER NOT NULL REFERENCES publisher(id),
 		key				TEXT NOT NULL,
-		value			TEXT NOT NULL
+		value			TEXT NOT NULL,
+		type			TEXT NOT NULL DEFAULT 'string'
 	)`,
 	"document": `
 	CREATE TABLE IF NOT EXISTS document (
-		publisher_id    INTEGER PRIMARY KEY REFERENCES publisher(id),
-		id				VARCHAR NOT NULL,
-		block			INTEGER NOT NULL REFERENCES block(id)
+		id				INTEGER PRIMARY KEY,
+		publisher_id    INTEGER NOT NULL REFERENCES publisher(id),
+		doc_id			VARCHAR NOT NULL,
+		version			INTEGER NOT NULL,
+		latest			INTEGER NOT NULL DEFAULT 1,
+		block			INTEGER NOT NULL REFERENCES block(id),
+		tx_hash			TEXT NOT NULL,
+		pubkey			TEXT NOT NULL
+	)`,
+	"document_content": `
+	CREATE TABLE IF NOT EXISTS document_content (
+		tx_hash			TEXT PRIMARY KEY,
+		tx_data			TEXT NOT NULL,
+		signature		TEXT NOT NULL
 	)`,
 	"state": `
 	CREATE TABLE IF NOT EXISTS state (
@@ -61,20 +81,105 @@ var dbTables = map[string]string{
 		flags			INTEGER NOT NULL DEFAULT 0
 	)
 	`,
+	"block_tree": `
+	CREATE TABLE IF NOT EXISTS block_tree (
+		hash			TEXT PRIMARY KEY,
+		prev_hash		TEXT NOT NULL,
+		height			INTEGER NOT NULL,
+		ts				INTEGER NOT NULL,
+		difficulty		INTEGER NOT NULL,
+		work			TEXT NOT NULL
+	)`,
+	"block_undo": `
+	CREATE TABLE IF NOT EXISTS block_undo (
+		height			INTEGER PRIMARY KEY REFERENCES block(height),
+		data			TEXT NOT NULL
+	)`,
+	"block_tx": `
+	CREATE TABLE IF NOT EXISTS block_tx (
+		height			INTEGER NOT NULL REFERENCES block(height),
+		idx				INTEGER NOT NULL,
+		hash			TEXT NOT NULL,
+		pubkey			TEXT NOT NULL,
+		PRIMARY KEY (height, idx)
+	)`,
+	"vouch": `
+	CREATE TABLE IF NOT EXISTS vouch (
+		voucher_id		INTEGER NOT NULL REFERENCES publisher(id),
+		tx_hash			TEXT NOT NULL,
+		target_id		INTEGER REFERENCES publisher(id),
+		block			INTEGER NOT NULL REFERENCES block(height),
+		vouch_tx_hash	TEXT NOT NULL,
+		PRIMARY KEY (voucher_id, tx_hash)
+	)`,
+	"follow": `
+	CREATE TABLE IF NOT EXISTS follow (
+		id				INTEGER PRIMARY KEY,
+		follower_id		INTEGER NOT NULL REFERENCES publisher(id),
+		target_id		INTEGER NOT NULL REFERENCES publisher(id),
+		since_block		INTEGER NOT NULL REFERENCES block(height),
+		to_block		INTEGER REFERENCES block(height),
+		tx_hash			TEXT NOT NULL
+	)`,
+	"trust_level": `
+	CREATE TABLE IF NOT EXISTS trust_level (
+		id				INTEGER PRIMARY KEY,
+		truster_id		INTEGER NOT NULL REFERENCES publisher(id),
+		target_id		INTEGER NOT NULL REFERENCES publisher(id),
+		level			TEXT NOT NULL,
+		since_block		INTEGER NOT NULL REFERENCES block(height),
+		to_block		INTEGER REFERENCES block(height),
+		tx_hash			TEXT NOT NULL
+	)`,
+	"handle": `
+	CREATE TABLE IF NOT EXISTS handle (
+		name			TEXT PRIMARY KEY,
+		publisher_id	INTEGER NOT NULL REFERENCES publisher(id),
+		since_block		INTEGER NOT NULL REFERENCES block(height),
+		expires_block	INTEGER NOT NULL,
+		tx_hash			TEXT NOT NULL
+	)`,
+	"state_tree_node": `
+	CREATE TABLE IF NOT EXISTS state_tree_node (
+		hash			BLOB PRIMARY KEY,
+		left			BLOB NOT NULL,
+		right			BLOB NOT NULL,
+		single			INTEGER NOT NULL DEFAULT 0
+	) WITHOUT ROWID`,
 	"utx": `
 	CREATE TABLE IF NOT EXISTS utx (
 		id				INTEGER PRIMARY KEY,
 		ts				INTEGER NOT NULL,
 		hash			TEXT NOT NULL UNIQUE,
-		tx				TEXT NOT NULL
+		tx				TEXT NOT NULL,
+		sender			TEXT NOT NULL,
+		nonce			INTEGER NOT NULL,
+		fee				INTEGER NOT NULL,
+		size			INTEGER NOT NULL
+	)`,
+	"utx_dropped": `
+	CREATE TABLE IF NOT EXISTS utx_dropped (
+		hash			TEXT PRIMARY KEY,
+		ts				INTEGER NOT NULL
 	)`,
 }
 
 var dbTableIndexes = map[string]string{
+	"block_tree_prev_idx":     `CREATE INDEX IF NOT EXISTS block_tree_prev_idx ON block_tree(prev_hash)`,
 	"publisher_pubkey_idx":    `CREATE INDEX IF NOT EXISTS publisher_pubkey_idx ON publisher_pubkey(pubkey)`,
 	"publisher_pubkey_id_idx": `CREATE INDEX IF NOT EXISTS publisher_pubkey_id_idx ON publisher_pubkey(publisher_id)`,
 	"fact_publisher_idx":      `CREATE UNIQUE INDEX IF NOT EXISTS fact_publisher_idx ON fact(publisher_id, key)`,
-	"document_idx":            `CREATE UNIQUE INDEX IF NOT EXISTS document_idx ON document(publisher_id, id)`,
+	"document_idx":            `CREATE UNIQUE INDEX IF NOT EXISTS document_idx ON document(publisher_id, doc_id, version)`,
+	"document_block_idx":      `CREATE INDEX IF NOT EXISTS document_block_idx ON document(publisher_id, block)`,
+	"block_tx_hash_idx":       `CREATE INDEX IF NOT EXISTS block_tx_hash_idx ON block_tx(hash)`,
+	"vouch_tx_idx":            `CREATE INDEX IF NOT EXISTS vouch_tx_idx ON vouch(tx_hash)`,
+	"vouch_target_idx":        `CREATE INDEX IF NOT EXISTS vouch_target_idx ON vouch(target_id)`,
+	"follow_follower_idx":     `CREATE INDEX IF NOT EXISTS follow_follower_idx ON follow(follower_id, target_id)`,
+	"follow_target_idx":       `CREATE INDEX IF NOT EXISTS follow_target_idx ON follow(target_id)`,
+	"trust_level_truster_idx": `CREATE INDEX IF NOT EXISTS trust_level_truster_idx ON trust_level(truster_id, target_id)`,
+	"trust_level_target_idx":  `CREATE INDEX IF NOT EXISTS trust_level_target_idx ON trust_level(target_id)`,
+	"handle_publisher_idx":    `CREATE INDEX IF NOT EXISTS handle_publisher_idx ON handle(publisher_id)`,
+	"utx_sender_idx":          `CREATE UNIQUE INDEX IF NOT EXISTS utx_sender_idx ON utx(sender, nonce)`,
 }
 
 type Publisher struct {
@@ -84,6 +189,7 @@ type Publisher struct {
 	CurrentPubKeyID int
 	SinceBlock      int
 	ToBlock         int
+	RevokedBlock    int
 }
 
 var db *sql.DB
@@ -101,11 +207,35 @@ func initDatabase() {
 	if _, err = os.Stat(dbName); err != nil {
 		exists = false
 	}
-	db, err = sql.Open("sqlite3", dbName)
+	// The busy timeout lets command line tools write to the database while the node is running
+	db, err = sql.Open("sqlite3", dbName+"?_busy_timeout=5000")
 	if err != nil {
 		log.Fatal(err)
 	}
+	if exists {
+		version := 0
+		err = db.QueryRow("PRAGMA user_version").Scan(&version)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if version != dbSchemaVersion {
+			log.Println("Database schema has changed, rebuilding the database from block files")
+			db.Close()
+			for _, suffix := range []string{"", "-wal", "-shm"} {
+				os.Remove(dbName + suffix)
+			}
+			db, err = sql.Open("sqlite3", dbName+"?_busy_timeout=5000")
+			if err != nil {
+				log.Fatal(err)
+			}
+			exists = false
+		}
+	}
 	if !exists {
+		_, err = db.Exec(fmt.Sprintf("PRAGMA user_version=%d", dbSchemaVersion))
+		if err != nil {
+			log.Fatal(err)
+		}
 		_, err = db.Exec("PRAGMA journal_mode=WAL")
 		if err != nil {
 			log.Fatal(err)
@@ -130,6 +260,7 @@ func initDatabase() {
 		log.Fatal(err)
 	}
 	sort.Strings(blocks)
+	dbReconcileBlockFiles(blocks)
 	for _, bFile := range blocks {
 		height, hash := getBlockDataFromFilename(bFile)
 		if !dbExistsBlockByHeight(height) {
@@ -139,12 +270,75 @@ func initDatabase() {
 			}
 		}
 	}
+	dbIndexForkBlocks()
 	_, err = db.Exec("PRAGMA foreign_keys")
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+// Makes the block files agree with the main chain in the database, in case the node
+// was interrupted while moving them during a reorganisation.
+func dbReconcileBlockFiles(blocks []string) {
+	for _, bFile := range blocks {
+		height, hash := getBlockDataFromFilename(bFile)
+		dbHash, err := dbGetBlockHash(height)
+		if err == nil && dbHash != hash {
+			log.Println("Moving block", hash, "at", height, "out of the main chain")
+			if err = dataDirMoveBlockToForks(height, hash); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	rows, err := db.Query("SELECT height, hash FROM block ORDER BY height")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		height := 0
+		hash := ""
+		if err = rows.Scan(&height, &hash); err != nil {
+			log.Fatal(err)
+		}
+		if _, err = os.Stat(getForkBlockFilename(height, hash)); err == nil {
+			log.Println("Moving block", hash, "at", height, "into the main chain")
+			if err = dataDirMoveBlockFromForks(height, hash); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+}
+
+// Adds the blocks in the forks directory to the block tree, if they are not already in it
+func dbIndexForkBlocks() {
+	blocks, err := filepath.Glob(path.Join(forksDir, blockFileGlob))
+	if err != nil {
+		log.Fatal(err)
+	}
+	sort.Strings(blocks)
+	for _, bFile := range blocks {
+		height, hash := getBlockDataFromFilename(bFile)
+		if dbExistsBlockTree(hash) {
+			continue
+		}
+		b, err := dataDirLoadBlock(height, hash)
+		if err != nil {
+			log.Println("Cannot load fork block", bFile, err)
+			continue
+		}
+		if !dbExistsBlockTree(b.PreviousBlockHash) {
+			log.Println("Fork block", hash, "at", height, "has no parent, deleting")
+			dataDirDeleteForkBlock(height, hash)
+			continue
+		}
+		_, err = dbAddBlockTreeEntry(db, b, height)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
 func shutdownDatabase() {
 	db.Exec("PRAGMA optimize")
 	db.Close()
@@ -159,18 +353,145 @@ func dbExistsBlockByHeight(height int) bool {
 	return count != 0
 }
 
-func dbImportBlockFile(fn string, height int, hash string) error {
-	f, err := os.Open(fn)
+func dbExistsBlockByHash(hash string) bool {
+	count := 0
+	err := db.QueryRow("SELECT COUNT(*) FROM block WHERE hash=?", hash).Scan(&count)
+	if err != nil {
+		log.Panic(err)
+	}
+	return count != 0
+}
+
+func dbGetBlockHeight(hash string) (int, error) {
+	height := 0
+	err := db.QueryRow("SELECT height FROM block WHERE hash=?", hash).Scan(&height)
+	return height, err
+}
+
+func dbGetBlockHash(height int) (string, error) {
+	hash := ""
+	err := db.QueryRow("SELECT hash FROM block WHERE height=?", height).Scan(&hash)
+	return hash, err
+}
+
+// dbQueryer is implemented by both *sql.DB and *sql.Tx
+type dbQueryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// A block in the tree of all known blocks, both in the main chain and in forks
+type blockTreeEntry struct {
+	Hash         string
+	PreviousHash string
+	Height       int
+	TimeUTC      int64
+	Difficulty   int      // the difficulty the block was required to have
+	Work         *big.Int // cumulative work of the chain ending with this block
+}
+
+// Adds the block to the block tree, calculating its difficulty and cumulative work
+// from its previous block
+func dbAddBlockTreeEntry(q dbQueryer, b BlockWithHeader, height int) (*blockTreeEntry, error) {
+	e := blockTreeEntry{Hash: b.BlockHeader.Hash, PreviousHash: b.PreviousBlockHash, Height: height, TimeUTC: b.TimeUTC, Difficulty: GenesisBlockDifficulty}
+	e.Work = getDifficultyWork(e.Difficulty)
+	if height > 0 {
+		parent, err := dbGetBlockTreeEntry(q, b.PreviousBlockHash)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot find previous block %s: %s", b.PreviousBlockHash, err.Error())
+		}
+		e.Difficulty, err = getNextBlockDifficulty(q, parent)
+		if err != nil {
+			return nil, err
+		}
+		e.Work.Add(parent.Work, getDifficultyWork(e.Difficulty))
+	}
+	_, err := q.Exec("INSERT OR IGNORE INTO block_tree (hash, prev_hash, height, ts, difficulty, work) VALUES (?, ?, ?, ?, ?, ?)", e.Hash, e.PreviousHash, e.Height, e.TimeUTC, e.Difficulty, e.Work.Text(16))
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// Checks the block's proof of work and timestamp, in the chain ending with its previous block.
+// The timestamp must be later than the median timestamp of the previous MedianTimeBlocks
+// blocks, and not more than MaxFutureBlockTime seconds in the future.
+func dbCheckBlockHeader(q dbQueryer, b BlockWithHeader, parent *blockTreeEntry) error {
+	difficulty, err := getNextBlockDifficulty(q, parent)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	zf, err := gzip.NewReader(f)
+	hash, err := base64.RawURLEncoding.DecodeString(b.BlockHeader.Hash)
+	if err != nil {
+		return fmt.Errorf("Invalid block hash %s: %s", b.BlockHeader.Hash, err.Error())
+	}
+	if countStartZeroBits(hash) < difficulty {
+		return fmt.Errorf("Block %s doesn't have the required difficulty of %d bits", b.BlockHeader.Hash, difficulty)
+	}
+	mtp, err := dbGetMedianTimePast(q, parent)
 	if err != nil {
 		return err
 	}
-	defer zf.Close()
-	bData, err := ioutil.ReadAll(zf)
+	if b.TimeUTC <= mtp {
+		return fmt.Errorf("Block %s timestamp %d is not after the median time of the previous blocks %d", b.BlockHeader.Hash, b.TimeUTC, mtp)
+	}
+	if b.TimeUTC > getNowUTC()+MaxFutureBlockTime {
+		return fmt.Errorf("Block %s timestamp %d is too far in the future", b.BlockHeader.Hash, b.TimeUTC)
+	}
+	return nil
+}
+
+// Returns the median timestamp of the last MedianTimeBlocks blocks in the chain ending with the given block
+func dbGetMedianTimePast(q dbQueryer, last *blockTreeEntry) (int64, error) {
+	times := []int64{last.TimeUTC}
+	e := last
+	var err error
+	for len(times) < MedianTimeBlocks && e.Height > 0 {
+		e, err = dbGetBlockTreeEntry(q, e.PreviousHash)
+		if err != nil {
+			return 0, err
+		}
+		times = append(times, e.TimeUTC)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[len(times)/2], nil
+}
+
+func dbGetBlockTreeEntry(q dbQueryer, hash string) (*blockTreeEntry, error) {
+	e := blockTreeEntry{Hash: hash}
+	work := ""
+	err := q.QueryRow("SELECT prev_hash, height, ts, difficulty, work FROM block_tree WHERE hash=?", hash).Scan(&e.PreviousHash, &e.Height, &e.TimeUTC, &e.Difficulty, &work)
+	if err != nil {
+		return nil, err
+	}
+	var ok bool
+	e.Work, ok = new(big.Int).SetString(work, 16)
+	if !ok {
+		return nil, fmt.Errorf("Invalid work for block %s: %s", hash, work)
+	}
+	return &e, nil
+}
+
+// Returns true if the block is known, either in the main chain or in a fork
+func dbExistsBlockTree(hash string) bool {
+	count := 0
+	err := db.QueryRow("SELECT COUNT(*) FROM block_tree WHERE hash=?", hash).Scan(&count)
+	if err != nil {
+		log.Panic(err)
+	}
+	return count != 0
+}
+
+// Returns the height and hash of the last block in the blockchain
+func dbGetLastBlock() (int, string, error) {
+	height := 0
+	hash := ""
+	err := db.QueryRow("SELECT height, hash FROM block ORDER BY height DESC LIMIT 1").Scan(&height, &hash)
+	return height, hash, err
+}
+
+func dbImportBlockFile(fn string, height int, hash string) error {
+	bData, err := dataDirReadBlockFile(fn)
 	if err != nil {
 		return err
 	}
@@ -180,19 +501,31 @@ func dbImportBlockFile(fn string, height int, hash string) error {
 func dbImportBlock(bData []byte, height int, hash string) error {
 	log.Println("Importing block", hash, "at", height)
 
-	// Check if hash matches
-	h := sha512.New512_256()
-	h.Write(bData)
-	bHash := h.Sum(nil)
-	if mustEncodeBase64URL(bHash) != hash {
-		return fmt.Errorf("Block hash doesn't match block data: Expecting %s got %s", mustEncodeBase64URL(bHash), hash)
-	}
-
 	b := BlockWithHeader{BlockHeader: BlockHeader{Hash: hash}}
 	err := json.Unmarshal(bData, &b.Block)
 	if err != nil {
 		return fmt.Errorf("Cannot unmarshall block: %s", err.Error())
 	}
+
+	// Check if hash matches. Blocks older than version 2 are hashed as they are stored,
+	// so their hash is checked against the file's bytes. The hash of newer blocks covers
+	// only their header, which commits to the transactions with the Merkle root, checked
+	// when the block is imported, so it's recomputed from the decoded block.
+	var bHash string
+	if b.Version >= 2 {
+		h, err := b.Block.Hash()
+		if err != nil {
+			return err
+		}
+		bHash = mustEncodeBase64URL(h)
+	} else {
+		h := sha512.New512_256()
+		h.Write(bData)
+		bHash = mustEncodeBase64URL(h.Sum(nil))
+	}
+	if bHash != hash {
+		return fmt.Errorf("Block hash doesn't match block data: Expecting %s got %s", bHash, hash)
+	}
 	if height == 0 {
 		if b.BlockHeader.Hash != GenesisBlock.BlockHeader.Hash {
 			return fmt.Errorf("Genesis block not on this chain: got %s expecting %s", b.BlockHeader.Hash, GenesisBlock.BlockHeader.Hash)
@@ -206,246 +539,563 @@ func dbImportBlock(bData []byte, height int, hash string) error {
 	err = dbImportCheckedBlock(dbtx, b, height, hash)
 	if err != nil {
 		dbtx.Rollback()
-		log.Println(err)
-	} else {
-		dbtx.Commit()
+		return err
 	}
-	return nil
+	return dbtx.Commit()
 }
 
 func dbImportCheckedBlock(dbtx *sql.Tx, b BlockWithHeader, height int, hash string) error {
-	_, err := dbtx.Exec("INSERT INTO block (height, hash) VALUES (?, ?)", height, hash)
+	err := checkBlockVersion(hash, b.Version, height)
+	if err != nil {
+		return err
+	}
+	err = b.Block.verifyMerkleRoot()
+	if err != nil {
+		return err
+	}
+	u := blockUndo{}
+	_, err = dbtx.Exec("INSERT INTO block (height, hash, ts) VALUES (?, ?, ?)", height, hash, b.TimeUTC)
+	if err != nil {
+		return err
+	}
+	u.inserted("block", "height=?", height)
+
+	// The genesis block is hard-coded and checked by its hash
+	if height > 0 {
+		prevHash := ""
+		err = dbtx.QueryRow("SELECT hash FROM block WHERE height=?", height-1).Scan(&prevHash)
+		if err != nil {
+			return fmt.Errorf("Cannot get block at %d: %s", height-1, err.Error())
+		}
+		if b.PreviousBlockHash != prevHash {
+			return fmt.Errorf("Block %s at %d doesn't follow the block at %d: expecting previous block %s, got %s", hash, height, height-1, prevHash, b.PreviousBlockHash)
+		}
+		parent, err := dbGetBlockTreeEntry(dbtx, prevHash)
+		if err != nil {
+			return err
+		}
+		err = dbCheckBlockHeader(dbtx, b, parent)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = dbAddBlockTreeEntry(dbtx, b, height)
+	if err != nil {
+		return err
+	}
+
+	keys, err := dbApplyBlockTxs(dbtx, &u, b, height)
 	if err != nil {
 		return err
 	}
+	for i, btx := range b.Transactions {
+		tx := Tx{}
+		if err = json.Unmarshal([]byte(btx.TxData), &tx); err != nil {
+			return fmt.Errorf("Cannot unmarshall tx: %s", btx.TxHash)
+		}
+		_, err = dbtx.Exec("INSERT INTO block_tx (height, idx, hash, pubkey) VALUES (?, ?, ?, ?)", height, i, btx.TxHash, tx.SigningPubKey)
+		if err != nil {
+			return err
+		}
+	}
+	u.inserted("block_tx", "height=?", height)
+	stateHash, stateRoot, err := dbGetBlockStateHash(dbtx, b, height, keys)
+	if err != nil {
+		return err
+	}
+	if stateHash != b.StateHash {
+		return fmt.Errorf("StateHash doesn't match. Expecting %s, got %s", stateHash, b.StateHash)
+	}
+	// The block row is deleted when the block is reverted, so this needs no undo
+	_, err = dbtx.Exec("UPDATE block SET state_root=? WHERE height=?", mustEncodeBase64URL(stateRoot), height)
+	if err != nil {
+		return err
+	}
+	if height%stateTreePruneInterval == 0 {
+		if err = dbPruneStateTree(dbtx, height); err != nil {
+			return err
+		}
+	}
 
-	touchedPubKeys := []string{}
+	return dbSaveBlockUndo(dbtx, height, &u)
+}
+
+// Returns the state hash of a block whose transactions have been applied and have
+// changed the given state tree keys, and the root of the state tree after it. Since
+// version 3 the state hash is the root; older blocks hash only the account states
+// they have changed.
+func dbGetBlockStateHash(dbtx *sql.Tx, b BlockWithHeader, height int, keys []string) (string, []byte, error) {
+	root := stateTreeEmptyHashes[0]
+	if height > 0 {
+		var err error
+		if root, err = dbGetStateTreeRoot(dbtx, height-1); err != nil {
+			return "", nil, fmt.Errorf("Cannot get the state root at %d: %s", height-1, err.Error())
+		}
+	}
+	root, err := dbUpdateStateTree(dbtx, root, keys, b.Version >= 4)
+	if err != nil {
+		return "", nil, err
+	}
+	if b.Version >= 3 {
+		return mustEncodeBase64URL(root), root, nil
+	}
+	pubKeys := []string{}
+	for _, key := range keys {
+		if strings.HasPrefix(key, "s:") {
+			pubKeys = append(pubKeys, key[2:])
+		}
+	}
+	states, err := dbGetStates(dbtx, pubKeys)
+	if err != nil {
+		return "", nil, err
+	}
+	return states.getStrHash(), root, nil
+}
+
+// Applies the transactions of a block at the given height to the database, checks
+// the coinbase transaction, and returns the state tree keys the transactions have changed.
+func dbApplyBlockTxs(dbtx *sql.Tx, u *blockUndo, b BlockWithHeader, height int) ([]string, error) {
+	touchedKeys := []string{}
 	totalFees := uint64(0)
 	coinbaseAmount := uint64(0)
 	coinbaseCount := 0
 	for _, btx := range b.Transactions {
-		// Verify tx signature
-		tx, err := btx.VerifyBasics()
+		tx, touched, err := dbApplyTx(dbtx, u, &btx, height, b.Version)
 		if err != nil {
-			return err
+			return nil, err
 		}
-
-		senderBalance := uint64(0)
-		senderNonce := uint64(0)
-
-		isCoinbase := inStringSlice("coinbase", tx.Flags)
-		if isCoinbase {
+		touchedKeys = append(touchedKeys, touched...)
+		totalFees += uint64(tx.MinerFeeAmount)
+		if inStringSlice("coinbase", tx.Flags) {
 			coinbaseCount++
-		} else {
-			err = dbtx.QueryRow("SELECT balance, nonce FROM state WHERE pubkey=?", tx.SigningPubKey).Scan(&senderBalance, &senderNonce)
-			if err != nil && err != sql.ErrNoRows {
-				return err
-			}
-			if tx.PubKeyNonce != senderNonce+1 {
-				return fmt.Errorf("nonce out of sync for %s: expecting %d, got %d", tx.SigningPubKey, senderNonce+1, tx.PubKeyNonce)
-			}
-			// Check if outputs are possible, i.e. within current balances, and
-			// deduce them from the sender's balance.
 			for _, out := range tx.Outputs {
-				if out.Amount > senderBalance {
-					return fmt.Errorf("Transaction amount exeeds balance for %s. Balance is %v, got %v", tx.SigningPubKey, senderBalance, out.Amount)
-				}
-				senderBalance -= out.Amount
+				coinbaseAmount += out.Amount
 			}
-			senderNonce++
-			touchedPubKeys = append(touchedPubKeys, tx.SigningPubKey)
 		}
-		totalFees += uint64(tx.MinerFeeAmount)
+	}
 
-		// Import tx payload document data
-		if len(tx.Data) > 0 {
-			// fmt.Println(jsonifyWhatever(tx.Data))
+	if coinbaseCount != 1 {
+		return nil, fmt.Errorf("Exactly 1 coinbase expected in every block. Got %d", coinbaseCount)
+	}
+	if coinbaseAmount != getCoinbaseAtHeight(height)+totalFees {
+		return nil, fmt.Errorf("The sum of coinbase and fees is invalid. Expecting %v, got %v", coinbaseAmount, getCoinbaseAtHeight(height)+totalFees)
+	}
+	return touchedKeys, nil
+}
 
-			if tx.Data["_key"] != "" && tx.Data["_key"] != tx.SigningPubKey {
-				return fmt.Errorf("_key in tx %s doesn't match signing key. Expecting %s, got %s", btx.TxHash, tx.SigningPubKey, tx.Data["_key"])
+// Applies a transaction in a block of the given version at the given height to the
+// database, and returns it together with the state tree keys it has changed.
+func dbApplyTx(dbtx *sql.Tx, u *blockUndo, btx *BlockTransaction, height int, blockVersion uint) (Tx, []string, error) {
+	// Verify tx signature
+	tx, err := btx.VerifyBasics()
+	if err != nil {
+		return tx, nil, txReject(txRejectInvalid, "%s", err.Error())
+	}
+	touchedKeys := []string{}
+
+	senderBalance := uint64(0)
+	senderNonce := uint64(0)
+
+	isCoinbase := inStringSlice("coinbase", tx.Flags)
+	if isCoinbase && len(tx.Data) > 0 && height > 0 {
+		// Only the genesis block's is trusted, since coinbase transactions aren't signed
+		return tx, nil, txReject(txRejectPayload, "Coinbase tx %s can't have a payload", btx.TxHash)
+	}
+	if !isCoinbase && blockVersion >= 4 && tx.Version < MinTxVersion {
+		return tx, nil, txReject(txRejectInvalid, "Tx %s of version %d is older than version %d", btx.TxHash, tx.Version, MinTxVersion)
+	}
+	if !isCoinbase {
+		err = dbtx.QueryRow("SELECT balance, nonce FROM state WHERE pubkey=?", tx.SigningPubKey).Scan(&senderBalance, &senderNonce)
+		if err != nil && err != sql.ErrNoRows {
+			return tx, nil, err
+		}
+		if tx.PubKeyNonce != senderNonce+1 {
+			return tx, nil, txReject(txRejectNonce, "nonce out of sync for %s: expecting %d, got %d", tx.SigningPubKey, senderNonce+1, tx.PubKeyNonce)
+		}
+		// Check if outputs are possible, i.e. within current balances, and deduce them from
+		// the sender's balance. Since block version 5, so is the miner fee; older blocks
+		// can't have fees, which they would mint.
+		for _, out := range tx.Outputs {
+			if out.Amount > senderBalance {
+				return tx, nil, txReject(txRejectBalance, "Transaction amount exceeds balance for %s. Balance is %v, got %v", tx.SigningPubKey, senderBalance, out.Amount)
 			}
+			senderBalance -= out.Amount
+		}
+		if blockVersion >= 5 {
+			if tx.MinerFeeAmount > senderBalance {
+				return tx, nil, txReject(txRejectBalance, "Transaction fee exceeds balance for %s. Balance after outputs is %v, fee is %v", tx.SigningPubKey, senderBalance, tx.MinerFeeAmount)
+			}
+			senderBalance -= tx.MinerFeeAmount
+		} else if tx.MinerFeeAmount > 0 {
+			return tx, nil, txReject(txRejectInvalid, "Tx %s pays a miner fee, which blocks of version %d can't have", btx.TxHash, blockVersion)
+		}
+		senderNonce++
+		touchedKeys = append(touchedKeys, getStateTreeStateKey(tx.SigningPubKey))
+	}
+	// The tx is no longer pending, whoever mined it, and neither are other txs with its nonce
+	_, err = dbtx.Exec("DELETE FROM utx WHERE hash=? OR (sender=? AND nonce<=?)", btx.TxHash, tx.SigningPubKey, tx.PubKeyNonce)
+	if err != nil {
+		return tx, nil, err
+	}
+
+	// Import tx payload document data
+	if len(tx.Data) > 0 {
+		// fmt.Println(jsonifyWhatever(tx.Data))
+
+		if tx.Data.getString("_key") != "" && tx.Data.getString("_key") != tx.SigningPubKey {
+			return tx, nil, txReject(txRejectPayload, "_key in tx %s doesn't match signing key. Expecting %s, got %s", btx.TxHash, tx.SigningPubKey, tx.Data.getString("_key"))
+		}
 
-			publisher, err := dbGetPublisherbyKey(dbtx, tx.SigningPubKey, height)
+		var publisher *Publisher
+		if tx.Data.getString("_id") == "_intro" {
+			publisher, err = dbIntroducePublisher(dbtx, u, btx, &tx, height)
 			if err != nil {
-				if height > 0 {
-					return fmt.Errorf("Publisher not found for key %s: %s", tx.SigningPubKey, err.Error())
-				}
-				// Special handling for the genesis block
-				publisher, err = dbIntroducePublisher(dbtx, &btx, &tx, 0)
-				if err != nil {
-					return err
-				}
+				return tx, nil, txReject(txRejectPayload, "%s", err.Error())
 			}
-			for key, value := range tx.Data {
-				if key[0] == '_' {
-					continue
-				}
-				_, err := dbtx.Exec("INSERT OR REPLACE INTO fact(publisher_id, key, value) VALUES (?, ?, ?)", publisher.ID, key, value)
-				if err != nil {
-					return err
-				}
+			touchedKeys = append(touchedKeys, getStateTreePublisherCountKey())
+		} else {
+			if _, ok := tx.Data["_newkey"]; ok {
+				return tx, nil, txReject(txRejectPayload, "_newkey is only allowed in _intro documents, in %s", btx.TxHash)
 			}
-			err = dbSaveDocument(dbtx, publisher, &tx, height)
+			publisher, err = dbGetPublisherbyKey(dbtx, tx.SigningPubKey, height)
 			if err != nil {
-				return err
+				return tx, nil, txReject(txRejectPayload, "Publisher not found for key %s: %s", tx.SigningPubKey, err.Error())
 			}
 		}
-
-		// Update recipient states, collect receipts
-		for _, out := range tx.Outputs {
-			balance := uint64(0)
-			err := dbtx.QueryRow("SELECT balance FROM state WHERE pubkey=?", out.PubKey).Scan(&balance)
-			if err != nil {
-				if err != sql.ErrNoRows {
-					return err
+		// Control transactions don't replace the publisher's document, and their keys
+		// aren't the publisher's facts
+		if !tx.Data.isControl() {
+			for key, v := range tx.Data {
+				if strings.HasPrefix(key, "_") {
+					continue
 				}
-				// Output to a brand new address / state
-				_, err = dbtx.Exec("INSERT INTO state(pubkey, balance, nonce) VALUES (?, ?, ?)", out.PubKey, out.Amount, 1)
+				value, valueType := getFactValue(v)
+				err = u.save(dbtx, "fact", "publisher_id=? AND key=?", publisher.ID, key)
 				if err != nil {
-					return err
+					return tx, nil, err
 				}
-				//log.Println("Inserted new balance", out.PubKey, out.Amount)
-			} else {
-				newBalance := balance + out.Amount
-				_, err = dbtx.Exec("UPDATE state SET balance = ? WHERE pubkey = ?", newBalance, out.PubKey)
+				_, err := dbtx.Exec("INSERT OR REPLACE INTO fact(publisher_id, key, value, type) VALUES (?, ?, ?, ?)", publisher.ID, key, value, valueType)
 				if err != nil {
-					return err
+					return tx, nil, err
 				}
 			}
-			touchedPubKeys = append(touchedPubKeys, out.PubKey)
-			if isCoinbase {
-				coinbaseAmount += out.Amount
+			err = dbSaveDocument(dbtx, u, publisher, btx, &tx, height)
+			if err != nil {
+				return tx, nil, err
 			}
+			touchedKeys = append(touchedKeys, getStateTreeDocumentKey(publisher.ID, tx.Data.getString("_id")))
 		}
-
-		// Update sender balance state
-		if !isCoinbase {
-			_, err = dbtx.Exec("UPDATE state SET balance=?, nonce=? WHERE pubkey=?", senderBalance, senderNonce, tx.SigningPubKey)
+		touchedKeys = append(touchedKeys, getStateTreePubKeyKey(tx.SigningPubKey))
+		if tx.Data.getString("_newkey") != "" {
+			touchedKeys = append(touchedKeys, getStateTreePubKeyKey(tx.Data.getString("_newkey")))
+		}
+		if txHash, ok := tx.Data.lookup("_vouchtx"); ok {
+			err = dbVouchTx(dbtx, u, btx, publisher, txHash, height)
+			if err != nil {
+				return tx, nil, txReject(txRejectPayload, "%s", err.Error())
+			}
+		}
+		if txHash, ok := tx.Data.lookup("_unvouchtx"); ok {
+			err = dbUnvouchTx(dbtx, u, btx, publisher, txHash)
+			if err != nil {
+				return tx, nil, txReject(txRejectPayload, "%s", err.Error())
+			}
+		}
+		if target, ok := tx.Data.lookup("_follow"); ok {
+			err = dbFollow(dbtx, u, btx, publisher, target, height)
+			if err != nil {
+				return tx, nil, txReject(txRejectPayload, "%s", err.Error())
+			}
+		}
+		if target, ok := tx.Data.lookup("_unfollow"); ok {
+			err = dbUnfollow(dbtx, u, btx, publisher, target, height)
+			if err != nil {
+				return tx, nil, txReject(txRejectPayload, "%s", err.Error())
+			}
+		}
+		if target, ok := tx.Data.lookup("_trust"); ok {
+			err = dbSetTrustLevel(dbtx, u, btx, publisher, target, tx.Data.getString("_trustlevel"), height)
 			if err != nil {
-				return err
+				return tx, nil, txReject(txRejectPayload, "%s", err.Error())
 			}
+		} else if _, ok := tx.Data["_trustlevel"]; ok {
+			return tx, nil, txReject(txRejectPayload, "_trustlevel without _trust in %s", btx.TxHash)
+		}
+		if name, ok := tx.Data.lookup("_handle"); ok {
+			fee, err := dbRegisterHandle(dbtx, u, btx, &tx, publisher, height)
+			if err != nil {
+				return tx, nil, txReject(txRejectPayload, "%s", err.Error())
+			}
+			if fee > senderBalance {
+				return tx, nil, txReject(txRejectBalance, "The fee of _handle %s exceeds the balance of %s. Balance is %v, fee is %v", name, tx.SigningPubKey, senderBalance, fee)
+			}
+			// Burned rather than paid to the miner
+			senderBalance -= fee
+			touchedKeys = append(touchedKeys, getStateTreeHandleKey(name))
+		} else if _, ok := tx.Data["_handleto"]; ok {
+			return tx, nil, txReject(txRejectPayload, "_handleto without _handle in %s", btx.TxHash)
+		}
+		if _, ok := tx.Data["_delkey"]; ok {
+			err = dbRevokeKey(dbtx, u, btx, &tx, publisher, height)
+			if err != nil {
+				return tx, nil, txReject(txRejectPayload, "%s", err.Error())
+			}
+			touchedKeys = append(touchedKeys, getStateTreePubKeyKey(tx.Data.getString("_delkey")))
 		}
 	}
 
-	if coinbaseCount != 1 {
-		return fmt.Errorf("Exactly 1 coinbase expected in every block. Got %d", coinbaseCount)
-	}
-	if coinbaseAmount != getCoinbaseAtHeight(height)+totalFees {
-		return fmt.Errorf("The sum of coinbase and fees is invalid. Expecting %v, got %v", coinbaseAmount, getCoinbaseAtHeight(height)+totalFees)
+	// Update recipient states, collect receipts
+	for _, out := range tx.Outputs {
+		err = u.save(dbtx, "state", "pubkey=?", out.PubKey)
+		if err != nil {
+			return tx, nil, err
+		}
+		balance := uint64(0)
+		err := dbtx.QueryRow("SELECT balance FROM state WHERE pubkey=?", out.PubKey).Scan(&balance)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				return tx, nil, err
+			}
+			// Output to a brand new address / state
+			_, err = dbtx.Exec("INSERT INTO state(pubkey, balance, nonce) VALUES (?, ?, ?)", out.PubKey, out.Amount, 1)
+			if err != nil {
+				return tx, nil, err
+			}
+			//log.Println("Inserted new balance", out.PubKey, out.Amount)
+		} else {
+			newBalance := balance + out.Amount
+			_, err = dbtx.Exec("UPDATE state SET balance = ? WHERE pubkey = ?", newBalance, out.PubKey)
+			if err != nil {
+				return tx, nil, err
+			}
+		}
+		touchedKeys = append(touchedKeys, getStateTreeStateKey(out.PubKey))
 	}
 
-	states, err := dbGetStates(dbtx, touchedPubKeys)
-	if err != nil {
-		return err
-	}
-	stateHash := states.getStrHash()
-	if stateHash != b.StateHash {
-		log.Println("ERROR stateHash:", jsonifyWhatever(states))
-		return fmt.Errorf("StateHash doesn't match. Expecting %s, got %s", stateHash, b.StateHash)
+	// Update sender balance state
+	if !isCoinbase {
+		err = u.save(dbtx, "state", "pubkey=?", tx.SigningPubKey)
+		if err != nil {
+			return tx, nil, err
+		}
+		_, err = dbtx.Exec("UPDATE state SET balance=?, nonce=? WHERE pubkey=?", senderBalance, senderNonce, tx.SigningPubKey)
+		if err != nil {
+			return tx, nil, err
+		}
 	}
-
-	return nil
+	return tx, touchedKeys, nil
 }
 
+// Returns the publisher the key belongs to at the given block height. A key belongs
+// to the publisher from its since_block, and before its to_block, if it has been rotated,
+// and before its revoked_block, if it has been revoked.
 func dbGetPublisherbyKey(dbtx *sql.Tx, pubKey string, atBlock int) (*Publisher, error) {
-	p := Publisher{}
+	p := Publisher{CurrentPubKey: pubKey}
 	nullToBlock := sql.NullInt64{}
-	err := dbtx.QueryRow("SELECT id, publisher_id, since_block, to_block FROM publisher_pubkey WHERE pubkey=? ORDER BY since_block DESC", pubKey).Scan(&p.CurrentPubKeyID, &p.ID, &p.SinceBlock, &nullToBlock)
+	nullRevokedBlock := sql.NullInt64{}
+	err := dbtx.QueryRow("SELECT id, publisher_id, since_block, to_block, revoked_block FROM publisher_pubkey WHERE pubkey=? ORDER BY since_block DESC", pubKey).Scan(&p.CurrentPubKeyID, &p.ID, &p.SinceBlock, &nullToBlock, &nullRevokedBlock)
 	if err != nil {
 		return nil, fmt.Errorf("Error getting publisher for pubkey %s: %s", pubKey, err.Error())
 	}
 	p.ToBlock = int(nullToBlock.Int64)
+	p.RevokedBlock = int(nullRevokedBlock.Int64)
+	if nullRevokedBlock.Valid && atBlock >= p.RevokedBlock {
+		return nil, fmt.Errorf("Publisher's key has been revoked: %s from block %d", pubKey, p.RevokedBlock)
+	}
 	err = dbtx.QueryRow("SELECT name FROM publisher WHERE id=?", p.ID).Scan(&p.Name)
 	if err != nil {
 		return nil, fmt.Errorf("Error getting publisher by ID %d", p.ID)
 	}
-	if nullToBlock.Valid && nullToBlock.Int64 > 0 {
-		if p.SinceBlock >= atBlock && atBlock <= p.ToBlock {
-			return &p, nil
-		}
-	} else {
-		if p.SinceBlock >= atBlock {
-			return &p, nil
-		}
+	if p.SinceBlock <= atBlock && (!nullToBlock.Valid || atBlock < p.ToBlock) {
+		return &p, nil
 	}
 	return nil, fmt.Errorf("Publisher's key has expired: %s at block %d", pubKey, atBlock)
 }
 
-func dbSaveDocument(dbtx *sql.Tx, publisher *Publisher, tx *Tx, height int) error {
-	_, err := dbtx.Exec("INSERT OR REPLACE INTO document (publisher_id, id, block) VALUES (?, ?, ?)", publisher.ID, tx.Data["_id"], height)
-	return err
-}
-
-func dbIntroducePublisher(dbtx *sql.Tx, btx *BlockTransaction, tx *Tx, height int) (*Publisher, error) {
-	id, ok := tx.Data["_id"]
-	if !ok {
-		return nil, fmt.Errorf("Missing _id in %s", btx.TxHash)
+// Saves the document as the next version of the publisher's document with its _id,
+// which becomes the latest one. The earlier versions are kept. The signed transaction
+// is stored with it, so the document can be verified without the block.
+func dbSaveDocument(dbtx *sql.Tx, u *blockUndo, publisher *Publisher, btx *BlockTransaction, tx *Tx, height int) error {
+	docID := tx.Data.getString("_id")
+	latestID := 0
+	version := 0
+	err := dbtx.QueryRow("SELECT id, version FROM document WHERE publisher_id=? AND doc_id=? AND latest=1", publisher.ID, docID).Scan(&latestID, &version)
+	if err != nil && err != sql.ErrNoRows {
+		return err
 	}
-	if id != "_intro" {
-		return nil, fmt.Errorf("Trying to introduce a publisher without _id in %s", btx.TxHash)
+	if latestID != 0 {
+		if err = u.save(dbtx, "document", "id=?", latestID); err != nil {
+			return err
+		}
+		if _, err = dbtx.Exec("UPDATE document SET latest=0 WHERE id=?", latestID); err != nil {
+			return err
+		}
 	}
-
-	name, ok := tx.Data["_name"]
-	if !ok {
-		return nil, fmt.Errorf("Trying to introduce a publisher without _name in %s", btx.TxHash)
+	res, err := dbtx.Exec("INSERT INTO document (publisher_id, doc_id, version, block, tx_hash, pubkey) VALUES (?, ?, ?, ?, ?, ?)", publisher.ID, docID, version+1, height, btx.TxHash, tx.SigningPubKey)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
 	}
+	u.inserted("document", "id=?", id)
+	_, err = dbtx.Exec("INSERT INTO document_content (tx_hash, tx_data, signature) VALUES (?, ?, ?)", btx.TxHash, btx.TxData, btx.Signature)
+	if err != nil {
+		return err
+	}
+	u.inserted("document_content", "tx_hash=?", btx.TxHash)
+	return nil
+}
 
-	pubKey, ok := tx.Data["_key"]
-	if !ok {
+// Imports an _intro document, which either introduces a new publisher with its _key
+// and _name, or, if it's signed by the current key of a publisher and has a _newkey,
+// rotates the publisher's key: the old key belongs to the publisher before this block,
+// and the new key from this block on, so only one of them can publish in any block.
+// Documents signed by the old key before the rotation remain the publisher's.
+func dbIntroducePublisher(dbtx *sql.Tx, u *blockUndo, btx *BlockTransaction, tx *Tx, height int) (*Publisher, error) {
+	pubKey := tx.Data.getString("_key")
+	if pubKey == "" {
 		return nil, fmt.Errorf("Trying to introduce a publisher without _key in %s", btx.TxHash)
 	}
 
-	publisherID := 0
-	publisherPubKeyID := 0
-	publisherSinceBlock := 0
-	err := dbtx.QueryRow("SELECT publisher_id, id, since_block FROM publisher_pubkey WHERE pubkey=?", pubKey).Scan(&publisherID, &publisherPubKeyID, &publisherSinceBlock)
-	if err == nil {
+	count := 0
+	err := dbtx.QueryRow("SELECT COUNT(*) FROM publisher_pubkey WHERE pubkey=?", pubKey).Scan(&count)
+	if err != nil {
+		return nil, err
+	}
+	if count > 0 {
 		// The publisher already exists, so this operation can only replace its key
-		newKey, ok := tx.Data["_newkey"]
+		p, err := dbGetPublisherbyKey(dbtx, pubKey, height)
+		if err != nil {
+			return nil, err
+		}
+		if p.ToBlock != 0 {
+			return nil, fmt.Errorf("The key %s has already been replaced, in %s", pubKey, btx.TxHash)
+		}
+		newKey, ok := tx.Data.lookup("_newkey")
 		if !ok {
 			return nil, fmt.Errorf("Trying to re-introduce (replace key) a publisher without _newkey in %s", btx.TxHash)
 		}
-		res, err := dbtx.Exec("INSERT INTO publisher_pubkey (publisher_id, pubkey, since_block) VALUES (?, ?, ?)", publisherID, newKey, height)
-		if err != nil {
-			dbtx.Rollback()
-			return nil, err
+		if _, err = DecodePublicKeyString(newKey); err != nil {
+			return nil, fmt.Errorf("Invalid _newkey in %s: %s", btx.TxHash, err.Error())
 		}
-		lastPubKeyID, err := res.LastInsertId()
+		err = dbtx.QueryRow("SELECT COUNT(*) FROM publisher_pubkey WHERE pubkey=?", newKey).Scan(&count)
 		if err != nil {
-			dbtx.Rollback()
 			return nil, err
 		}
-		publisherPubKeyID = int(lastPubKeyID)
-		_, err = dbtx.Exec("UPDATE publisher SET name=? WHERE id=?", name, publisherID)
+		if count > 0 {
+			return nil, fmt.Errorf("The _newkey %s in %s has already been used by a publisher", newKey, btx.TxHash)
+		}
+		// The old key doesn't belong to the publisher in this block anymore
+		err = dbtx.QueryRow("SELECT COUNT(*) FROM document WHERE pubkey=? AND block=?", pubKey, height).Scan(&count)
 		if err != nil {
-			dbtx.Rollback()
 			return nil, err
 		}
-	} else {
-		// Brand new publisher
-		res, err := dbtx.Exec("INSERT INTO publisher (name) VALUES (?)", name)
+		if count > 0 {
+			return nil, fmt.Errorf("The key %s has published a document in block %d, and can only be replaced in a later block, in %s", pubKey, height, btx.TxHash)
+		}
+		err = u.save(dbtx, "publisher_pubkey", "id=?", p.CurrentPubKeyID)
 		if err != nil {
 			return nil, err
 		}
-		lastID, err := res.LastInsertId()
+		_, err = dbtx.Exec("UPDATE publisher_pubkey SET to_block=? WHERE id=?", height, p.CurrentPubKeyID)
 		if err != nil {
 			return nil, err
 		}
-		publisherID := int(lastID)
-		res, err = dbtx.Exec("INSERT INTO publisher_pubkey (publisher_id, pubkey, since_block) VALUES (?,?,?)", publisherID, pubKey, height)
+		res, err := dbtx.Exec("INSERT INTO publisher_pubkey (publisher_id, pubkey, since_block) VALUES (?, ?, ?)", p.ID, newKey, height)
 		if err != nil {
 			return nil, err
 		}
-		lastKeyID, err := res.LastInsertId()
+		lastPubKeyID, err := res.LastInsertId()
 		if err != nil {
 			return nil, err
 		}
-		publisherPubKeyID = int(lastKeyID)
-		publisherSinceBlock = height
+		u.inserted("publisher_pubkey", "id=?", lastPubKeyID)
+		if name, ok := tx.Data.lookup("_name"); ok {
+			err = u.save(dbtx, "publisher", "id=?", p.ID)
+			if err != nil {
+				return nil, err
+			}
+			_, err = dbtx.Exec("UPDATE publisher SET name=? WHERE id=?", name, p.ID)
+			if err != nil {
+				return nil, err
+			}
+			p.Name = name
+		}
+		return &Publisher{ID: p.ID, CurrentPubKeyID: int(lastPubKeyID), CurrentPubKey: newKey, Name: p.Name, SinceBlock: height}, nil
+	}
+
+	// Brand new publisher
+	if _, ok := tx.Data["_newkey"]; ok {
+		return nil, fmt.Errorf("Trying to replace the key of a publisher which doesn't exist in %s", btx.TxHash)
+	}
+	name, ok := tx.Data.lookup("_name")
+	if !ok {
+		return nil, fmt.Errorf("Trying to introduce a publisher without _name in %s", btx.TxHash)
+	}
+	// Publishers are numbered in the order of their introduction in the chain, which
+	// the state tree commits to with the number of publishers
+	publisherID := 0
+	err = dbtx.QueryRow("SELECT COUNT(*) FROM publisher").Scan(&publisherID)
+	if err != nil {
+		return nil, err
+	}
+	publisherID++
+	_, err = dbtx.Exec("INSERT INTO publisher (id, name) VALUES (?, ?)", publisherID, name)
+	if err != nil {
+		return nil, err
 	}
+	u.inserted("publisher", "id=?", publisherID)
+	res, err := dbtx.Exec("INSERT INTO publisher_pubkey (publisher_id, pubkey, since_block) VALUES (?,?,?)", publisherID, pubKey, height)
+	if err != nil {
+		return nil, err
+	}
+	lastKeyID, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	u.inserted("publisher_pubkey", "id=?", lastKeyID)
+	return &Publisher{ID: publisherID, CurrentPubKeyID: int(lastKeyID), CurrentPubKey: pubKey, Name: name, SinceBlock: height}, nil
+}
 
-	p := Publisher{ID: publisherID, CurrentPubKeyID: publisherPubKeyID, CurrentPubKey: pubKey, Name: name, SinceBlock: publisherSinceBlock}
-	return &p, nil
+// Revokes the _delkey of the publisher, from the block _delfrom if given, or from this
+// block. The key can't publish for the publisher from then on, and the documents it
+// has signed from then on are marked as signed by a revoked key. The key must be one of
+// the publisher's, and the transaction must be signed by a key the publisher can
+// still use, which may be the revoked key itself.
+func dbRevokeKey(dbtx *sql.Tx, u *blockUndo, btx *BlockTransaction, tx *Tx, publisher *Publisher, height int) error {
+	pubKey := tx.Data.getString("_delkey")
+	fromBlock := height
+	if from, ok := tx.Data.lookup("_delfrom"); ok {
+		var err error
+		if fromBlock, err = strconv.Atoi(from); err != nil || fromBlock < 1 || fromBlock > height {
+			return fmt.Errorf("Invalid _delfrom in %s: %s", btx.TxHash, from)
+		}
+	}
+	id := 0
+	publisherID := 0
+	sinceBlock := 0
+	revokedBlock := sql.NullInt64{}
+	err := dbtx.QueryRow("SELECT id, publisher_id, since_block, revoked_block FROM publisher_pubkey WHERE pubkey=?", pubKey).Scan(&id, &publisherID, &sinceBlock, &revokedBlock)
+	if err == sql.ErrNoRows || err == nil && publisherID != publisher.ID {
+		return fmt.Errorf("The _delkey %s in %s is not a key of publisher %d", pubKey, btx.TxHash, publisher.ID)
+	}
+	if err != nil {
+		return err
+	}
+	if revokedBlock.Valid {
+		return fmt.Errorf("The _delkey %s in %s has already been revoked", pubKey, btx.TxHash)
+	}
+	if fromBlock < sinceBlock {
+		fromBlock = sinceBlock
+	}
+	err = u.save(dbtx, "publisher_pubkey", "id=?", id)
+	if err != nil {
+		return err
+	}
+	_, err = dbtx.Exec("UPDATE publisher_pubkey SET revoked_block=? WHERE id=?", fromBlock, id)
+	return err
 }
 
 func dbGetStates(dbtx *sql.Tx, pubkeys []string) (AccountStates, error) {
@@ -463,66 +1113,68 @@ func dbGetStates(dbtx *sql.Tx, pubkeys []string) (AccountStates, error) {
 	return result, nil
 }
 
-func dbSimStateHashStr(dbtx *sql.Tx, block BlockWithHeader) (string, error) {
-	touchedAddressesMap := map[string]bool{}
-	for _, btx := range block.Transactions {
-		tx := Tx{}
-		err := json.Unmarshal([]byte(btx.TxData), &tx)
-		if err != nil {
-			return "", err
-		}
-		if !inStringSlice("coinbase", tx.Flags) {
-			touchedAddressesMap[tx.SigningPubKey] = true
-		}
-		for _, out := range tx.Outputs {
-			touchedAddressesMap[out.PubKey] = true
+// Calls f within a savepoint of the transaction. The changes f makes are kept if it
+// succeeds and rolled back if it fails, or always rolled back if rollback is true.
+func dbWithSavepoint(dbtx *sql.Tx, name string, rollback bool, f func() error) error {
+	_, err := dbtx.Exec("SAVEPOINT " + name)
+	if err != nil {
+		return err
+	}
+	err = f()
+	if err != nil || rollback {
+		if _, rerr := dbtx.Exec("ROLLBACK TO " + name); rerr != nil && err == nil {
+			err = rerr
 		}
 	}
-	touchedAddresses := []string{}
-	for a := range touchedAddressesMap {
-		touchedAddresses = append(touchedAddresses, a)
+	if _, rerr := dbtx.Exec("RELEASE " + name); rerr != nil && err == nil {
+		err = rerr
 	}
-	states, err := dbGetStates(dbtx, touchedAddresses)
+	return err
+}
+
+func dbExistsUtx(hash string) bool {
+	count := 0
+	err := db.QueryRow("SELECT COUNT(*) FROM utx WHERE hash=?", hash).Scan(&count)
 	if err != nil {
-		return "", err
+		log.Panic(err)
 	}
-	//fmt.Println("before:", jsonifyWhatever(states))
+	return count != 0
+}
 
-	coinbaseCount := 0
-	for _, btx := range block.Transactions {
-		tx := Tx{}
-		json.Unmarshal([]byte(btx.TxData), &tx)
+// Returns true if the transaction has recently been dropped from the pool
+func dbIsDroppedUtx(hash string) bool {
+	count := 0
+	err := db.QueryRow("SELECT COUNT(*) FROM utx_dropped WHERE hash=?", hash).Scan(&count)
+	if err != nil {
+		log.Panic(err)
+	}
+	return count != 0
+}
 
-		isCoinbase := inStringSlice("coinbase", tx.Flags)
-		if isCoinbase {
-			coinbaseCount++
-		} else {
-			if states[tx.SigningPubKey] == nil {
-				return "", fmt.Errorf("No state to send from for tx %s", btx.TxHash)
-			}
-		}
+func dbGetUtx(hash string) (BlockTransaction, error) {
+	btx := BlockTransaction{}
+	txData := ""
+	err := db.QueryRow("SELECT tx FROM utx WHERE hash=?", hash).Scan(&txData)
+	if err != nil {
+		return btx, err
+	}
+	err = json.Unmarshal([]byte(txData), &btx)
+	return btx, err
+}
 
-		// XXX: fees accounting?!
-		// XXX: mining needs a better way to be notified of an invalid tx; custom error type?
-		for _, out := range tx.Outputs {
-			if !isCoinbase {
-				if out.Amount < states[tx.SigningPubKey].Balance {
-					states[tx.SigningPubKey].Balance -= out.Amount
-					states[tx.SigningPubKey].Nonce++
-					if states[tx.SigningPubKey].Nonce != tx.PubKeyNonce {
-						return btx.TxHash, fmt.Errorf("[sim] nonce out of sync for tx %s: expecting %d, got %d", btx.TxHash, states[tx.SigningPubKey].Nonce, tx.PubKeyNonce)
-					}
-				} else {
-					return "", fmt.Errorf("Not enough balance for tx %s", btx.TxHash)
-				}
-			}
-			if states[out.PubKey] == nil {
-				states[out.PubKey] = &RawAccountState{Balance: out.Amount, Nonce: 1}
-			} else {
-				states[out.PubKey].Balance += out.Amount
-			}
+func dbGetUtxHashes() ([]string, error) {
+	rows, err := db.Query("SELECT hash FROM utx ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hashes := []string{}
+	for rows.Next() {
+		hash := ""
+		if err = rows.Scan(&hash); err != nil {
+			return nil, err
 		}
+		hashes = append(hashes, hash)
 	}
-	//fmt.Println("after:", jsonifyWhatever(states))
-	return states.getStrHash(), nil
+	return hashes, rows.Err()
 }
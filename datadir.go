@@ -2,7 +2,9 @@ package main
 
 import (
 	"compress/gzip"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
@@ -12,10 +14,12 @@ import (
 )
 
 const blocksDirectoryName = "blocks"
+const forksDirectoryName = "forks" // blocks which are not (or no longer) in the main chain
 const blockFileFormat = "%010d %s.gz"
 const blockFileGlob = "*.gz"
 
 var blocksDir = ""
+var forksDir = ""
 var currentBlockHeight = 0
 
 var reBlockFilename = regexp.MustCompile(`^([0-9]+) (.+?)\.gz$`)
@@ -23,11 +27,16 @@ var reBlockFilename = regexp.MustCompile(`^([0-9]+) (.+?)\.gz$`)
 func initDataDir() {
 	log.Println("Data directory:", *dataDir)
 	blocksDir = path.Join(*dataDir, blocksDirectoryName)
+	forksDir = path.Join(*dataDir, forksDirectoryName)
 	if _, err := os.Stat(*dataDir); os.IsNotExist(err) {
 		bootstrapDataDir()
 	} else if !dbFilePresent() || countDataDirBlocks() < 1 {
 		bootstrapDataDir()
 	}
+	err := os.Mkdir(forksDir, 0750)
+	if err != nil && !os.IsExist(err) {
+		log.Fatal(err)
+	}
 }
 
 func countDataDirBlocks() int {
@@ -43,6 +52,10 @@ func getBlockFilename(b BlockWithHeader, height int) string {
 	return path.Join(blocksDir, fmt.Sprintf(blockFileFormat, height, b.BlockHeader.Hash))
 }
 
+func getForkBlockFilename(height int, hash string) string {
+	return path.Join(forksDir, fmt.Sprintf(blockFileFormat, height, hash))
+}
+
 func getBlockDataFromFilename(fn string) (int, string) {
 	base := filepath.Base(fn)
 	m := reBlockFilename.FindStringSubmatch(base)
@@ -69,8 +82,16 @@ func bootstrapDataDir() {
 }
 
 func dataDirSaveBlock(b BlockWithHeader, height int) error {
-	fname := getBlockFilename(b, height)
-	// Write the genesis block data file. All block files are gzipped.
+	return saveBlockFile(b, getBlockFilename(b, height))
+}
+
+// Saves a block which is not in the main chain
+func dataDirSaveForkBlock(b BlockWithHeader, height int) error {
+	return saveBlockFile(b, getForkBlockFilename(height, b.BlockHeader.Hash))
+}
+
+func saveBlockFile(b BlockWithHeader, fname string) error {
+	// Write the block data file. All block files are gzipped.
 	f, err := os.Create(fname)
 	if err != nil {
 		return err
@@ -98,6 +119,50 @@ func dataDirSaveBlock(b BlockWithHeader, height int) error {
 	return nil
 }
 
+// Reads the (uncompressed) block data from the given block file
+func dataDirReadBlockFile(fn string) ([]byte, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zf, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer zf.Close()
+	return ioutil.ReadAll(zf)
+}
+
+// Loads the block with the given height and hash from the data directory,
+// either from the main chain or from the forks
+func dataDirLoadBlock(height int, hash string) (BlockWithHeader, error) {
+	b := BlockWithHeader{BlockHeader: BlockHeader{Hash: hash}}
+	bData, err := dataDirReadBlockFile(path.Join(blocksDir, fmt.Sprintf(blockFileFormat, height, hash)))
+	if os.IsNotExist(err) {
+		bData, err = dataDirReadBlockFile(getForkBlockFilename(height, hash))
+	}
+	if err != nil {
+		return b, err
+	}
+	err = json.Unmarshal(bData, &b.Block)
+	return b, err
+}
+
 func dataDirDeleteBlock(b BlockWithHeader, height int) error {
 	return os.Remove(getBlockFilename(b, height))
 }
+
+func dataDirDeleteForkBlock(height int, hash string) error {
+	return os.Remove(getForkBlockFilename(height, hash))
+}
+
+// Moves a block file from the main chain to the forks directory
+func dataDirMoveBlockToForks(height int, hash string) error {
+	return os.Rename(path.Join(blocksDir, fmt.Sprintf(blockFileFormat, height, hash)), getForkBlockFilename(height, hash))
+}
+
+// Moves a block file from the forks directory to the main chain
+func dataDirMoveBlockFromForks(height int, hash string) error {
+	return os.Rename(getForkBlockFilename(height, hash), path.Join(blocksDir, fmt.Sprintf(blockFileFormat, height, hash)))
+}
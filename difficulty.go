@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// Difficulty is the number of leading zero bits a block hash must have. It is
+// retargeted every DifficultyRetargetInterval blocks, from the time it took to mine
+// the previous DifficultyRetargetInterval blocks (according to their TimeUTC), so that
+// blocks are mined every TargetBlockTime seconds on average. Since every bit doubles
+// the work needed, the difficulty is changed by the (rounded) binary logarithm of the
+// ratio between the expected and the actual time, and by at most MaxDifficultyChange bits.
+
+const TargetBlockTime = 60 // seconds
+const DifficultyRetargetInterval = 20
+const MinBlockDifficulty = GenesisBlockDifficulty
+const MaxBlockDifficulty = 255
+const MaxDifficultyChange = 4
+
+// Returns the amount of work (the expected number of hashes) needed to mine a block
+// with the given difficulty
+func getDifficultyWork(diff int) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(diff))
+}
+
+// Returns the difficulty of the block following the given block
+func getNextBlockDifficulty(q dbQueryer, prev *blockTreeEntry) (int, error) {
+	height := prev.Height + 1
+	if height%DifficultyRetargetInterval != 0 {
+		return prev.Difficulty, nil
+	}
+	first := prev
+	var err error
+	for i := 0; i < DifficultyRetargetInterval && first.Height > 0; i++ {
+		first, err = dbGetBlockTreeEntry(q, first.PreviousHash)
+		if err != nil {
+			return 0, fmt.Errorf("Cannot get block for difficulty retarget: %s", err.Error())
+		}
+	}
+	return retargetDifficulty(prev.Difficulty, prev.TimeUTC-first.TimeUTC, int64(prev.Height-first.Height)*TargetBlockTime), nil
+}
+
+// Returns the new difficulty, given the time it took to mine the last blocks and
+// the time it was expected to take
+func retargetDifficulty(diff int, actualTime, expectedTime int64) int {
+	if actualTime < 1 {
+		actualTime = 1
+	}
+	change := int(math.Round(math.Log2(float64(expectedTime) / float64(actualTime))))
+	if change > MaxDifficultyChange {
+		change = MaxDifficultyChange
+	} else if change < -MaxDifficultyChange {
+		change = -MaxDifficultyChange
+	}
+	diff += change
+	if diff < MinBlockDifficulty {
+		diff = MinBlockDifficulty
+	} else if diff > MaxBlockDifficulty {
+		diff = MaxBlockDifficulty
+	}
+	return diff
+}
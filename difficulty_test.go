@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestRetargetDifficulty(t *testing.T) {
+	expected := int64(DifficultyRetargetInterval * TargetBlockTime)
+	for _, v := range []struct {
+		diff       int
+		actualTime int64
+		out        int
+	}{
+		{20, expected, 20},
+		{20, expected / 2, 21},
+		{20, expected / 3, 22},
+		{20, expected * 2, 19},
+		{20, expected * 3, 18},
+		{20, expected / 16, 24},
+		{20, expected / 1000, 24},
+		{20, 0, 24},
+		{20, -100, 24},
+		{20, expected * 1000, 16},
+		{MinBlockDifficulty, expected * 2, MinBlockDifficulty},
+		{MinBlockDifficulty + 1, expected * 16, MinBlockDifficulty},
+		{MaxBlockDifficulty - 1, expected / 16, MaxBlockDifficulty},
+	} {
+		if out := retargetDifficulty(v.diff, v.actualTime, expected); out != v.out {
+			t.Errorf("Difficulty %d after %d s: expecting %d, got %d", v.diff, v.actualTime, v.out, out)
+		}
+	}
+}
+
+func TestDifficultyWork(t *testing.T) {
+	if w := getDifficultyWork(0); w.Int64() != 1 {
+		t.Errorf("Expecting 1, got %s", w)
+	}
+	if w := getDifficultyWork(20); w.Int64() != 1<<20 {
+		t.Errorf("Expecting %d, got %s", 1<<20, w)
+	}
+	if w := getDifficultyWork(MaxBlockDifficulty); w.BitLen() != MaxBlockDifficulty+1 {
+		t.Errorf("Expecting %d bits, got %d", MaxBlockDifficulty+1, w.BitLen())
+	}
+}
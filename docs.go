@@ -1,3 +1,433 @@
 package main
 
-type PublishedData map[string]string
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The payload document of a transaction, which is any JSON object. The values of its
+// reserved keys, which begin with an underscore, must be strings. Numbers are decoded
+// as json.Number, so that they keep their digits, and the canonical encoding rejects
+// the numbers it would have to round.
+type PublishedData map[string]interface{}
+
+func (d *PublishedData) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	m := map[string]interface{}{}
+	if err := dec.Decode(&m); err != nil {
+		return err
+	}
+	*d = m
+	return nil
+}
+
+// Returns the value of the key if it's a string, or ""
+func (d PublishedData) getString(key string) string {
+	s, _ := d[key].(string)
+	return s
+}
+
+// Returns the value of the key if it's a string, and whether the key is present
+func (d PublishedData) lookup(key string) (string, bool) {
+	v, ok := d[key]
+	s, _ := v.(string)
+	return s, ok
+}
+
+// Checks that the values of the reserved keys are strings
+func (d PublishedData) checkReservedKeys() error {
+	for key, value := range d {
+		if _, ok := value.(string); strings.HasPrefix(key, "_") && !ok {
+			return fmt.Errorf("The value of the reserved key %s is not a string", key)
+		}
+	}
+	return nil
+}
+
+// Returns true if the document's _id is a reserved one other than _intro, e.g. _delkey,
+// or if it's an _intro which replaces the publisher's key, which makes it a control
+// transaction rather than a document of the publisher
+func (d PublishedData) isControl() bool {
+	id := d.getString("_id")
+	if id == "_intro" {
+		_, ok := d["_newkey"]
+		return ok
+	}
+	return strings.HasPrefix(id, "_")
+}
+
+// Returns the fact value and type of a top-level value of a payload: strings are stored
+// as they are, and other values as their JSON
+func getFactValue(value interface{}) (string, string) {
+	switch v := value.(type) {
+	case string:
+		return v, "string"
+	case json.Number:
+		return v.String(), "number"
+	case bool:
+		return jsonifyWhatever(v), "boolean"
+	case nil:
+		return "null", "null"
+	case []interface{}:
+		return jsonifyWhatever(v), "array"
+	default:
+		return jsonifyWhatever(v), "object"
+	}
+}
+
+// Every document a publisher publishes with the same _id is a new version of the
+// document, numbered from 1. All the versions are kept, and the latest one is marked
+// as such, and is the one in the state tree under the publisher and the _id. Control
+// transactions, whose _id is reserved, aren't documents.
+
+// A version of a publisher's document, as returned by /api/document and /api/docversions
+type publisherDocument struct {
+	PublisherID   int           `json:"publisher_id"`
+	PublisherName string        `json:"publisher_name"`
+	ID            string        `json:"id"`
+	Version       int           `json:"version"`
+	Latest        bool          `json:"latest"` // the latest version of the document with the id
+	Block         int           `json:"block"`
+	TxHash        string        `json:"tx_hash"`
+	PubKey        string        `json:"pubkey"`
+	Revoked       bool          `json:"revoked"` // the key which signed it was revoked from its block on
+	Data          PublishedData `json:"data,omitempty"`
+}
+
+// The differences between two versions of a document, as returned by /api/docdiff
+type documentDiff struct {
+	PublisherID int                       `json:"publisher_id"`
+	ID          string                    `json:"id"`
+	From        int                       `json:"from"`
+	To          int                       `json:"to"`
+	Added       map[string]interface{}    `json:"added"`
+	Removed     map[string]interface{}    `json:"removed"`
+	Changed     map[string]documentChange `json:"changed"`
+}
+
+// A top-level value changed between two versions of a document
+type documentChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// Returns the document versions matching the where clause on the document table, without their data
+func dbGetDocuments(where string, args ...interface{}) ([]publisherDocument, error) {
+	rows, err := db.Query(fmt.Sprintf(`SELECT document.publisher_id, publisher.name, document.doc_id, document.version, document.latest, document.block, document.tx_hash, document.pubkey, publisher_pubkey.revoked_block
+		FROM document JOIN publisher ON publisher.id=document.publisher_id JOIN publisher_pubkey ON publisher_pubkey.pubkey=document.pubkey
+		WHERE %s ORDER BY document.block DESC, document.id DESC`, where), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	docs := []publisherDocument{}
+	for rows.Next() {
+		d := publisherDocument{}
+		revokedBlock := sql.NullInt64{}
+		if err = rows.Scan(&d.PublisherID, &d.PublisherName, &d.ID, &d.Version, &d.Latest, &d.Block, &d.TxHash, &d.PubKey, &revokedBlock); err != nil {
+			return nil, err
+		}
+		d.Revoked = revokedBlock.Valid && int(revokedBlock.Int64) <= d.Block
+		docs = append(docs, d)
+	}
+	return docs, rows.Err()
+}
+
+// Returns the document version matching the where clause, with its data, or sql.ErrNoRows
+func dbGetDocument(where string, args ...interface{}) (*publisherDocument, error) {
+	docs, err := dbGetDocuments(where, args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	d := docs[0]
+	if err = d.loadData(); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// Loads the data of the document from its stored transaction
+func (d *publisherDocument) loadData() error {
+	txData := ""
+	err := db.QueryRow("SELECT tx_data FROM document_content WHERE tx_hash=?", d.TxHash).Scan(&txData)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("Tx %s is not in the document store", d.TxHash)
+	}
+	if err != nil {
+		return err
+	}
+	tx := Tx{}
+	if err = json.Unmarshal([]byte(txData), &tx); err != nil {
+		return fmt.Errorf("Cannot unmarshall tx: %s", d.TxHash)
+	}
+	d.Data = tx.Data
+	return nil
+}
+
+// Returns the signed transaction with the document, exactly as it was published, and
+// where it is in the main chain
+func dbGetDocumentContent(txHash string) (*documentContent, error) {
+	c := documentContent{TxHash: txHash}
+	err := db.QueryRow(`SELECT block_tx.height, block_tx.idx, block.hash, document_content.tx_data, document_content.signature
+		FROM document_content JOIN block_tx ON block_tx.hash=document_content.tx_hash JOIN block ON block.height=block_tx.height
+		WHERE document_content.tx_hash=? ORDER BY block_tx.height DESC LIMIT 1`, txHash).Scan(&c.Height, &c.Index, &c.BlockHash, &c.TxData, &c.Signature)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Checks that the data matches the hash, and that it's signed by the key in it
+func (c *documentContent) verify() error {
+	btx := BlockTransaction{TxHash: c.TxHash, TxData: c.TxData, Signature: c.Signature}
+	_, err := btx.VerifyBasics()
+	return err
+}
+
+// Returns the publisher's latest document
+func dbGetPublisherDocument(publisherID int) (*publisherDocument, error) {
+	return dbGetDocument("document.publisher_id=?", publisherID)
+}
+
+// Returns the given version of the publisher's document with the _id, or the latest
+// version if version is 0
+func dbGetDocumentVersion(publisherID int, docID string, version int) (*publisherDocument, error) {
+	if version == 0 {
+		return dbGetDocument("document.publisher_id=? AND document.doc_id=? AND document.latest=1", publisherID, docID)
+	}
+	return dbGetDocument("document.publisher_id=? AND document.doc_id=? AND document.version=?", publisherID, docID, version)
+}
+
+// Returns the versions of the publisher's document with the _id, from the latest one
+func dbGetDocumentVersions(publisherID int, docID string) ([]publisherDocument, error) {
+	return dbGetDocuments("document.publisher_id=? AND document.doc_id=?", publisherID, docID)
+}
+
+// A signed transaction with a document, as returned by /api/doccontent. Anyone can
+// verify it: the hash is the hash of the data, and the signature is made over the data
+// by the key in its "k" field.
+type documentContent struct {
+	TxHash    string `json:"tx_hash"`
+	Height    int    `json:"height"`
+	Index     int    `json:"index"` // of the transaction in the block
+	BlockHash string `json:"block_hash"`
+	TxData    string `json:"tx_data"`
+	Signature string `json:"signature"`
+}
+
+// Returns the differences of the top-level values of two versions of a document
+func diffDocuments(from, to *publisherDocument) (documentDiff, error) {
+	diff := documentDiff{PublisherID: from.PublisherID, ID: from.ID, From: from.Version, To: to.Version,
+		Added: map[string]interface{}{}, Removed: map[string]interface{}{}, Changed: map[string]documentChange{}}
+	for key, v := range from.Data {
+		toV, ok := to.Data[key]
+		if !ok {
+			diff.Removed[key] = v
+			continue
+		}
+		// Older transactions needn't be in the canonical encoding, so their values can fail to encode
+		fromJSON, err := canonicalJSON(v)
+		if err != nil {
+			return diff, fmt.Errorf("Cannot compare %s in version %d: %s", key, from.Version, err.Error())
+		}
+		toJSON, err := canonicalJSON(toV)
+		if err != nil {
+			return diff, fmt.Errorf("Cannot compare %s in version %d: %s", key, to.Version, err.Error())
+		}
+		if !bytes.Equal(fromJSON, toJSON) {
+			diff.Changed[key] = documentChange{From: v, To: toV}
+		}
+	}
+	for key, v := range to.Data {
+		if _, ok := from.Data[key]; !ok {
+			diff.Added[key] = v
+		}
+	}
+	return diff, nil
+}
+
+// Returns the differences between two versions of the publisher's document with the
+// _id. If toVersion is 0, it's the latest version, and if fromVersion is 0, it's the
+// version before toVersion, or an empty document if toVersion is the first one.
+func dbDiffDocumentVersions(publisherID int, docID string, fromVersion, toVersion int) (*documentDiff, error) {
+	to, err := dbGetDocumentVersion(publisherID, docID, toVersion)
+	if err != nil {
+		return nil, err
+	}
+	if fromVersion == 0 {
+		fromVersion = to.Version - 1
+	}
+	from := &publisherDocument{PublisherID: publisherID, ID: docID}
+	if fromVersion > 0 {
+		if from, err = dbGetDocumentVersion(publisherID, docID, fromVersion); err != nil {
+			return nil, err
+		}
+	}
+	diff, err := diffDocuments(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return &diff, nil
+}
+
+// Returns the error message for a version of a document which isn't found
+func getDocumentNotFound(publisherID int, docID string, version int) string {
+	if version != 0 {
+		return fmt.Sprintf("Publisher %d has no version %d of document %s", publisherID, version, docID)
+	}
+	return fmt.Sprintf("Publisher %d has no document %s", publisherID, docID)
+}
+
+// Returns the publisher given by the "publisher" (publisher id) or "key" (any key or
+// the @handle of the publisher) argument. If neither is given, or it can't be resolved,
+// writes the error response and returns false.
+func getDocumentPublisherID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	s := r.URL.Query().Get("publisher")
+	if s == "" {
+		s = r.URL.Query().Get("key")
+	}
+	if s == "" {
+		wwwWriteJSON(w, http.StatusBadRequest, map[string]string{"error": "Expecting a publisher or key argument"})
+		return 0, false
+	}
+	publisherID, err := dbResolvePublisherID(db, s)
+	if _, ok := err.(*unknownPublisherError); ok {
+		wwwWriteJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return 0, false
+	}
+	if err != nil {
+		log.Println(err)
+		wwwWriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return 0, false
+	}
+	return publisherID, true
+}
+
+// Returns the document version given by the argument, or 0 if it's not given
+func getDocumentVersionArg(r *http.Request, arg string) (int, error) {
+	s := r.URL.Query().Get(arg)
+	if s == "" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(s)
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("Invalid %s argument: %s", arg, s)
+	}
+	return version, nil
+}
+
+// Handles /api/document?publisher=<publisher id> or /api/document?key=<any key or the @handle of the publisher>
+// for the publisher's latest document, and with &id=<_id> for the latest version of its
+// document with the _id, or with &id=<_id>&version=<version> for that version
+func wwwGetDocument(w http.ResponseWriter, r *http.Request) {
+	publisherID, ok := getDocumentPublisherID(w, r)
+	if !ok {
+		return
+	}
+	version, err := getDocumentVersionArg(r, "version")
+	if err != nil {
+		wwwWriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	var d *publisherDocument
+	if docID, ok := r.URL.Query()["id"]; ok {
+		d, err = dbGetDocumentVersion(publisherID, docID[0], version)
+		if err == sql.ErrNoRows {
+			wwwWriteJSON(w, http.StatusNotFound, map[string]string{"error": getDocumentNotFound(publisherID, docID[0], version)})
+			return
+		}
+	} else {
+		d, err = dbGetPublisherDocument(publisherID)
+		if err == sql.ErrNoRows {
+			wwwWriteJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("Publisher %d has no document", publisherID)})
+			return
+		}
+	}
+	if err != nil {
+		log.Println(err)
+		wwwWriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	wwwWriteJSON(w, http.StatusOK, d)
+}
+
+// Handles /api/docversions?publisher=<publisher id>&id=<_id> (or key=<any key or the
+// @handle of the publisher> instead of publisher) for the versions of the publisher's
+// document with the _id, from the latest one, without their data
+func wwwGetDocumentVersions(w http.ResponseWriter, r *http.Request) {
+	publisherID, ok := getDocumentPublisherID(w, r)
+	if !ok {
+		return
+	}
+	docID := r.URL.Query().Get("id")
+	docs, err := dbGetDocumentVersions(publisherID, docID)
+	if err != nil {
+		log.Println(err)
+		wwwWriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if len(docs) == 0 {
+		wwwWriteJSON(w, http.StatusNotFound, map[string]string{"error": getDocumentNotFound(publisherID, docID, 0)})
+		return
+	}
+	wwwWriteJSON(w, http.StatusOK, docs)
+}
+
+// Handles /api/docdiff?publisher=<publisher id>&id=<_id>&from=<version>&to=<version>
+// (or key=<any key or the @handle of the publisher> instead of publisher) for the
+// differences between two versions of the publisher's document with the _id. By default,
+// to is the latest version, and from the version before it.
+func wwwGetDocumentDiff(w http.ResponseWriter, r *http.Request) {
+	publisherID, ok := getDocumentPublisherID(w, r)
+	if !ok {
+		return
+	}
+	fromVersion, err := getDocumentVersionArg(r, "from")
+	if err != nil {
+		wwwWriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	toVersion, err := getDocumentVersionArg(r, "to")
+	if err != nil {
+		wwwWriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	docID := r.URL.Query().Get("id")
+	diff, err := dbDiffDocumentVersions(publisherID, docID, fromVersion, toVersion)
+	if err == sql.ErrNoRows {
+		wwwWriteJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("Publisher %d has no such versions of document %s", publisherID, docID)})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		wwwWriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	wwwWriteJSON(w, http.StatusOK, diff)
+}
+
+// Handles /api/doccontent?tx=<tx hash> for the signed transaction with a document
+func wwwGetDocumentContent(w http.ResponseWriter, r *http.Request) {
+	txHash := r.URL.Query().Get("tx")
+	c, err := dbGetDocumentContent(txHash)
+	if err == sql.ErrNoRows {
+		wwwWriteJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("Tx %s has no document in the main chain", txHash)})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		wwwWriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	wwwWriteJSON(w, http.StatusOK, c)
+}
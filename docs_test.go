@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDiffDocuments(t *testing.T) {
+	from := &publisherDocument{PublisherID: 2, ID: "doc", Version: 1}
+	to := &publisherDocument{PublisherID: 2, ID: "doc", Version: 2}
+	if err := json.Unmarshal([]byte(`{"_id":"doc","a":1,"b":[1,2],"c":"x"}`), &from.Data); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(`{"_id":"doc","a":1.0,"b":[2,1],"d":"y"}`), &to.Data); err != nil {
+		t.Fatal(err)
+	}
+	diff, err := diffDocuments(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Added) != 1 || diff.Added["d"] != "y" {
+		t.Error("Expecting d to be added, got", diff.Added)
+	}
+	if len(diff.Removed) != 1 || diff.Removed["c"] != "x" {
+		t.Error("Expecting c to be removed, got", diff.Removed)
+	}
+	if _, ok := diff.Changed["b"]; !ok || len(diff.Changed) != 1 {
+		t.Error("Expecting only b to be changed, got", diff.Changed)
+	}
+
+	// A version 1 transaction can have numbers which the canonical encoding would round
+	if err := json.Unmarshal([]byte(`{"_id":"doc","a":12345678901234567890}`), &to.Data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = diffDocuments(from, to); err == nil {
+		t.Error("Expecting an error for a number which can't be compared")
+	}
+}
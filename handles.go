@@ -0,0 +1,195 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A handle is a unique name of a publisher, which can be used as @handle wherever a
+// public key is expected, and resolves to the publisher's current key. A publisher
+// registers a handle which isn't taken by publishing a document with the `_handle` key,
+// which burns handleFee from the balance of the key which signs it. The fee isn't paid
+// to the miner, who could otherwise register handles for free by mining them. The
+// handle is the publisher's for handleLifetime blocks, and is renewed for handleLifetime
+// blocks from the renewal with another such document. When it expires, anyone can
+// register it. The publisher can transfer the handle to another publisher, for the
+// rest of its lifetime, with a document which also has the `_handleto` key set to the
+// other's publisher id.
+
+const handleFee = OneCoin
+const handleLifetime = 365 * 24 * 3600 / TargetBlockTime // about a year
+
+// Handles are lower-case letters, digits and underscores, and begin with a letter
+var reHandle = regexp.MustCompile(`^[a-z][a-z0-9_]{2,31}$`)
+
+// A handle, as returned by /api/handle
+type handle struct {
+	Name          string `json:"name"`
+	PublisherID   int    `json:"publisher_id"`
+	PublisherName string `json:"publisher_name"`
+	PubKey        string `json:"pubkey,omitempty"` // the publisher's current key
+	SinceBlock    int    `json:"since_block"`      // when it was registered or transferred to the publisher
+	ExpiresBlock  int    `json:"expires_block"`
+	TxHash        string `json:"tx_hash"`
+}
+
+// Registers, renews or transfers the publisher's _handle. Returns the fee to be burned
+// from the sender's balance, which transfers don't pay.
+func dbRegisterHandle(dbtx *sql.Tx, u *blockUndo, btx *BlockTransaction, tx *Tx, publisher *Publisher, height int) (uint64, error) {
+	name := tx.Data.getString("_handle")
+	if !reHandle.MatchString(name) {
+		return 0, fmt.Errorf("Invalid _handle in %s: %s", btx.TxHash, name)
+	}
+	ownerID := 0
+	expiresBlock := 0
+	err := dbtx.QueryRow("SELECT publisher_id, expires_block FROM handle WHERE name=?", name).Scan(&ownerID, &expiresBlock)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	taken := err == nil && expiresBlock > height
+	if to, ok := tx.Data.lookup("_handleto"); ok {
+		if !taken || ownerID != publisher.ID {
+			return 0, fmt.Errorf("The _handle %s in %s is not publisher %d's", name, btx.TxHash, publisher.ID)
+		}
+		targetID, err := dbGetRelationTarget(dbtx, btx, publisher, "_handleto", to)
+		if err != nil {
+			return 0, err
+		}
+		if err = u.save(dbtx, "handle", "name=?", name); err != nil {
+			return 0, err
+		}
+		_, err = dbtx.Exec("UPDATE handle SET publisher_id=?, since_block=?, tx_hash=? WHERE name=?", targetID, height, btx.TxHash, name)
+		return 0, err
+	}
+	if taken && ownerID != publisher.ID {
+		return 0, fmt.Errorf("The _handle %s in %s is registered by publisher %d until block %d", name, btx.TxHash, ownerID, expiresBlock)
+	}
+	if err = u.save(dbtx, "handle", "name=?", name); err != nil {
+		return 0, err
+	}
+	if taken {
+		_, err = dbtx.Exec("UPDATE handle SET expires_block=? WHERE name=?", height+handleLifetime, name)
+	} else {
+		_, err = dbtx.Exec("INSERT OR REPLACE INTO handle (name, publisher_id, since_block, expires_block, tx_hash) VALUES (?, ?, ?, ?, ?)", name, publisher.ID, height, height+handleLifetime, btx.TxHash)
+	}
+	return handleFee, err
+}
+
+// unknownPublisherError is returned when a key or a handle doesn't name a publisher
+type unknownPublisherError struct {
+	Message string
+}
+
+func (e *unknownPublisherError) Error() string {
+	return e.Message
+}
+
+// Returns the publisher id of the handle, if it hasn't expired by the last block
+func dbResolveHandle(q dbQueryer, name string) (int, error) {
+	publisherID := 0
+	err := q.QueryRow("SELECT publisher_id FROM handle WHERE name=? AND expires_block > (SELECT MAX(height) FROM block)", name).Scan(&publisherID)
+	if err == sql.ErrNoRows {
+		return 0, &unknownPublisherError{fmt.Sprintf("Handle @%s is not registered", name)}
+	}
+	return publisherID, err
+}
+
+// Returns the current key of the publisher, which may not have one if it was revoked
+func dbGetCurrentPubKey(q dbQueryer, publisherID int) (string, error) {
+	pubKey := ""
+	err := q.QueryRow("SELECT pubkey FROM publisher_pubkey WHERE publisher_id=? AND to_block IS NULL AND revoked_block IS NULL", publisherID).Scan(&pubKey)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("Publisher %d has no current key", publisherID)
+	}
+	return pubKey, err
+}
+
+// Returns the public key for a string which may be a public key or an @handle
+func dbResolvePubKey(q dbQueryer, s string) (string, error) {
+	if !strings.HasPrefix(s, "@") {
+		return s, nil
+	}
+	publisherID, err := dbResolveHandle(q, s[1:])
+	if err != nil {
+		return "", err
+	}
+	return dbGetCurrentPubKey(q, publisherID)
+}
+
+// Returns the id of the publisher given by its id, any of its public keys, or its @handle
+func dbResolvePublisherID(q dbQueryer, s string) (int, error) {
+	if id, err := strconv.Atoi(s); err == nil {
+		return id, nil
+	}
+	if strings.HasPrefix(s, "@") {
+		return dbResolveHandle(q, s[1:])
+	}
+	pubKey := s
+	publisherID := 0
+	err := q.QueryRow("SELECT publisher_id FROM publisher_pubkey WHERE pubkey=?", pubKey).Scan(&publisherID)
+	if err == sql.ErrNoRows {
+		return 0, &unknownPublisherError{fmt.Sprintf("Key %s doesn't belong to a publisher", pubKey)}
+	}
+	return publisherID, err
+}
+
+// Returns the handles matching the where clause on the handle table
+func dbGetHandles(where string, args ...interface{}) ([]handle, error) {
+	rows, err := db.Query(fmt.Sprintf(`SELECT handle.name, handle.publisher_id, publisher.name, handle.since_block, handle.expires_block, handle.tx_hash
+		FROM handle JOIN publisher ON publisher.id=handle.publisher_id
+		WHERE handle.expires_block > (SELECT MAX(height) FROM block) AND %s ORDER BY handle.name`, where), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	handles := []handle{}
+	for rows.Next() {
+		h := handle{}
+		if err = rows.Scan(&h.Name, &h.PublisherID, &h.PublisherName, &h.SinceBlock, &h.ExpiresBlock, &h.TxHash); err != nil {
+			return nil, err
+		}
+		handles = append(handles, h)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range handles {
+		handles[i].PubKey, _ = dbGetCurrentPubKey(db, handles[i].PublisherID)
+	}
+	return handles, nil
+}
+
+// Handles /api/handle?name=<handle> for the publisher and the current key of a handle,
+// and /api/handle?publisher=<publisher id> for the handles of a publisher
+func wwwGetHandle(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var handles []handle
+	var err error
+	if name := strings.TrimPrefix(q.Get("name"), "@"); name != "" {
+		handles, err = dbGetHandles("handle.name=?", name)
+		if err == nil && len(handles) == 0 {
+			wwwWriteJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("Handle @%s is not registered", name)})
+			return
+		}
+		if err == nil {
+			wwwWriteJSON(w, http.StatusOK, handles[0])
+			return
+		}
+	} else if id, aerr := strconv.Atoi(q.Get("publisher")); aerr == nil {
+		handles, err = dbGetHandles("handle.publisher_id=?", id)
+	} else {
+		wwwWriteJSON(w, http.StatusBadRequest, map[string]string{"error": "Expecting a name or publisher argument"})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		wwwWriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	wwwWriteJSON(w, http.StatusOK, handles)
+}
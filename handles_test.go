@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestHandles(t *testing.T) {
+	miner := getTestKey("miner")
+	alice := getTestKey("alice")
+	bob := getTestKey("bob")
+	carol := getTestKey("carol")
+	c := newFundedTestChain(t, miner, alice, bob)
+	c.send(miner, Tx{Outputs: []TxOutput{{PubKey: carol.Public, Amount: handleFee / 2}}})
+	c.introduce(alice, "alice")
+	c.introduce(bob, "bob")
+	c.introduce(carol, "carol")
+	c.mine(miner)
+	aliceID, bobID := c.publisherID(alice), c.publisherID(bob)
+	url := c.serve(nil)
+
+	// The fee is burned rather than paid to the miner
+	reward := getTestKey("reward")
+	register := c.publish(alice, PublishedData{"_id": "_handle", "_handle": "alice_h"})
+	c.mine(reward)
+	if c.balance(alice) != 10*OneCoin-handleFee || c.balance(reward) != getCoinbaseAtHeight(c.height()) {
+		t.Error("Expecting the handle fee to be burned, got balances", c.balance(alice), c.balance(reward))
+	}
+	h := handle{}
+	getTestJSON(t, url+"/api/handle?name=@alice_h", http.StatusOK, &h)
+	expected := handle{Name: "alice_h", PublisherID: aliceID, PublisherName: "alice", PubKey: alice.Public, SinceBlock: c.height(), ExpiresBlock: c.height() + handleLifetime, TxHash: register.TxHash}
+	if h != expected {
+		t.Errorf("Expecting %+v, got %+v", expected, h)
+	}
+	if pubKey, err := dbResolvePubKey(db, "@alice_h"); err != nil || pubKey != alice.Public {
+		t.Error("Expecting @alice_h to resolve to alice's key, got", pubKey, err)
+	}
+
+	for _, test := range []struct {
+		key    *WalletKey
+		doc    PublishedData
+		reason string
+	}{
+		{bob, PublishedData{"_id": "_handle", "_handle": "alice_h"}, txRejectPayload},
+		{bob, PublishedData{"_id": "_handle", "_handle": "Bob"}, txRejectPayload},
+		{bob, PublishedData{"_id": "_handle", "_handle": "bo"}, txRejectPayload},
+		{bob, PublishedData{"_id": "_handle", "_handle": "alice_h", "_handleto": fmt.Sprint(bobID)}, txRejectPayload},
+		{bob, PublishedData{"_id": "_handle", "_handleto": fmt.Sprint(aliceID)}, txRejectPayload},
+		{carol, PublishedData{"_id": "_handle", "_handle": "carol_h"}, txRejectBalance},
+	} {
+		_, err := acceptTx(c.signTx(test.key, Tx{Data: test.doc}))
+		if re, ok := err.(*txRejectError); !ok || re.Reason != test.reason {
+			t.Errorf("Expecting %v to be rejected for %q, got %v", test.doc, test.reason, err)
+		}
+	}
+
+	// A transfer doesn't pay the fee, and keeps the expiry
+	transfer := c.publish(alice, PublishedData{"_id": "_handle", "_handle": "alice_h", "_handleto": fmt.Sprint(bobID)})
+	c.mine(miner)
+	if c.balance(alice) != 10*OneCoin-handleFee {
+		t.Error("Expecting the transfer to be free, got balance", c.balance(alice))
+	}
+	expected.PublisherID, expected.PublisherName, expected.PubKey = bobID, "bob", bob.Public
+	expected.SinceBlock, expected.TxHash = c.height(), transfer.TxHash
+	h = handle{}
+	getTestJSON(t, url+"/api/handle?name=alice_h", http.StatusOK, &h)
+	if h != expected {
+		t.Errorf("Expecting %+v, got %+v", expected, h)
+	}
+	handles := []handle{}
+	getTestJSON(t, fmt.Sprintf("%s/api/handle?publisher=%d", url, aliceID), http.StatusOK, &handles)
+	if len(handles) != 0 {
+		t.Error("Expecting alice to have no handles, got", handles)
+	}
+
+	// An expired handle doesn't resolve, and can be registered by anyone
+	if _, err := db.Exec("UPDATE handle SET expires_block=? WHERE name=?", c.height(), "alice_h"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dbResolvePubKey(db, "@alice_h"); err == nil {
+		t.Error("Expecting the expired handle not to resolve")
+	}
+	getTestJSON(t, url+"/api/handle?name=alice_h", http.StatusNotFound, &map[string]string{})
+	c.publish(alice, PublishedData{"_id": "_handle", "_handle": "alice_h"})
+}
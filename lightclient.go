@@ -0,0 +1,482 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The light client verifies documents without the database and the blocks. It keeps
+// only the chain of block headers, which it downloads from a full node with
+//
+//   GET /api/headers?from=<height>&count=<number of headers>
+//
+// and checks like a full node does: the hashes, the links between the blocks, the
+// proof of work with the retargeted difficulty, and the timestamps. Blocks older than
+// version 2 are hashed with their transactions, so they are downloaded whole. If the
+// node's chain forks from the light client's, the light client switches to it only
+// if it has more work.
+//
+// Since block version 3, the headers commit to the state tree, so the light client
+// can verify the state proofs (/api/stateproof) and the transaction proofs
+// (/api/txproof) a full node gives it against its own headers. Proving a document
+// takes the publisher of the key (k:<pubkey>) or of the handle (h:<handle>), the
+// publisher's document (d:<publisher id>), which is its latest one, and the
+// transaction with the document.
+
+const lightHeadersFileName = "headers.json"
+const lightMaxHeaders = 500
+
+// A block header as returned by /api/headers
+type lightHeader struct {
+	Height int                `json:"height"`
+	Hash   string             `json:"hash"`
+	Header CompactBlockHeader `json:"header"`
+	Block  *Block             `json:"block,omitempty"` // for blocks older than version 2
+}
+
+// A verified block header in the light client's chain
+type lightChainEntry struct {
+	Hash       string             `json:"hash"`
+	Header     CompactBlockHeader `json:"header"`
+	Difficulty int                `json:"difficulty"`
+}
+
+// The light client's chain of headers, indexed by height
+type lightChain []lightChainEntry
+
+// Handles /api/headers
+func wwwGetHeaders(w http.ResponseWriter, r *http.Request) {
+	from, err := strconv.Atoi(r.URL.Query().Get("from"))
+	if err != nil || from < 0 {
+		wwwWriteJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid from height"})
+		return
+	}
+	count, err := strconv.Atoi(r.URL.Query().Get("count"))
+	if err != nil || count < 1 || count > lightMaxHeaders {
+		count = lightMaxHeaders
+	}
+	headers := []lightHeader{}
+	rows, err := db.Query("SELECT height, hash FROM block WHERE height >= ? ORDER BY height LIMIT ?", from, count)
+	if err != nil {
+		log.Println(err)
+		wwwWriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	for rows.Next() {
+		h := lightHeader{}
+		if err = rows.Scan(&h.Height, &h.Hash); err != nil {
+			break
+		}
+		headers = append(headers, h)
+	}
+	rows.Close()
+	if err == nil {
+		err = rows.Err()
+	}
+	for i := range headers {
+		if err != nil {
+			break
+		}
+		var b BlockWithHeader
+		b, err = dataDirLoadBlock(headers[i].Height, headers[i].Hash)
+		headers[i].Header = b.CompactHeader()
+		if b.Version < 2 {
+			headers[i].Block = &b.Block
+		}
+	}
+	if err != nil {
+		log.Println(err)
+		wwwWriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	wwwWriteJSON(w, http.StatusOK, headers)
+}
+
+// Loads the light client's chain from the data directory, or starts it with the genesis block
+func loadLightChain() (lightChain, error) {
+	data, err := ioutil.ReadFile(path.Join(*dataDir, lightHeadersFileName))
+	if os.IsNotExist(err) {
+		return lightChain{lightChainEntry{Hash: GenesisBlock.BlockHeader.Hash, Header: GenesisBlock.CompactHeader(), Difficulty: GenesisBlockDifficulty}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := lightChain{}
+	if err = json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("Cannot decode %s: %s", lightHeadersFileName, err.Error())
+	}
+	if len(c) == 0 || c[0].Hash != GenesisBlock.BlockHeader.Hash {
+		return nil, fmt.Errorf("The headers in %s are not on this chain", lightHeadersFileName)
+	}
+	return c, nil
+}
+
+func (c lightChain) save() error {
+	err := os.MkdirAll(*dataDir, 0750)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(*dataDir, lightHeadersFileName), jsonifyWhateverToBytes(c), 0640)
+}
+
+// Returns the work of the chain's blocks from the given height
+func (c lightChain) getWork(from int) *big.Int {
+	work := big.NewInt(0)
+	for _, e := range c[from:] {
+		work.Add(work, getDifficultyWork(e.Difficulty))
+	}
+	return work
+}
+
+// Returns the difficulty of the block following the chain
+func (c lightChain) getNextDifficulty() int {
+	prev := len(c) - 1
+	if (prev+1)%DifficultyRetargetInterval != 0 {
+		return c[prev].Difficulty
+	}
+	first := prev - DifficultyRetargetInterval
+	if first < 0 {
+		first = 0
+	}
+	return retargetDifficulty(c[prev].Difficulty, c[prev].Header.TimeUTC-c[first].Header.TimeUTC, int64(prev-first)*TargetBlockTime)
+}
+
+// Returns the median timestamp of the last MedianTimeBlocks blocks of the chain
+func (c lightChain) getMedianTimePast() int64 {
+	times := []int64{}
+	for i := len(c) - 1; i >= 0 && len(times) < MedianTimeBlocks; i-- {
+		times = append(times, c[i].Header.TimeUTC)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[len(times)/2]
+}
+
+// Checks the header the same way a full node checks a block header, and appends it to the chain
+func (c lightChain) appendHeader(h lightHeader) (lightChain, error) {
+	if h.Height != len(c) {
+		return c, fmt.Errorf("Expecting header at %d, got %d", len(c), h.Height)
+	}
+	var hash []byte
+	var err error
+	if h.Header.Version >= 2 {
+		hash, err = h.Header.Hash()
+	} else {
+		if h.Block == nil {
+			return c, fmt.Errorf("Missing block %s at %d", h.Hash, h.Height)
+		}
+		hash, err = h.Block.Hash()
+		h.Header = h.Block.CompactHeader()
+	}
+	if err != nil {
+		return c, fmt.Errorf("Block header at %d: %s", h.Height, err.Error())
+	}
+	if mustEncodeBase64URL(hash) != h.Hash {
+		return c, fmt.Errorf("Block header at %d doesn't match its hash %s", h.Height, h.Hash)
+	}
+	if err := checkBlockVersion(h.Hash, h.Header.Version, h.Height); err != nil {
+		return c, err
+	}
+	if h.Header.PreviousBlockHash != c[len(c)-1].Hash {
+		return c, fmt.Errorf("Block %s at %d doesn't follow the block at %d", h.Hash, h.Height, h.Height-1)
+	}
+	difficulty := c.getNextDifficulty()
+	if countStartZeroBits(hash) < difficulty {
+		return c, fmt.Errorf("Block %s doesn't have the required difficulty of %d bits", h.Hash, difficulty)
+	}
+	mtp := c.getMedianTimePast()
+	if h.Header.TimeUTC <= mtp {
+		return c, fmt.Errorf("Block %s timestamp %d is not after the median time of the previous blocks %d", h.Hash, h.Header.TimeUTC, mtp)
+	}
+	if h.Header.TimeUTC > getNowUTC()+MaxFutureBlockTime {
+		return c, fmt.Errorf("Block %s timestamp %d is too far in the future", h.Hash, h.Header.TimeUTC)
+	}
+	return append(c, lightChainEntry{Hash: h.Hash, Header: h.Header, Difficulty: difficulty}), nil
+}
+
+// Downloads and verifies the headers the node has, and returns the chain with the most work
+func (c lightChain) sync(nodeURL string) (lightChain, error) {
+	// Find the last block the node has in common with the chain, going back
+	// exponentially if the node has forked or has fewer blocks
+	fork := len(c) - 1
+	for step := 1; fork > 0; step *= 2 {
+		headers, err := lightGetHeaders(nodeURL, fork, 1)
+		if err != nil {
+			return c, err
+		}
+		if len(headers) == 1 && headers[0].Hash == c[fork].Hash {
+			break
+		}
+		fork -= step
+		if fork < 0 {
+			fork = 0
+		}
+	}
+	nc := append(lightChain{}, c[:fork+1]...)
+	for {
+		headers, err := lightGetHeaders(nodeURL, len(nc), lightMaxHeaders)
+		if err != nil {
+			return c, err
+		}
+		for _, h := range headers {
+			if nc, err = nc.appendHeader(h); err != nil {
+				return c, err
+			}
+		}
+		if len(headers) < lightMaxHeaders {
+			break
+		}
+	}
+	if nc.getWork(fork+1).Cmp(c.getWork(fork+1)) <= 0 {
+		if len(nc) != len(c) {
+			log.Println("The node's chain has less work than ours, keeping ours")
+		}
+		return c, nil
+	}
+	if fork+1 < len(c) {
+		log.Println("Switching to the node's chain from block", fork+1)
+	}
+	return nc, nc.save()
+}
+
+// Checks that the block is in the chain, syncing the chain again if the node has
+// more blocks than it
+func (c *lightChain) checkBlock(nodeURL string, height int, hash string) error {
+	if height >= len(*c) {
+		nc, err := c.sync(nodeURL)
+		if err != nil {
+			return err
+		}
+		*c = nc
+	}
+	if height >= len(*c) {
+		return fmt.Errorf("Block %s at %d is not in the synced headers", hash, height)
+	}
+	if (*c)[height].Hash != hash {
+		return fmt.Errorf("Block %s at %d is not in the main chain", hash, height)
+	}
+	return nil
+}
+
+// Returns the verified value of the key in the state tree after the chain's last block.
+// A proof against an older block is rejected, since the value could have changed since.
+func (c *lightChain) getStateValue(nodeURL, key string, value interface{}) (*blockStateProof, error) {
+	p := blockStateProof{}
+	err := lightGetJSON(nodeURL+"/api/stateproof?key="+url.QueryEscape(key), &p)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.checkBlock(nodeURL, p.Height, p.BlockHash); err != nil {
+		return nil, err
+	}
+	if p.Height != len(*c)-1 {
+		return nil, fmt.Errorf("The proof of %s is at block %d, not at the last block %d", key, p.Height, len(*c)-1)
+	}
+	if err = p.verify(); err != nil {
+		return nil, err
+	}
+	if p.Proof.Key != key {
+		return nil, fmt.Errorf("Expecting a proof for %s, got %s", key, p.Proof.Key)
+	}
+	if p.Proof.Value != "" {
+		if err = json.Unmarshal([]byte(p.Proof.Value), value); err != nil {
+			return nil, fmt.Errorf("Cannot decode %s: %s", key, err.Error())
+		}
+	}
+	return &p, nil
+}
+
+// Returns the verified transaction, and the height of its block
+func (c *lightChain) getTx(nodeURL, txHash string) (*txProof, error) {
+	p := txProof{}
+	err := lightGetJSON(nodeURL+"/api/txproof?hash="+url.QueryEscape(txHash), &p)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.checkBlock(nodeURL, p.Height, p.BlockHash); err != nil {
+		return nil, err
+	}
+	if err = p.verify(); err != nil {
+		return nil, err
+	}
+	if p.Tx.TxHash != txHash {
+		return nil, fmt.Errorf("Expecting a proof for tx %s, got %s", txHash, p.Tx.TxHash)
+	}
+	return &p, nil
+}
+
+// Checks that the key which signed a transaction in the block at the given height
+// belonged to the publisher at the time, since publishers can replace their keys, and
+// returns true if the key has since been revoked from that block on.
+func (c *lightChain) checkSigner(nodeURL, pubKey string, publisherID, height int) (bool, error) {
+	k := stateTreePubKey{}
+	if _, err := c.getStateValue(nodeURL, getStateTreePubKeyKey(pubKey), &k); err != nil {
+		return false, err
+	}
+	if !k.belongsAt(publisherID, height) {
+		return false, fmt.Errorf("Key %s didn't belong to publisher %d at block %d", pubKey, publisherID, height)
+	}
+	return k.revokedAt(height), nil
+}
+
+// Syncs the light client's headers from the node at the given URL
+func lightSync(nodeURL string) (lightChain, error) {
+	c, err := loadLightChain()
+	if err != nil {
+		return nil, err
+	}
+	return c.sync(strings.TrimSuffix(nodeURL, "/"))
+}
+
+// Verifies with proofs from the node that the publisher of the public key (or the
+// @handle) has published the document with the _id, and prints its latest version. If
+// txHash is given, reports whether that transaction contains the latest version, and if
+// blockHash is also given, checks that the transaction is still in that block. Without
+// docID, the document is the one in the transaction.
+func lightVerifyDocument(nodeURL, pubKey, docID, txHash, blockHash string) error {
+	nodeURL = strings.TrimSuffix(nodeURL, "/")
+	c, err := lightSync(nodeURL)
+	if err != nil {
+		return err
+	}
+	pk := stateTreePubKey{}
+	if strings.HasPrefix(pubKey, "@") {
+		h := stateTreeHandle{}
+		hp, err := c.getStateValue(nodeURL, getStateTreeHandleKey(pubKey[1:]), &h)
+		if err != nil {
+			return err
+		}
+		if hp.Proof.Value == "" || h.ExpiresBlock <= hp.Height {
+			return fmt.Errorf("Handle %s is not registered (verified at block %d)", pubKey, hp.Height)
+		}
+		pk.PublisherID = h.PublisherID
+	} else {
+		kp, err := c.getStateValue(nodeURL, getStateTreePubKeyKey(pubKey), &pk)
+		if err != nil {
+			return err
+		}
+		if kp.Proof.Value == "" {
+			return fmt.Errorf("Key %s doesn't belong to a publisher (verified at block %d)", pubKey, kp.Height)
+		}
+	}
+	if docID == "" {
+		if txHash == "" {
+			return fmt.Errorf("Neither the document _id nor the tx is given")
+		}
+		tp, err := c.getTx(nodeURL, txHash)
+		if err != nil {
+			return err
+		}
+		tx, err := tp.Tx.VerifyBasics()
+		if err != nil {
+			return err
+		}
+		if docID = tx.Data.getString("_id"); docID == "" {
+			return fmt.Errorf("Tx %s has no document", txHash)
+		}
+	}
+	doc := stateTreeDocument{}
+	dp, err := c.getStateValue(nodeURL, getStateTreeDocumentKey(pk.PublisherID, docID), &doc)
+	if err != nil {
+		return err
+	}
+	if dp.Proof.Value == "" {
+		return fmt.Errorf("Publisher %d has no document %s (verified at block %d)", pk.PublisherID, docID, dp.Height)
+	}
+	tp, err := c.getTx(nodeURL, doc.TxHash)
+	if err != nil {
+		return err
+	}
+	if tp.Height != doc.Block {
+		return fmt.Errorf("Tx %s is in block %d, expecting %d", doc.TxHash, tp.Height, doc.Block)
+	}
+	tx, err := tp.Tx.VerifyBasics()
+	if err != nil {
+		return err
+	}
+	revoked, err := c.checkSigner(nodeURL, tx.SigningPubKey, pk.PublisherID, tp.Height)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Publisher:", pk.PublisherID)
+	fmt.Println("Signed by:", tx.SigningPubKey)
+	if revoked {
+		fmt.Println("WARNING: the publisher has revoked the key which signed the document")
+	}
+	fmt.Println("Document:", doc.ID, "version", doc.Version)
+	fmt.Println("Tx:", doc.TxHash)
+	fmt.Println("Block:", tp.Height, tp.BlockHash, "with", len(c)-1-tp.Height, "confirmation(s)")
+	fmt.Println("Data:", jsonifyWhatever(tx.Data))
+	if txHash == "" || txHash == doc.TxHash {
+		if blockHash != "" && tp.BlockHash != blockHash {
+			return fmt.Errorf("Tx %s is in block %s, not in block %s", txHash, tp.BlockHash, blockHash)
+		}
+		fmt.Println("This is the latest version of the publisher's document")
+		return nil
+	}
+	old, err := c.getTx(nodeURL, txHash)
+	if err != nil {
+		return err
+	}
+	if blockHash != "" && old.BlockHash != blockHash {
+		return fmt.Errorf("Tx %s is in block %s, not in block %s", txHash, old.BlockHash, blockHash)
+	}
+	oldTx, err := old.Tx.VerifyBasics()
+	if err != nil {
+		return err
+	}
+	if oldTx.Data.getString("_id") != docID {
+		return fmt.Errorf("Tx %s has no version of document %s", txHash, docID)
+	}
+	if revoked, err = c.checkSigner(nodeURL, oldTx.SigningPubKey, pk.PublisherID, old.Height); err != nil {
+		return err
+	}
+	fmt.Println("Tx", txHash, "in block", old.Height, "signed by", oldTx.SigningPubKey, "is not the latest version of the publisher's document")
+	if revoked {
+		fmt.Println("WARNING: the publisher has revoked the key which signed it")
+	}
+	return nil
+}
+
+// Verifies the transaction of a verification URI like lightVerifyDocument, with the key
+// which signed it, and checks that it's still in the block given by the URI
+func lightVerifyURI(nodeURL, uri string) error {
+	txHash, blockHash, pubKey, err := parseVerificationURI(uri)
+	if err != nil {
+		return err
+	}
+	if pubKey == "" {
+		return fmt.Errorf("The URI has no key: %s", uri)
+	}
+	return lightVerifyDocument(nodeURL, pubKey, "", txHash, blockHash)
+}
+
+func lightGetHeaders(nodeURL string, from, count int) ([]lightHeader, error) {
+	headers := []lightHeader{}
+	err := lightGetJSON(fmt.Sprintf("%s/api/headers?from=%d&count=%d", nodeURL, from, count), &headers)
+	return headers, err
+}
+
+func lightGetJSON(u string, v interface{}) error {
+	resp, err := http.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return minerResponseError(resp)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("Cannot decode response from %s: %s", u, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestLightVerifyDocumentRejectsOldStateProof(t *testing.T) {
+	c := newTestChain(t)
+	alice := getTestKey("alice")
+	c.mine(alice)
+	c.publish(alice, PublishedData{"_id": "_intro", "_key": alice.Public, "_name": "alice"})
+	c.publish(alice, PublishedData{"_id": "profile", "city": "Zagreb"})
+	c.mine(alice)
+	docKey := getStateTreeDocumentKey(2, "profile")
+	old := httptest.NewRecorder()
+	wwwGetStateProof(old, httptest.NewRequest("GET", "/api/stateproof?key="+url.QueryEscape(docKey), nil))
+	latest := c.publish(alice, PublishedData{"_id": "profile", "city": "Split"})
+	c.mine(alice)
+
+	if err := lightVerifyDocument(c.serve(nil), alice.Public, "profile", latest.TxHash, ""); err != nil {
+		t.Fatal(err)
+	}
+	// A node which serves the proof of the document from before the latest version
+	nodeURL := c.serve(map[string]http.HandlerFunc{"/api/stateproof": func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("key") == docKey {
+			w.Write(old.Body.Bytes())
+			return
+		}
+		wwwGetStateProof(w, r)
+	}})
+	if err := lightVerifyDocument(nodeURL, alice.Public, "profile", latest.TxHash, ""); err == nil {
+		t.Error("Verified the document with a proof from an older block")
+	}
+}
+
+func TestLightDocumentLeafPerID(t *testing.T) {
+	c := newTestChain(t)
+	alice := getTestKey("alice")
+	c.mine(alice)
+	c.publish(alice, PublishedData{"_id": "_intro", "_key": alice.Public, "_name": "alice"})
+	c.publish(alice, PublishedData{"_id": "profile", "city": "Zagreb"})
+	c.mine(alice)
+	profile := c.publish(alice, PublishedData{"_id": "profile", "city": "Split"})
+	c.mine(alice)
+	other := c.publish(alice, PublishedData{"_id": "other", "x": "y"})
+	c.mine(alice)
+
+	nodeURL := c.serve(nil)
+	lc, err := lightSync(nodeURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct {
+		id      string
+		txHash  string
+		version int
+	}{
+		{"profile", profile.TxHash, 2},
+		{"other", other.TxHash, 1},
+	} {
+		doc := stateTreeDocument{}
+		if _, err = lc.getStateValue(nodeURL, getStateTreeDocumentKey(2, v.id), &doc); err != nil {
+			t.Fatal(err)
+		}
+		if doc.TxHash != v.txHash || doc.Version != v.version {
+			t.Errorf("Expecting version %d of %s in %s, got %+v", v.version, v.id, v.txHash, doc)
+		}
+	}
+	if err = lightVerifyDocument(nodeURL, alice.Public, "profile", profile.TxHash, ""); err != nil {
+		t.Error(err)
+	}
+	if err = lightVerifyDocument(nodeURL, alice.Public, "profile", other.TxHash, ""); err == nil {
+		t.Error("Verified a tx of another document as a version of the document")
+	}
+	if err = lightVerifyDocument(nodeURL, alice.Public, "", profile.TxHash, ""); err != nil {
+		t.Error(err)
+	}
+}
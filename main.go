@@ -27,7 +27,13 @@ var logFileName = flag.String("log", "/tmp/wot1.log", "Log file ('-' for only st
 var walletFileName = flag.String("wallet", DefaultWalletFilename, "Wallet filename")
 var dataDir = flag.String("datadir", "~/.wot", "Data directory for the blockchain")
 var miningActive = flag.Bool("mining", true, "Enables mining on this node")
+var miningEmptyBlocks = flag.Bool("miningEmptyBlocks", false, "Mines blocks even when there are no pending transactions")
+var miningThreads = flag.Int("miningThreads", 0, "Number of threads the miner uses (0 for the number of CPUs)")
 var miningRewardAddress = flag.String("miningAddress", "", "Which address receives the mining reward")
+var wwwBind = flag.String("www", ":8002", "Address on which the web server listens")
+var p2pBind = flag.String("p2p", ":2018", "Address on which the node listens for peers ('' disables incoming connections)")
+var p2pPeerList = flag.String("peers", "", "Comma-separated list of peer addresses (host:port) to connect to")
+var trustAlgorithmName = flag.String("trustAlgorithm", "eigentrust", "Default trust algorithm for /api/trust (path, flow or eigentrust)")
 
 func main() {
 	flag.Parse()
@@ -50,6 +56,9 @@ func main() {
 		}
 		*dataDir = usr.HomeDir + (*dataDir)[1:]
 	}
+	if _, ok := trustAlgorithms[*trustAlgorithmName]; !ok {
+		log.Fatal("Unknown trust algorithm: " + *trustAlgorithmName)
+	}
 
 	if len(flag.Args()) > 0 {
 		if processSimpleCmdLineActions() {
@@ -73,6 +82,7 @@ func main() {
 	signal.Notify(sigChannel, syscall.SIGINT)
 
 	go webServer()
+	go p2pServer()
 
 	if *miningActive {
 		go miningRig()
@@ -95,6 +105,7 @@ func main() {
 			}
 		case <-time.After(60 * time.Second):
 			log.Println("Tick.")
+			expireUtxs()
 		}
 	}
 }
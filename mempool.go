@@ -0,0 +1,530 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sync/atomic"
+)
+
+// The mempool is the pool of unconfirmed transactions, kept in the utx table together
+// with their sender, nonce, fee and size. Transactions are validated when they enter
+// it. Blocks are built from the transactions with the highest fee per byte, but the
+// transactions of a sender are always included in the order of their nonces, since
+// each of them can only be applied after the previous one. A transaction which cannot
+// be applied is skipped, together with the later transactions of its sender.
+//
+// A pending transaction can be replaced by one with the same sender and nonce and a
+// higher fee, after which the sender's later transactions are checked again. Transactions
+// expire from the pool after mempoolMaxAge seconds, together with the later transactions
+// of their sender, and when the pool is full, the transactions with the lowest fee per
+// byte are evicted. The hashes of dropped transactions are remembered for mempoolMaxAge
+// seconds, so they aren't taken back from peers.
+
+const miningMaxBlockTransactions = 1000
+const mempoolMaxAge = 3 * 24 * 3600 // seconds
+const mempoolMaxTxs = 10000
+const mempoolMaxBytes = 32 * 1024 * 1024
+
+// mempoolVersion is incremented whenever the node changes the pool, other than by
+// importing blocks, which changes the chain tip
+var mempoolVersion int64
+
+func mempoolChanged() {
+	atomic.AddInt64(&mempoolVersion, 1)
+}
+
+func getMempoolVersion() int64 {
+	return atomic.LoadInt64(&mempoolVersion)
+}
+
+type utxEntry struct {
+	btx  BlockTransaction
+	tx   Tx
+	size int
+}
+
+func (e *utxEntry) feePerByte() float64 {
+	return float64(e.tx.MinerFeeAmount) / float64(e.size)
+}
+
+// Reasons for which transactions are rejected
+const (
+	txRejectInvalid   = "invalid"   // malformed, or with an invalid hash or signature
+	txRejectCoinbase  = "coinbase"  // coinbase transactions are only created by miners
+	txRejectNonce     = "nonce"     // the nonce doesn't follow the sender's previous transaction
+	txRejectDuplicate = "duplicate" // another transaction with the same nonce is pending
+	txRejectBalance   = "balance"   // the outputs and the fee exceed the sender's balance
+	txRejectPayload   = "payload"   // the published document is invalid
+	txRejectFull      = "full"      // the pool is full of transactions with higher fees
+)
+
+// txRejectError is returned when a transaction is invalid, with the reason why
+type txRejectError struct {
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+func (e *txRejectError) Error() string {
+	return e.Message
+}
+
+func txReject(reason string, format string, args ...interface{}) *txRejectError {
+	return &txRejectError{Reason: reason, Message: fmt.Sprintf(format, args...)}
+}
+
+// Validates a transaction against the current state, after the sender's pending
+// transactions, and adds it to the pool of unconfirmed transactions. Returns false
+// if the transaction is already in the pool. Invalid transactions are rejected
+// with a txRejectError.
+func dbAddUtx(dbtx *sql.Tx, btx BlockTransaction) (bool, error) {
+	tx, err := btx.VerifyBasics()
+	if err != nil {
+		return false, txReject(txRejectInvalid, "%s", err.Error())
+	}
+	if inStringSlice("coinbase", tx.Flags) {
+		return false, txReject(txRejectCoinbase, "Coinbase tx %s cannot be added to the pool", btx.TxHash)
+	}
+	if tx.Version < MinTxVersion {
+		return false, txReject(txRejectInvalid, "Tx %s of version %d is older than version %d", btx.TxHash, tx.Version, MinTxVersion)
+	}
+	count := 0
+	err = dbtx.QueryRow("SELECT COUNT(*) FROM utx WHERE hash=?", btx.TxHash).Scan(&count)
+	if err != nil || count != 0 {
+		return false, err
+	}
+	states, err := dbGetStates(dbtx, []string{tx.SigningPubKey})
+	if err != nil {
+		return false, err
+	}
+	if states[tx.SigningPubKey] != nil && tx.PubKeyNonce <= states[tx.SigningPubKey].Nonce {
+		return false, txReject(txRejectNonce, "Nonce %d of %s has already been used in the blockchain", tx.PubKeyNonce, tx.SigningPubKey)
+	}
+	oldHash := ""
+	oldFee := uint64(0)
+	err = dbtx.QueryRow("SELECT hash, fee FROM utx WHERE sender=? AND nonce=?", tx.SigningPubKey, tx.PubKeyNonce).Scan(&oldHash, &oldFee)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	if oldHash != "" {
+		if tx.MinerFeeAmount <= oldFee {
+			return false, txReject(txRejectDuplicate, "A transaction from %s with nonce %d is already pending with a fee of %d, a replacement needs a higher fee", tx.SigningPubKey, tx.PubKeyNonce, oldFee)
+		}
+	} else {
+		nextNonce, err := dbGetNextNonce(dbtx, tx.SigningPubKey)
+		if err != nil {
+			return false, err
+		}
+		if tx.PubKeyNonce != nextNonce {
+			return false, txReject(txRejectNonce, "Nonce out of sync for %s: expecting %d, got %d", tx.SigningPubKey, nextNonce, tx.PubKeyNonce)
+		}
+	}
+	err = dbCheckUtx(dbtx, btx, tx)
+	if err != nil {
+		return false, err
+	}
+	if oldHash != "" {
+		if _, err = dbtx.Exec("DELETE FROM utx WHERE hash=?", oldHash); err != nil {
+			return false, err
+		}
+		if err = dbRememberDroppedUtxs(dbtx, []string{oldHash}); err != nil {
+			return false, err
+		}
+		log.Println("Replacing pending tx", oldHash, "with", btx.TxHash)
+	}
+	added, err := dbInsertUtx(dbtx, btx, tx)
+	if err != nil || !added {
+		return added, err
+	}
+	if oldHash != "" {
+		// The replacement can leave too little for the sender's later transactions
+		hashes, err := dbRevalidateUtxs(dbtx, tx.SigningPubKey)
+		if err != nil {
+			return false, err
+		}
+		for _, hash := range hashes {
+			log.Println("Dropped pending tx", hash, "which is invalid after the replacement")
+		}
+	}
+	return true, dbEvictUtxs(dbtx, btx.TxHash)
+}
+
+// Evicts the transactions with the lowest fee per byte while the pool is over its
+// limits. Only the last transaction of a sender is evicted, so the remaining ones
+// can still be mined. Returns an error if the given new transaction gets evicted.
+func dbEvictUtxs(dbtx *sql.Tx, newHash string) error {
+	for {
+		var count, size int
+		err := dbtx.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0) FROM utx").Scan(&count, &size)
+		if err != nil {
+			return err
+		}
+		if count <= mempoolMaxTxs && size <= mempoolMaxBytes {
+			return nil
+		}
+		hash := ""
+		err = dbtx.QueryRow(`SELECT hash FROM utx u WHERE NOT EXISTS (SELECT 1 FROM utx WHERE sender=u.sender AND nonce>u.nonce)
+			ORDER BY CAST(fee AS REAL) / size, id DESC LIMIT 1`).Scan(&hash)
+		if err != nil {
+			return err
+		}
+		if hash == newHash {
+			return txReject(txRejectFull, "The pool of unconfirmed transactions is full, tx %s needs a higher fee", newHash)
+		}
+		if _, err = dbtx.Exec("DELETE FROM utx WHERE hash=?", hash); err != nil {
+			return err
+		}
+		if err = dbRememberDroppedUtxs(dbtx, []string{hash}); err != nil {
+			return err
+		}
+		log.Println("Evicted pending tx", hash, "from the full pool")
+	}
+}
+
+// Removes the transactions which have been in the pool for longer than mempoolMaxAge
+func expireUtxs() {
+	chainLock.With(func() {
+		dbtx, err := db.Begin()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		hashes, err := dbExpireUtxs(dbtx, getNowUTC()-mempoolMaxAge)
+		if err == nil {
+			err = dbtx.Commit()
+		}
+		if err != nil {
+			dbtx.Rollback()
+			log.Println(err)
+			return
+		}
+		if len(hashes) > 0 {
+			mempoolChanged()
+			log.Println("Expired", len(hashes), "pending tx(s)")
+		}
+	})
+}
+
+// Removes the transactions which entered the pool before the given time, together
+// with the later transactions of their sender, which can't be mined without them, and
+// forgets the transactions dropped before it. Returns the hashes of the removed
+// transactions.
+func dbExpireUtxs(dbtx *sql.Tx, before int64) ([]string, error) {
+	// The earliest expired transaction of each sender
+	rows, err := dbtx.Query(`SELECT hash FROM utx u WHERE ts<? AND NOT EXISTS
+		(SELECT 1 FROM utx WHERE sender=u.sender AND nonce<u.nonce AND ts<?)`, before, before)
+	if err != nil {
+		return nil, err
+	}
+	expired := []string{}
+	for rows.Next() {
+		hash := ""
+		if err = rows.Scan(&hash); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		expired = append(expired, hash)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	hashes := []string{}
+	for _, hash := range expired {
+		dropped, err := dbDropUtx(dbtx, hash)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, dropped...)
+	}
+	_, err = dbtx.Exec("DELETE FROM utx_dropped WHERE ts<?", before)
+	return hashes, err
+}
+
+// Removes a transaction from the pool, together with the later transactions of its
+// sender which depend on it. Returns the hashes of the removed transactions.
+func dbDropUtx(dbtx *sql.Tx, hash string) ([]string, error) {
+	sender := ""
+	nonce := uint64(0)
+	err := dbtx.QueryRow("SELECT sender, nonce FROM utx WHERE hash=?", hash).Scan(&sender, &nonce)
+	if err != nil {
+		return nil, err
+	}
+	hashes := []string{}
+	rows, err := dbtx.Query("SELECT hash FROM utx WHERE sender=? AND nonce>=? ORDER BY nonce", sender, nonce)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		h := ""
+		if err = rows.Scan(&h); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		hashes = append(hashes, h)
+	}
+	rows.Close()
+	_, err = dbtx.Exec("DELETE FROM utx WHERE sender=? AND nonce>=?", sender, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return hashes, dbRememberDroppedUtxs(dbtx, hashes)
+}
+
+// Remembers the hashes of transactions dropped from the pool, so they aren't
+// taken back when peers announce them again.
+func dbRememberDroppedUtxs(dbtx *sql.Tx, hashes []string) error {
+	now := getNowUTC()
+	for _, hash := range hashes {
+		if _, err := dbtx.Exec("INSERT OR REPLACE INTO utx_dropped(hash, ts) VALUES (?, ?)", hash, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checks that the sender's pending transactions can still be applied in the order of
+// their nonces, and drops the first one which can't, together with the later ones.
+// Returns the hashes of the dropped transactions.
+func dbRevalidateUtxs(dbtx *sql.Tx, sender string) ([]string, error) {
+	lastHeight := 0
+	err := dbtx.QueryRow("SELECT MAX(height) FROM block").Scan(&lastHeight)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := dbGetSenderUtxs(dbtx, sender, math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+	invalid := ""
+	err = dbWithSavepoint(dbtx, "revalidate_utx", true, func() error {
+		u := blockUndo{}
+		for _, ptx := range pending {
+			if _, _, err := dbApplyTx(dbtx, &u, &ptx, lastHeight+1, CurrentBlockVersion); err != nil {
+				if _, ok := err.(*txRejectError); ok {
+					invalid = ptx.TxHash
+					return nil
+				}
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil || invalid == "" {
+		return nil, err
+	}
+	return dbDropUtx(dbtx, invalid)
+}
+
+// Checks the pending transactions of the senders of the transactions in the blocks,
+// which have been put back into the pool when the blocks were disconnected, against
+// the state of the new main chain
+func dbRevalidateDisconnectedUtxs(dbtx *sql.Tx, blocks []BlockWithHeader) error {
+	done := map[string]bool{}
+	for _, b := range blocks {
+		for _, btx := range b.Transactions {
+			tx := Tx{}
+			if err := json.Unmarshal([]byte(btx.TxData), &tx); err != nil {
+				return err
+			}
+			if inStringSlice("coinbase", tx.Flags) || done[tx.SigningPubKey] {
+				continue
+			}
+			done[tx.SigningPubKey] = true
+			hashes, err := dbRevalidateUtxs(dbtx, tx.SigningPubKey)
+			if err != nil {
+				return err
+			}
+			for _, hash := range hashes {
+				log.Println("Dropped pending tx", hash, "which is invalid after the reorganisation")
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the sender's pending transactions with nonces up to maxNonce, in the order of their nonces
+func dbGetSenderUtxs(dbtx *sql.Tx, sender string, maxNonce uint64) ([]BlockTransaction, error) {
+	pending := []BlockTransaction{}
+	rows, err := dbtx.Query("SELECT tx FROM utx WHERE sender=? AND nonce<=? ORDER BY nonce", sender, maxNonce)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		txData := ""
+		ptx := BlockTransaction{}
+		if err = rows.Scan(&txData); err == nil {
+			err = json.Unmarshal([]byte(txData), &ptx)
+		}
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		pending = append(pending, ptx)
+	}
+	rows.Close()
+	return pending, rows.Err()
+}
+
+// Checks that the transaction can be included in the next block, by applying the
+// sender's pending transactions and the transaction to the database, and rolling back.
+func dbCheckUtx(dbtx *sql.Tx, btx BlockTransaction, tx Tx) error {
+	lastHeight := 0
+	err := dbtx.QueryRow("SELECT MAX(height) FROM block").Scan(&lastHeight)
+	if err != nil {
+		return err
+	}
+	pending, err := dbGetSenderUtxs(dbtx, tx.SigningPubKey, tx.PubKeyNonce-1)
+	if err != nil {
+		return err
+	}
+	return dbWithSavepoint(dbtx, "check_utx", true, func() error {
+		u := blockUndo{}
+		for _, ptx := range pending {
+			if _, _, err := dbApplyTx(dbtx, &u, &ptx, lastHeight+1, CurrentBlockVersion); err != nil {
+				if re, ok := err.(*txRejectError); ok {
+					return txReject(re.Reason, "Pending tx %s is invalid: %s", ptx.TxHash, re.Message)
+				}
+				return err
+			}
+		}
+		_, _, err := dbApplyTx(dbtx, &u, &btx, lastHeight+1, CurrentBlockVersion)
+		return err
+	})
+}
+
+// Inserts the transaction into the pool, if there isn't already one from its sender with its nonce
+func dbInsertUtx(dbtx *sql.Tx, btx BlockTransaction, tx Tx) (bool, error) {
+	data := jsonifyWhatever(btx)
+	res, err := dbtx.Exec("INSERT OR IGNORE INTO utx(hash, ts, tx, sender, nonce, fee, size) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		btx.TxHash, getNowUTC(), data, tx.SigningPubKey, tx.PubKeyNonce, tx.MinerFeeAmount, len(data))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	// A dropped transaction which is sent again is no longer ignored
+	_, err = dbtx.Exec("DELETE FROM utx_dropped WHERE hash=?", btx.TxHash)
+	return true, err
+}
+
+// Returns the nonce of the next transaction from the sender, following its
+// transactions in the blockchain and in the pool.
+func dbGetNextNonce(dbtx *sql.Tx, sender string) (uint64, error) {
+	var stateNonce, utxNonce sql.NullInt64
+	err := dbtx.QueryRow("SELECT nonce FROM state WHERE pubkey=?", sender).Scan(&stateNonce)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	err = dbtx.QueryRow("SELECT MAX(nonce) FROM utx WHERE sender=?", sender).Scan(&utxNonce)
+	if err != nil {
+		return 0, err
+	}
+	if utxNonce.Int64 > stateNonce.Int64 {
+		return uint64(utxNonce.Int64) + 1, nil
+	}
+	return uint64(stateNonce.Int64) + 1, nil
+}
+
+// Selects the transactions to be included in a block at the given height, in the order
+// in which they need to be applied. Transactions which are already in the blockchain are
+// removed from the pool.
+func dbSelectUtxs(dbtx *sql.Tx, height int) ([]utxEntry, error) {
+	chains, err := dbGetUtxChains(dbtx)
+	if err != nil {
+		return nil, err
+	}
+	selected := []utxEntry{}
+	err = dbWithSavepoint(dbtx, "select_utx", true, func() error {
+		u := blockUndo{}
+		for len(chains) > 0 && len(selected) < miningMaxBlockTransactions {
+			// The sender whose next transaction has the highest fee per byte
+			best := ""
+			for sender, chain := range chains {
+				if best == "" || chain[0].feePerByte() > chains[best][0].feePerByte() ||
+					(chain[0].feePerByte() == chains[best][0].feePerByte() && sender < best) {
+					best = sender
+				}
+			}
+			e := chains[best][0]
+			chain := chains[best][1:]
+			if len(chain) == 0 || chain[0].tx.PubKeyNonce != e.tx.PubKeyNonce+1 {
+				delete(chains, best)
+			} else {
+				chains[best] = chain
+			}
+			err := dbWithSavepoint(dbtx, "apply_utx", false, func() error {
+				_, _, err := dbApplyTx(dbtx, &u, &e.btx, height, CurrentBlockVersion)
+				return err
+			})
+			if err != nil {
+				log.Println("Skipping tx", e.btx.TxHash, "and the following txs from", best, ":", err)
+				delete(chains, best)
+				continue
+			}
+			selected = append(selected, e)
+		}
+		return nil
+	})
+	return selected, err
+}
+
+// Returns the transactions in the pool by sender, ordered by nonce and starting with
+// the transaction which follows the sender's last transaction in the blockchain.
+// Transactions which are already in the blockchain are removed from the pool.
+func dbGetUtxChains(dbtx *sql.Tx) (map[string][]utxEntry, error) {
+	chains := map[string][]utxEntry{}
+	rows, err := dbtx.Query("SELECT tx, sender, size FROM utx ORDER BY sender, nonce")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		e := utxEntry{}
+		var txData, sender string
+		if err = rows.Scan(&txData, &sender, &e.size); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(txData), &e.btx); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(e.btx.TxData), &e.tx); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		chains[sender] = append(chains[sender], e)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for sender, chain := range chains {
+		states, err := dbGetStates(dbtx, []string{sender})
+		if err != nil {
+			return nil, err
+		}
+		nonce := uint64(0)
+		if states[sender] != nil {
+			nonce = states[sender].Nonce
+		}
+		_, err = dbtx.Exec("DELETE FROM utx WHERE sender=? AND nonce<=?", sender, nonce)
+		if err != nil {
+			return nil, err
+		}
+		for len(chain) > 0 && chain[0].tx.PubKeyNonce <= nonce {
+			chain = chain[1:]
+		}
+		if len(chain) == 0 || chain[0].tx.PubKeyNonce != nonce+1 {
+			// Waiting for the missing nonces
+			delete(chains, sender)
+			continue
+		}
+		chains[sender] = chain
+	}
+	return chains, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Returns a chain on which the miner has sent coins to each of the keys
+func newFundedTestChain(t *testing.T, miner *WalletKey, keys ...*WalletKey) *testChain {
+	t.Helper()
+	c := newTestChain(t)
+	c.mine(miner)
+	for _, key := range keys {
+		c.send(miner, Tx{Outputs: []TxOutput{{PubKey: key.Public, Amount: 10 * OneCoin}}})
+	}
+	c.mine(miner)
+	return c
+}
+
+// Returns the hashes of the transactions in the block after the coinbase tx
+func blockTxHashes(b BlockWithHeader) []string {
+	hashes := []string{}
+	for _, btx := range b.Transactions[1:] {
+		hashes = append(hashes, btx.TxHash)
+	}
+	return hashes
+}
+
+func TestBlockTxsOrderedByFee(t *testing.T) {
+	miner := getTestKey("miner")
+	alice := getTestKey("alice")
+	bob := getTestKey("bob")
+	c := newFundedTestChain(t, miner, alice, bob)
+
+	// Alice's second tx has the highest fee, but can only follow her first one
+	a1 := c.send(alice, Tx{Outputs: []TxOutput{{PubKey: miner.Public, Amount: 1}}, MinerFeeAmount: 10})
+	a2 := c.send(alice, Tx{Outputs: []TxOutput{{PubKey: miner.Public, Amount: 1}}, MinerFeeAmount: 1000})
+	b1 := c.send(bob, Tx{Outputs: []TxOutput{{PubKey: miner.Public, Amount: 1}}, MinerFeeAmount: 100})
+
+	reward := getTestKey("reward")
+	b := c.mine(reward)
+	expected := []string{b1.TxHash, a1.TxHash, a2.TxHash}
+	if hashes := blockTxHashes(b); !reflect.DeepEqual(hashes, expected) {
+		t.Error("Expecting the txs in the order", expected, "got", hashes)
+	}
+	if c.balance(reward) != getCoinbaseAtHeight(3)+1110 {
+		t.Error("Expecting the coinbase reward and the fees, got", c.balance(reward))
+	}
+	if c.balance(alice) != 10*OneCoin-1012 {
+		t.Error("Expecting the outputs and fees to be deducted, got", c.balance(alice))
+	}
+}
+
+func TestSendTxRejected(t *testing.T) {
+	miner := getTestKey("miner")
+	alice := getTestKey("alice")
+	c := newFundedTestChain(t, miner, alice)
+	url := c.serve(nil)
+	pending := c.send(alice, Tx{Outputs: []TxOutput{{PubKey: miner.Public, Amount: 1}}, MinerFeeAmount: 10})
+	pendingNonce := c.nextNonce(alice) - 1
+
+	badSignature := c.signTx(alice, Tx{Outputs: []TxOutput{{PubKey: miner.Public, Amount: 1}}})
+	badSignature.Signature = c.signTx(alice, Tx{}).Signature
+	for _, test := range []struct {
+		name   string
+		btx    BlockTransaction
+		reason string
+	}{
+		{"signature", badSignature, txRejectInvalid},
+		{"coinbase", c.signTx(alice, Tx{Flags: []string{"coinbase"}}), txRejectCoinbase},
+		{"used nonce", c.signTx(alice, Tx{PubKeyNonce: pendingNonce - 1}), txRejectNonce},
+		{"nonce gap", c.signTx(alice, Tx{PubKeyNonce: pendingNonce + 2}), txRejectNonce},
+		{"duplicate", c.signTx(alice, Tx{PubKeyNonce: pendingNonce, MinerFeeAmount: 10, Outputs: []TxOutput{{PubKey: alice.Public, Amount: 1}}}), txRejectDuplicate},
+		{"balance", c.signTx(alice, Tx{Outputs: []TxOutput{{PubKey: miner.Public, Amount: 20 * OneCoin}}}), txRejectBalance},
+		{"fee", c.signTx(alice, Tx{MinerFeeAmount: 20 * OneCoin}), txRejectBalance},
+		{"payload", c.signTx(alice, Tx{Data: PublishedData{"_id": "_intro", "_key": miner.Public, "_name": "alice"}}), txRejectPayload},
+	} {
+		resp, err := http.Post(url+"/api/sendtx", "application/json", strings.NewReader(jsonifyWhatever(test.btx)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := map[string]string{}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusBadRequest || result["reason"] != test.reason {
+			t.Errorf("Expecting the %s tx to be rejected for %q, got %d %v", test.name, test.reason, resp.StatusCode, result)
+		}
+		if dbExistsUtx(test.btx.TxHash) {
+			t.Errorf("The %s tx has been added to the pool", test.name)
+		}
+	}
+	if !dbExistsUtx(pending.TxHash) {
+		t.Error("The pending tx has been dropped")
+	}
+}
+
+func TestReplaceUtx(t *testing.T) {
+	miner := getTestKey("miner")
+	alice := getTestKey("alice")
+	c := newFundedTestChain(t, miner, alice)
+
+	first := c.send(alice, Tx{Outputs: []TxOutput{{PubKey: miner.Public, Amount: OneCoin}}, MinerFeeAmount: 10})
+	nonce := c.nextNonce(alice) - 1
+	later := c.send(alice, Tx{Outputs: []TxOutput{{PubKey: miner.Public, Amount: 5 * OneCoin}}})
+
+	// The replacement needs a higher fee, and leaves too little for the later tx
+	same := c.signTx(alice, Tx{PubKeyNonce: nonce, Outputs: []TxOutput{{PubKey: miner.Public, Amount: 6 * OneCoin}}, MinerFeeAmount: 10})
+	if _, err := acceptTx(same); err == nil || err.(*txRejectError).Reason != txRejectDuplicate {
+		t.Error("Expecting a replacement with the same fee to be rejected, got", err)
+	}
+	replacement := c.send(alice, Tx{PubKeyNonce: nonce, Outputs: []TxOutput{{PubKey: miner.Public, Amount: 6 * OneCoin}}, MinerFeeAmount: 20})
+	if !dbExistsUtx(replacement.TxHash) || dbExistsUtx(first.TxHash) || dbExistsUtx(later.TxHash) {
+		t.Error("Expecting only the replacement to be pending")
+	}
+	if !dbIsDroppedUtx(first.TxHash) || !dbIsDroppedUtx(later.TxHash) {
+		t.Error("Expecting the replaced tx and the later tx to be remembered as dropped")
+	}
+
+	b := c.mine(miner)
+	if hashes := blockTxHashes(b); !reflect.DeepEqual(hashes, []string{replacement.TxHash}) {
+		t.Error("Expecting only the replacement in the block, got", hashes)
+	}
+}
+
+func TestExpireUtxs(t *testing.T) {
+	miner := getTestKey("miner")
+	alice := getTestKey("alice")
+	bob := getTestKey("bob")
+	c := newFundedTestChain(t, miner, alice, bob)
+
+	a1 := c.send(alice, Tx{Outputs: []TxOutput{{PubKey: miner.Public, Amount: 1}}})
+	a2 := c.send(alice, Tx{Outputs: []TxOutput{{PubKey: miner.Public, Amount: 1}}})
+	b1 := c.send(bob, Tx{Outputs: []TxOutput{{PubKey: miner.Public, Amount: 1}}})
+	old := getNowUTC() - mempoolMaxAge - 1
+	if _, err := db.Exec("UPDATE utx SET ts=? WHERE hash=?", old, a1.TxHash); err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice's later tx can't be mined without the expired one
+	expireUtxs()
+	if dbExistsUtx(a1.TxHash) || dbExistsUtx(a2.TxHash) || !dbExistsUtx(b1.TxHash) {
+		t.Error("Expecting only bob's tx to be pending")
+	}
+	if !dbIsDroppedUtx(a1.TxHash) || !dbIsDroppedUtx(a2.TxHash) {
+		t.Error("Expecting alice's txs to be remembered as dropped")
+	}
+
+	// Dropped txs are forgotten after mempoolMaxAge
+	if _, err := db.Exec("UPDATE utx_dropped SET ts=? WHERE hash=?", old, a1.TxHash); err != nil {
+		t.Fatal(err)
+	}
+	expireUtxs()
+	if dbIsDroppedUtx(a1.TxHash) || !dbIsDroppedUtx(a2.TxHash) {
+		t.Error("Expecting only the tx dropped before mempoolMaxAge to be forgotten")
+	}
+}
+
+func TestEvictUtxs(t *testing.T) {
+	miner := getTestKey("miner")
+	alice := getTestKey("alice")
+	c := newFundedTestChain(t, miner, alice)
+
+	// Fill the pool with txs from other senders, which are only inserted
+	dbtx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < mempoolMaxTxs; i++ {
+		btx := BlockTransaction{TxHash: fmt.Sprintf("tx%d", i)}
+		tx := Tx{SigningPubKey: fmt.Sprintf("sender%d", i), PubKeyNonce: 1, MinerFeeAmount: uint64(10 + i)}
+		if _, err = dbInsertUtx(dbtx, btx, tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = dbtx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	low := c.signTx(alice, Tx{Outputs: []TxOutput{{PubKey: miner.Public, Amount: 1}}, MinerFeeAmount: 1})
+	if _, err = acceptTx(low); err == nil || err.(*txRejectError).Reason != txRejectFull {
+		t.Error("Expecting a tx with a low fee to be rejected from the full pool, got", err)
+	}
+	high := c.send(alice, Tx{Outputs: []TxOutput{{PubKey: miner.Public, Amount: 1}}, MinerFeeAmount: OneCoin})
+	if !dbExistsUtx(high.TxHash) || dbExistsUtx("tx0") || !dbExistsUtx("tx1") {
+		t.Error("Expecting the tx with the lowest fee to be evicted")
+	}
+	if !dbIsDroppedUtx("tx0") {
+		t.Error("Expecting the evicted tx to be remembered as dropped")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+// The transactions of a block (of version 2 and later) are committed to in the block
+// header by the root of a Merkle tree whose leaves are their hashes. Leaves and inner
+// nodes are hashed with different prefixes, so an inner node can't pose as a leaf, and
+// a node without a sibling on its level is promoted to the next level unchanged.
+// A Merkle proof is the list of the sibling hashes on the path from a leaf to the root,
+// which lets anyone check that a transaction is in a block, given only its header.
+
+const merkleLeafPrefix = 0
+const merkleNodePrefix = 1
+
+// One step of a Merkle proof: the sibling hash, and whether it's on the left
+type merkleProofStep struct {
+	Hash string `json:"h"`
+	Left bool   `json:"l,omitempty"`
+}
+
+func merkleLeafHash(txHash []byte) []byte {
+	h := sha256.Sum256(append([]byte{merkleLeafPrefix}, txHash...))
+	return h[:]
+}
+
+func merkleNodeHash(left, right []byte) []byte {
+	data := append([]byte{merkleNodePrefix}, left...)
+	h := sha256.Sum256(append(data, right...))
+	return h[:]
+}
+
+// Returns the Merkle root of the given transaction hashes
+func getMerkleRoot(txHashes [][]byte) []byte {
+	if len(txHashes) == 0 {
+		return nil
+	}
+	level := make([][]byte, len(txHashes))
+	for i, txHash := range txHashes {
+		level[i] = merkleLeafHash(txHash)
+	}
+	for len(level) > 1 {
+		level = getMerkleParentLevel(level)
+	}
+	return level[0]
+}
+
+func getMerkleParentLevel(level [][]byte) [][]byte {
+	parents := [][]byte{}
+	for i := 0; i < len(level); i += 2 {
+		if i+1 < len(level) {
+			parents = append(parents, merkleNodeHash(level[i], level[i+1]))
+		} else {
+			parents = append(parents, level[i])
+		}
+	}
+	return parents
+}
+
+// Returns the Merkle proof for the transaction at the given index
+func getMerkleProof(txHashes [][]byte, index int) []merkleProofStep {
+	level := make([][]byte, len(txHashes))
+	for i, txHash := range txHashes {
+		level[i] = merkleLeafHash(txHash)
+	}
+	proof := []merkleProofStep{}
+	for len(level) > 1 {
+		if index%2 == 1 {
+			proof = append(proof, merkleProofStep{Hash: mustEncodeBase64URL(level[index-1]), Left: true})
+		} else if index+1 < len(level) {
+			proof = append(proof, merkleProofStep{Hash: mustEncodeBase64URL(level[index+1])})
+		}
+		level = getMerkleParentLevel(level)
+		index /= 2
+	}
+	return proof
+}
+
+// Checks that the transaction hash is in the Merkle tree with the given root
+func verifyMerkleProof(txHash []byte, proof []merkleProofStep, root []byte) error {
+	h := merkleLeafHash(txHash)
+	for _, step := range proof {
+		sibling, err := base64.RawURLEncoding.DecodeString(step.Hash)
+		if err != nil {
+			return fmt.Errorf("Invalid Merkle proof hash %s: %s", step.Hash, err.Error())
+		}
+		if step.Left {
+			h = merkleNodeHash(sibling, h)
+		} else {
+			h = merkleNodeHash(h, sibling)
+		}
+	}
+	if !bytes.Equal(h, root) {
+		return fmt.Errorf("Merkle proof doesn't lead to the root %s", mustEncodeBase64URL(root))
+	}
+	return nil
+}
+
+// Returns the hashes of the block's transactions
+func (b *Block) getTxHashes() ([][]byte, error) {
+	hashes := [][]byte{}
+	for _, btx := range b.Transactions {
+		h, err := base64.RawURLEncoding.DecodeString(btx.TxHash)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid tx hash %s: %s", btx.TxHash, err.Error())
+		}
+		hashes = append(hashes, h)
+	}
+	return hashes, nil
+}
+
+// Returns the Merkle root of the block's transactions
+func (b *Block) getMerkleRoot() (string, error) {
+	hashes, err := b.getTxHashes()
+	if err != nil {
+		return "", err
+	}
+	return mustEncodeBase64URL(getMerkleRoot(hashes)), nil
+}
+
+// Checks that the Merkle root in the block header matches the block's transactions
+func (b *Block) verifyMerkleRoot() error {
+	if b.Version < 2 {
+		// Older blocks are hashed with their transactions
+		return nil
+	}
+	root, err := b.getMerkleRoot()
+	if err != nil {
+		return err
+	}
+	if root != b.MerkleRoot {
+		return fmt.Errorf("Merkle root doesn't match the transactions: expecting %s, got %s", root, b.MerkleRoot)
+	}
+	return nil
+}
@@ -2,15 +2,26 @@ package main
 
 import (
 	"database/sql"
-	"encoding/json"
 	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var currentDifficulty = GenesisBlockDifficulty
+// The miner builds a block from the pending transactions while holding chainLock,
+// and then searches for the nonce without it, in miningThreads goroutines which try
+// interleaved nonces. The search is abandoned as soon as the last block of the main
+// chain changes, e.g. because a block arrived from a peer, since the block being
+// mined would then only extend a fork.
+
+var minerHashrateLock = WithMutex{}
+var minerHashrate float64
+
+const minerHashrateLogInterval = 30 * time.Second
 
 func miningRig() {
-	log.Println("Starting the PoW miner...")
+	log.Println("Starting the PoW miner with", getMiningThreads(), "thread(s)...")
 	if *miningRewardAddress == "" {
 		if len(currentWallet.Keys) == 0 {
 			log.Println("No miningAddress specified and no keys in current wallet. Stopping the miner.")
@@ -18,90 +29,224 @@ func miningRig() {
 		}
 		*miningRewardAddress = currentWallet.Keys[0].Public
 	}
+	address, err := dbResolvePubKey(db, *miningRewardAddress)
+	if err != nil {
+		log.Println("Invalid miningAddress:", err, "Stopping the miner.")
+		return
+	}
+	*miningRewardAddress = address
 	for {
-		var min, max sql.NullInt64
-		dbtx, err := db.Begin()
+		if !mineFromUtx() {
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
+
+// Returns the number of threads the miner uses
+func getMiningThreads() int {
+	if *miningThreads > 0 {
+		return *miningThreads
+	}
+	return runtime.NumCPU()
+}
+
+// Returns the hash rate of the miner, in hashes per second
+func getMinerHashrate() float64 {
+	rate := 0.0
+	minerHashrateLock.With(func() {
+		rate = minerHashrate
+	})
+	return rate
+}
+
+func setMinerHashrate(rate float64) {
+	minerHashrateLock.With(func() {
+		minerHashrate = rate
+	})
+}
+
+// A block to be mined, with the difficulty it needs to be mined with
+type blockTemplate struct {
+	Height     int             `json:"height"`
+	Difficulty int             `json:"difficulty"`
+	Block      BlockWithHeader `json:"block"`
+	tip        int64           // the chainTipVersion the block was made for
+}
+
+// Mines a block from all the currently pending transactions, if there are any.
+// Returns true if mining was abandoned because the chain has changed, and should
+// be restarted immediately.
+func mineFromUtx() bool {
+	t, err := getBlockTemplate(*miningRewardAddress)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	if t == nil {
+		return false
+	}
+	block := t.Block
+	if !mineBlockNonce(&block.Block, t.Difficulty, func() bool { return getChainTipVersion() != t.tip }) {
+		log.Println("The last block has changed, abandoning the block at", t.Height)
+		return true
+	}
+	hash, err := block.Block.Hash()
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	block.BlockHeader.Hash = mustEncodeBase64URL(hash)
+	err = acceptBlock(block, t.Height)
+	if err != nil {
+		log.Println("Cannot accept mined block", block.BlockHeader.Hash, err)
+		return false
+	}
+	log.Printf("!! Mined block %s at %d, %d transaction(s), %.0f H/s\n", block.BlockHeader.Hash, t.Height, len(block.Transactions)-1, getMinerHashrate())
+	return false
+}
+
+// Returns a block to be mined from all the currently pending transactions, whose
+// coinbase transaction pays to the given address. Returns nil if there are no pending
+// transactions and empty blocks are not mined.
+func getBlockTemplate(rewardAddress string) (*blockTemplate, error) {
+	var t *blockTemplate
+	var err error
+	chainLock.With(func() {
+		var dbtx *sql.Tx
+		dbtx, err = db.Begin()
 		if err != nil {
-			log.Println(err)
-			continue
+			return
 		}
-		err = dbtx.QueryRow("SELECT MIN(id), MAX(id) FROM utx").Scan(&min, &max)
+		// Nothing but the removal of transactions which are already in the blockchain is written
+		defer dbtx.Commit()
+		lastHash := ""
+		lastHeight := 0
+		err = dbtx.QueryRow("SELECT hash, height FROM block ORDER BY height DESC LIMIT 1").Scan(&lastHash, &lastHeight)
 		if err != nil {
-			log.Println("Mining block min/max error", err)
-			continue
+			return
 		}
-		if min.Valid && max.Valid {
-			lastHash := ""
-			lastHeight := 0
-			err = dbtx.QueryRow("SELECT hash, height FROM block ORDER BY height DESC LIMIT 1").Scan(&lastHash, &lastHeight)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-			err = mineBlock(dbtx, uint64(min.Int64), uint64(max.Int64), lastHeight, lastHash, *miningRewardAddress)
-			if err == nil {
-				_, err = dbtx.Exec("DELETE FROM utx WHERE id BETWEEN ? AND ?", min.Int64, max.Int64)
+		t = &blockTemplate{Height: lastHeight + 1, tip: getChainTipVersion()}
+		t.Block, t.Difficulty, err = makeBlockTemplate(dbtx, lastHeight, lastHash, rewardAddress)
+		if err != nil || (len(t.Block.Transactions) == 1 && !*miningEmptyBlocks) {
+			// Only the coinbase tx would be in the block
+			t = nil
+		}
+	})
+	return t, err
+}
+
+// Searches for a nonce which gives the block a hash with the required difficulty, in
+// several goroutines. Returns false if abandoned() has returned true, which is checked
+// after every hash.
+func mineBlockNonce(b *Block, difficulty int, abandoned func() bool) bool {
+	threads := getMiningThreads()
+	var hashes uint64
+	var stop int32
+	var wg sync.WaitGroup
+	result := make(chan Block, threads)
+	timeStart := time.Now()
+	for i := 0; i < threads; i++ {
+		wb := *b
+		wb.Nonce += uint(i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&stop) == 0 {
+				atomic.AddUint64(&hashes, 1)
+				hash, err := wb.Hash()
 				if err != nil {
-					log.Panic(err)
+					log.Println(err)
+					atomic.StoreInt32(&stop, 1)
+					return
+				}
+				if countStartZeroBits(hash) >= difficulty {
+					atomic.StoreInt32(&stop, 1)
+					result <- wb
+					return
 				}
-				dbtx.Commit()
-			} else {
-				log.Println(err)
-				dbtx.Rollback()
+				if abandoned() {
+					atomic.StoreInt32(&stop, 1)
+					return
+				}
+				wb.Nonce += uint(threads)
+			}
+		}()
+	}
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(minerHashrateLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			setMinerHashrate(float64(atomic.LoadUint64(&hashes)) / time.Since(timeStart).Seconds())
+			log.Printf("Mining at difficulty %d, %.0f H/s\n", difficulty, getMinerHashrate())
+		case <-done:
+			setMinerHashrate(float64(atomic.LoadUint64(&hashes)) / time.Since(timeStart).Seconds())
+			select {
+			case *b = <-result:
+				return true
+			default:
+				return false
 			}
 		}
-		time.Sleep(5 * time.Second)
 	}
 }
 
-func mineBlock(dbtx *sql.Tx, min, max uint64, prevHeight int, prevHash string, rewardAddress string) error {
+// Creates a block from the pending transactions, and returns it (without the nonce
+// and the hash) together with the difficulty it needs to be mined with.
+func makeBlockTemplate(dbtx *sql.Tx, prevHeight int, prevHash string, rewardAddress string) (BlockWithHeader, int, error) {
 	newHeight := prevHeight + 1
 	block := BlockWithHeader{Block: Block{TimeUTC: time.Now().Unix(), PreviousBlockHash: prevHash, Transactions: []BlockTransaction{}}}
+	utxs, err := dbSelectUtxs(dbtx, newHeight)
+	if err != nil {
+		return block, 0, err
+	}
 	coinbaseReward := getCoinbaseAtHeight(newHeight)
-	var err error
-	for i := min; i <= max; i++ {
-		txData := ""
-		err = dbtx.QueryRow("SELECT tx FROM utx WHERE id=?", i).Scan(&txData)
-		if err != nil {
-			return err
-		}
-		btx := BlockTransaction{}
-		err = json.Unmarshal([]byte(txData), &btx)
-		if err != nil {
-			return err
-		}
-		tx, err := btx.VerifyBasics()
-		if err != nil {
-			return err
-		}
-		coinbaseReward += tx.MinerFeeAmount
-		block.Transactions = append(block.Transactions, btx)
+	for _, e := range utxs {
+		coinbaseReward += e.tx.MinerFeeAmount
 	}
 	coinbaseTx := Tx{Flags: []string{"coinbase"}, Version: CurrentTxVersion, Outputs: []TxOutput{TxOutput{PubKey: rewardAddress, Amount: coinbaseReward}}}
-	coinbaseTxData := jsonifyWhateverToBytes(coinbaseTx)
+	coinbaseTxData := mustCanonicalJSON(coinbaseTx)
 	txHash := getTxHashStr(coinbaseTxData)
-	coinbaseBtx := BlockTransaction{TxHash: txHash, TxData: string(coinbaseTxData)}
-	block.Transactions = append([]BlockTransaction{coinbaseBtx}, block.Transactions...)
-	block.StateHash, err = dbSimStateHashStr(dbtx, block)
+	block.Transactions = append(block.Transactions, BlockTransaction{TxHash: txHash, TxData: string(coinbaseTxData)})
+	for _, e := range utxs {
+		block.Transactions = append(block.Transactions, e.btx)
+	}
+	block.Version = CurrentBlockVersion
+	block.MerkleRoot, err = block.getMerkleRoot()
 	if err != nil {
-		if block.StateHash != "" {
-			// Assume this contains a tx hash of an invalid tx, and remove it
-			dbtx.Exec("DELETE FROM utx WHERE hash=?", block.StateHash)
+		return block, 0, err
+	}
+	err = dbWithSavepoint(dbtx, "template", true, func() error {
+		keys, err := dbApplyBlockTxs(dbtx, &blockUndo{}, block, newHeight)
+		if err != nil {
+			return err
 		}
+		block.StateHash, _, err = dbGetBlockStateHash(dbtx, block, newHeight, keys)
 		return err
+	})
+	if err != nil {
+		return block, 0, err
 	}
 
-	block.BlockHeader.Hash = block.Mine(currentDifficulty)
-
-	err = dataDirSaveBlock(block, newHeight)
+	prev, err := dbGetBlockTreeEntry(dbtx, prevHash)
 	if err != nil {
-		log.Fatal(err)
+		return block, 0, err
 	}
-	err = dbImportCheckedBlock(dbtx, block, newHeight, block.BlockHeader.Hash)
+	difficulty, err := getNextBlockDifficulty(dbtx, prev)
 	if err != nil {
-		dataDirDeleteBlock(block, newHeight)
-		return err
+		return block, 0, err
+	}
+	mtp, err := dbGetMedianTimePast(dbtx, prev)
+	if err != nil {
+		return block, 0, err
+	}
+	if block.TimeUTC <= mtp {
+		block.TimeUTC = mtp + 1
 	}
-	log.Printf("!! Mined block %s at %d, %d transaction(s)\n", block.BlockHeader.Hash, newHeight, max-min+1)
-	return nil
+	return block, difficulty, nil
 }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The mining API lets blocks be mined outside of the node, by processes which don't
+// have the database. A miner gets a block template with
+//
+//   GET /api/getblocktemplate?address=<reward address or @handle>
+//
+// which returns the height, the difficulty and the block to be mined (with the
+// previous block hash, the transactions including the coinbase transaction paying
+// to the reward address, and the state hash). The miner searches for a nonce which
+// gives the block a hash with the required number of leading zero bits, sets the
+// block hash, and sends the template back with
+//
+//   POST /api/submitblock
+//
+// The node validates and imports the block as if it came from a peer.
+//
+// Templates are cached by reward address until the chain tip or the mempool changes,
+// so that frequent polls don't contend with block imports for the chain lock. They
+// are also rebuilt after blockTemplateMaxAge, since command line tools can add
+// transactions to the database without the node knowing it.
+
+const minerPollInterval = 5 * time.Second
+const blockTemplateMaxAge = 30 * time.Second
+const blockTemplateCacheSize = 16
+
+type blockTemplateCacheEntry struct {
+	t       *blockTemplate // nil if there's nothing to mine
+	tip     int64
+	mempool int64
+	created time.Time
+}
+
+var blockTemplateCache = map[string]blockTemplateCacheEntry{}
+var blockTemplateCacheLock = WithMutex{}
+
+// Returns the block template for the reward address from the cache, if it's still
+// current, or makes a new one
+func getCachedBlockTemplate(address string) (*blockTemplate, error) {
+	tip := getChainTipVersion()
+	mempool := getMempoolVersion()
+	var e blockTemplateCacheEntry
+	var ok bool
+	blockTemplateCacheLock.With(func() {
+		e, ok = blockTemplateCache[address]
+	})
+	if ok && e.tip == tip && e.mempool == mempool && time.Since(e.created) < blockTemplateMaxAge {
+		return e.t, nil
+	}
+	t, err := getBlockTemplate(address)
+	if err != nil {
+		return nil, err
+	}
+	blockTemplateCacheLock.With(func() {
+		if len(blockTemplateCache) >= blockTemplateCacheSize {
+			blockTemplateCache = map[string]blockTemplateCacheEntry{}
+		}
+		blockTemplateCache[address] = blockTemplateCacheEntry{t: t, tip: tip, mempool: mempool, created: time.Now()}
+	})
+	return t, nil
+}
+
+// Handles /api/getblocktemplate
+func wwwGetBlockTemplate(w http.ResponseWriter, r *http.Request) {
+	address, err := dbResolvePubKey(db, r.URL.Query().Get("address"))
+	if err != nil {
+		wwwWriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if _, err = DecodePublicKeyString(address); err != nil {
+		wwwWriteJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Invalid reward address: %s", address)})
+		return
+	}
+	t, err := getCachedBlockTemplate(address)
+	if err != nil {
+		log.Println(err)
+		wwwWriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if t == nil {
+		wwwWriteJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "No transactions to mine"})
+		return
+	}
+	wwwWriteJSON(w, http.StatusOK, t)
+}
+
+// Handles /api/submitblock
+func wwwSubmitBlock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		wwwWriteJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "Expecting a POST request"})
+		return
+	}
+	t := blockTemplate{}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, wwwMaxRequestSize)).Decode(&t)
+	if err != nil {
+		wwwWriteJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Cannot decode block: %s", err.Error())})
+		return
+	}
+	err = acceptBlock(t.Block, t.Height)
+	if err != nil {
+		log.Println("Rejected submitted block", t.Block.BlockHeader.Hash, "from", r.RemoteAddr, err)
+		wwwWriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	log.Println("Accepted submitted block", t.Block.BlockHeader.Hash, "at", t.Height, "from", r.RemoteAddr)
+	wwwWriteJSON(w, http.StatusOK, map[string]string{"hash": t.Block.BlockHeader.Hash})
+}
+
+// Mines blocks from templates obtained from the node at the given URL, until interrupted
+func externalMiner(nodeURL, rewardAddress string) {
+	nodeURL = strings.TrimSuffix(nodeURL, "/")
+	log.Println("Mining for", nodeURL, "with", getMiningThreads(), "thread(s)...")
+	for {
+		t, err := minerGetBlockTemplate(nodeURL, rewardAddress)
+		if err != nil {
+			log.Println(err)
+			time.Sleep(minerPollInterval)
+			continue
+		}
+		// Abandon the block when the node starts handing out blocks with another previous block
+		var stop int32
+		done := make(chan bool)
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(minerPollInterval):
+					nt, err := minerGetBlockTemplate(nodeURL, rewardAddress)
+					if err == nil && nt.Block.PreviousBlockHash != t.Block.PreviousBlockHash {
+						atomic.StoreInt32(&stop, 1)
+						return
+					}
+				}
+			}
+		}()
+		found := mineBlockNonce(&t.Block.Block, t.Difficulty, func() bool { return atomic.LoadInt32(&stop) != 0 })
+		close(done)
+		if !found {
+			log.Println("The last block has changed, abandoning the block at", t.Height)
+			continue
+		}
+		hash, err := t.Block.Block.Hash()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		t.Block.BlockHeader.Hash = mustEncodeBase64URL(hash)
+		if err = minerSubmitBlock(nodeURL, t); err != nil {
+			log.Println("Block", t.Block.BlockHeader.Hash, "at", t.Height, "was rejected:", err)
+			continue
+		}
+		log.Printf("!! Mined block %s at %d, %d transaction(s), %.0f H/s\n", t.Block.BlockHeader.Hash, t.Height, len(t.Block.Transactions)-1, getMinerHashrate())
+	}
+}
+
+func minerGetBlockTemplate(nodeURL, rewardAddress string) (*blockTemplate, error) {
+	resp, err := http.Get(nodeURL + "/api/getblocktemplate?address=" + url.QueryEscape(rewardAddress))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, minerResponseError(resp)
+	}
+	t := blockTemplate{}
+	if err = json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return nil, fmt.Errorf("Cannot decode block template: %s", err.Error())
+	}
+	return &t, nil
+}
+
+func minerSubmitBlock(nodeURL string, t *blockTemplate) error {
+	resp, err := http.Post(nodeURL+"/api/submitblock", "application/json", bytes.NewReader(jsonifyWhateverToBytes(t)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return minerResponseError(resp)
+	}
+	return nil
+}
+
+// Returns the error message from an API response
+func minerResponseError(resp *http.Response) error {
+	msg := map[string]string{}
+	if json.NewDecoder(resp.Body).Decode(&msg) != nil || msg["error"] == "" {
+		return fmt.Errorf("Node responded with %s", resp.Status)
+	}
+	return fmt.Errorf("%s", msg["error"])
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// The orphan pool keeps blocks whose previous block is not yet known, e.g. because
+// blocks arrived out of order. When the previous block is accepted, the orphans
+// which follow it are accepted too. The pool is bounded by the number of blocks,
+// their total size and their age, so peers cannot exhaust the node's memory.
+
+const orphanPoolMaxBlocks = 100
+const orphanPoolMaxBytes = 32 * 1024 * 1024
+const orphanPoolMaxAge = 10 * time.Minute
+
+var errOrphanBlock = errors.New("Previous block is unknown")
+
+type orphanBlock struct {
+	block    BlockWithHeader
+	height   int
+	size     int
+	received time.Time
+}
+
+var orphanPoolLock = WithMutex{}
+var orphanPool = make(map[string]*orphanBlock)         // by block hash
+var orphanPoolByPrev = make(map[string][]*orphanBlock) // by previous block hash
+var orphanPoolBytes = 0
+
+// Adds a block whose previous block is unknown to the orphan pool
+func addOrphanBlock(b BlockWithHeader, height int) {
+	orphanPoolLock.With(func() {
+		if orphanPool[b.BlockHeader.Hash] != nil {
+			return
+		}
+		o := orphanBlock{block: b, height: height, size: len(b.Block.getBlockData()), received: time.Now()}
+		if o.size > orphanPoolMaxBytes {
+			return
+		}
+		expireOrphanBlocks()
+		for len(orphanPool) >= orphanPoolMaxBlocks || orphanPoolBytes+o.size > orphanPoolMaxBytes {
+			removeOrphanBlock(getOldestOrphanBlock())
+		}
+		orphanPool[b.BlockHeader.Hash] = &o
+		orphanPoolByPrev[b.PreviousBlockHash] = append(orphanPoolByPrev[b.PreviousBlockHash], &o)
+		orphanPoolBytes += o.size
+		log.Println("Added orphan block", b.BlockHeader.Hash, "at", height, "to the orphan pool, now", len(orphanPool), "orphans")
+	})
+}
+
+// Removes and returns the orphans following the given block
+func takeOrphanBlocks(prevHash string) []*orphanBlock {
+	orphans := []*orphanBlock{}
+	orphanPoolLock.With(func() {
+		orphans = append(orphans, orphanPoolByPrev[prevHash]...)
+		for _, o := range orphans {
+			removeOrphanBlock(o)
+		}
+	})
+	return orphans
+}
+
+// Returns the number of blocks in the orphan pool
+func getOrphanBlockCount() int {
+	count := 0
+	orphanPoolLock.With(func() {
+		count = len(orphanPool)
+	})
+	return count
+}
+
+// Must be called with orphanPoolLock held
+func removeOrphanBlock(o *orphanBlock) {
+	if o == nil || orphanPool[o.block.BlockHeader.Hash] == nil {
+		return
+	}
+	delete(orphanPool, o.block.BlockHeader.Hash)
+	siblings := orphanPoolByPrev[o.block.PreviousBlockHash]
+	for i := range siblings {
+		if siblings[i] == o {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(orphanPoolByPrev, o.block.PreviousBlockHash)
+	} else {
+		orphanPoolByPrev[o.block.PreviousBlockHash] = siblings
+	}
+	orphanPoolBytes -= o.size
+}
+
+// Must be called with orphanPoolLock held
+func getOldestOrphanBlock() *orphanBlock {
+	var oldest *orphanBlock
+	for _, o := range orphanPool {
+		if oldest == nil || o.received.Before(oldest.received) {
+			oldest = o
+		}
+	}
+	return oldest
+}
+
+// Must be called with orphanPoolLock held
+func expireOrphanBlocks() {
+	for _, o := range orphanPool {
+		if time.Since(o.received) > orphanPoolMaxAge {
+			removeOrphanBlock(o)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Empties the orphan pool
+func clearOrphanBlocks() {
+	orphanPoolLock.With(func() {
+		for _, o := range orphanPool {
+			removeOrphanBlock(o)
+		}
+	})
+}
+
+func TestOrphanBlocks(t *testing.T) {
+	miner := getTestKey("miner")
+	c := newTestChain(t)
+	blocks := []BlockWithHeader{GenesisBlock, c.mine(miner), c.mine(miner), c.mine(miner)}
+
+	// The blocks arrive in reverse order
+	c = newTestChain(t)
+	t.Cleanup(clearOrphanBlocks)
+	for height := 3; height >= 2; height-- {
+		if err := acceptBlock(blocks[height], height); err != errOrphanBlock {
+			t.Fatal("Expecting block", height, "to be an orphan, got", err)
+		}
+	}
+	if getOrphanBlockCount() != 2 {
+		t.Fatal("Expecting 2 orphans, got", getOrphanBlockCount())
+	}
+	if err := acceptBlock(blocks[1], 1); err != nil {
+		t.Fatal(err)
+	}
+	if c.height() != 3 || getOrphanBlockCount() != 0 {
+		t.Error("Expecting the orphans to be accepted after their previous block, got height", c.height(), "and", getOrphanBlockCount(), "orphans")
+	}
+}
+
+func TestOrphanBlockFromPeer(t *testing.T) {
+	miner := getTestKey("miner")
+	c := newTestChain(t)
+	blocks := []BlockWithHeader{GenesisBlock, c.mine(miner), c.mine(miner)}
+
+	// The node asks the peer for the previous block of an orphan
+	c = newTestChain(t)
+	t.Cleanup(clearOrphanBlocks)
+	tp := newTestPeer(t, 0)
+	tp.send(p2pMessage{Type: "block", Block: &blocks[2], Height: 2})
+	if msg := tp.expect("getdata"); len(msg.Inv) != 1 || msg.Inv[0].Hash != blocks[1].BlockHeader.Hash || msg.Inv[0].Height != 1 {
+		t.Fatal("Expecting a request for block 1, got", msg.Inv)
+	}
+	tp.send(p2pMessage{Type: "block", Block: &blocks[1], Height: 1})
+	tp.sync()
+	if c.height() != 2 {
+		t.Error("Expecting both blocks to be accepted, got height", c.height())
+	}
+}
+
+func TestOrphanPoolLimits(t *testing.T) {
+	t.Cleanup(clearOrphanBlocks)
+	orphan := func(i int) BlockWithHeader {
+		return BlockWithHeader{BlockHeader: BlockHeader{Hash: fmt.Sprintf("orphan%d", i)}, Block: Block{PreviousBlockHash: "unknown"}}
+	}
+	for i := 0; i <= orphanPoolMaxBlocks; i++ {
+		addOrphanBlock(orphan(i), 10)
+	}
+	if getOrphanBlockCount() != orphanPoolMaxBlocks {
+		t.Fatal("Expecting", orphanPoolMaxBlocks, "orphans, got", getOrphanBlockCount())
+	}
+	orphanPoolLock.With(func() {
+		if orphanPool["orphan0"] != nil || orphanPool["orphan1"] == nil {
+			t.Error("Expecting the oldest orphan to be removed")
+		}
+		// Orphans are removed after orphanPoolMaxAge
+		orphanPool["orphan1"].received = time.Now().Add(-orphanPoolMaxAge - time.Second)
+	})
+	addOrphanBlock(orphan(0), 10)
+	orphanPoolLock.With(func() {
+		if orphanPool["orphan1"] != nil || orphanPool["orphan2"] == nil {
+			t.Error("Expecting the expired orphan to be removed")
+		}
+	})
+	if len(takeOrphanBlocks("unknown")) != orphanPoolMaxBlocks || getOrphanBlockCount() != 0 {
+		t.Error("Expecting all the orphans to be taken")
+	}
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// P2P protocol between wot1 nodes. Peers exchange newline-delimited JSON messages
+// over TCP. After connecting, each side sends a "hello" message, and the connection
+// is dropped if the peers are not on the same chain (i.e. have different genesis blocks).
+// New blocks and transactions are announced with "inv" messages, which the receiving
+// peer answers with "getdata" for the items it doesn't have, which are then sent with
+// "block" and "tx" messages.
+
+const p2pProtocolVersion = 1
+const p2pMaxMessageSize = 32 * 1024 * 1024
+const p2pMaxKnownInv = 10000
+const p2pPingInterval = 30 * time.Second
+const p2pTimeout = 120 * time.Second
+const p2pReconnectInterval = 30 * time.Second
+const p2pMempoolAnnounceInterval = 60 * time.Second
+
+const (
+	p2pInvBlock = "block"
+	p2pInvTx    = "tx"
+)
+
+// A reference to a block or a transaction
+type p2pInvItem struct {
+	Type   string `json:"type"`
+	Hash   string `json:"hash"`
+	Height int    `json:"height,omitempty"`
+}
+
+// The JSON structure which goes over the wire between peers (delimited by newlines)
+type p2pMessage struct {
+	Type   string            `json:"type"`
+	Data   map[string]string `json:"data,omitempty"`
+	Inv    []p2pInvItem      `json:"inv,omitempty"`
+	Block  *BlockWithHeader  `json:"block,omitempty"`
+	Height int               `json:"height,omitempty"`
+	Tx     *BlockTransaction `json:"tx,omitempty"`
+}
+
+// The memory structure of a single connected peer
+type p2pPeer struct {
+	conn             net.Conn
+	addr             string
+	outbound         bool
+	toPeer           chan p2pMessage
+	fromPeer         chan p2pMessage
+	quit             chan struct{}
+	timeLastFromPeer time.Time
+	handshaked       bool
+	nodeID           string
+	lock             WithMutex
+	height           int
+	knownInv         map[string]bool
+}
+
+// Random ID of this node, used to detect connections to self
+var p2pNodeID = newP2PNodeID()
+
+// All currently connected peers
+var p2pPeersLock = WithMutex{}
+var p2pPeers = make(map[*p2pPeer]time.Time)
+
+func newP2PNodeID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// goroutine which accepts incoming peer connections and maintains outgoing ones
+func p2pServer() {
+	go p2pConnectPeers()
+	if *p2pBind == "" {
+		return
+	}
+	l, err := net.Listen("tcp", *p2pBind)
+	if err != nil {
+		log.Panic("Cannot listen on ", *p2pBind, " for peers")
+	}
+	log.Println("P2P listening on", *p2pBind)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		startPeer(conn, conn.RemoteAddr().String(), false)
+	}
+}
+
+// Returns the list of peer addresses given on the command line
+func getP2PPeerAddresses() []string {
+	addrs := []string{}
+	for _, addr := range strings.Split(*p2pPeerList, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// goroutine which (re)connects to the peers given on the command line
+func p2pConnectPeers() {
+	addrs := getP2PPeerAddresses()
+	if len(addrs) == 0 {
+		return
+	}
+	for {
+		for _, addr := range addrs {
+			connected := false
+			p2pPeersLock.With(func() {
+				for p := range p2pPeers {
+					if p.outbound && p.addr == addr {
+						connected = true
+					}
+				}
+			})
+			if connected {
+				continue
+			}
+			conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+			if err != nil {
+				log.Println("Cannot connect to peer", addr, err)
+				continue
+			}
+			startPeer(conn, addr, true)
+		}
+		time.Sleep(p2pReconnectInterval)
+	}
+}
+
+func startPeer(conn net.Conn, addr string, outbound bool) *p2pPeer {
+	p := p2pPeer{
+		conn:             conn,
+		addr:             addr,
+		outbound:         outbound,
+		toPeer:           make(chan p2pMessage, 100),
+		fromPeer:         make(chan p2pMessage, 100),
+		quit:             make(chan struct{}),
+		timeLastFromPeer: time.Now(),
+		knownInv:         make(map[string]bool),
+	}
+	p2pPeersLock.With(func() {
+		p2pPeers[&p] = time.Now()
+	})
+	go p.handlePeer()
+	return &p
+}
+
+// Returns the list of peers which have completed the handshake
+func getP2PPeers() []*p2pPeer {
+	peers := []*p2pPeer{}
+	p2pPeersLock.With(func() {
+		for p := range p2pPeers {
+			if p.handshaked {
+				peers = append(peers, p)
+			}
+		}
+	})
+	return peers
+}
+
+// Writes a log to the console
+func (p *p2pPeer) log(msgs ...interface{}) {
+	log.Println(append([]interface{}{"peer " + p.addr + ":"}, msgs...)...)
+}
+
+// Queues a message to be sent to the peer. Doesn't block if the peer is gone.
+func (p *p2pPeer) send(msg p2pMessage) {
+	select {
+	case p.toPeer <- msg:
+	case <-p.quit:
+	}
+}
+
+// Queues a message to be sent to the peer, dropping it if the peer's queue is full.
+// Used for messages coming from outside the peer's goroutine.
+func (p *p2pPeer) trySend(msg p2pMessage) {
+	select {
+	case p.toPeer <- msg:
+	default:
+		p.log("Send queue full, dropping", msg.Type)
+	}
+}
+
+func (p *p2pPeer) isKnown(hash string) bool {
+	known := false
+	p.lock.With(func() {
+		known = p.knownInv[hash]
+	})
+	return known
+}
+
+func (p *p2pPeer) setKnown(hash string) {
+	p.lock.With(func() {
+		if len(p.knownInv) >= p2pMaxKnownInv {
+			p.knownInv = make(map[string]bool)
+		}
+		p.knownInv[hash] = true
+	})
+}
+
+// Returns the best block height the peer has announced
+func (p *p2pPeer) getHeight() int {
+	height := 0
+	p.lock.With(func() {
+		height = p.height
+	})
+	return height
+}
+
+func (p *p2pPeer) updateHeight(height int) {
+	p.lock.With(func() {
+		if height > p.height {
+			p.height = height
+		}
+	})
+}
+
+func getP2PHelloMessage() p2pMessage {
+	height, hash, err := dbGetLastBlock()
+	if err != nil {
+		log.Println(err)
+	}
+	return p2pMessage{Type: "hello", Data: map[string]string{
+		"version": strconv.Itoa(p2pProtocolVersion),
+		"genesis": GenesisBlock.BlockHeader.Hash,
+		"node":    p2pNodeID,
+		"height":  strconv.Itoa(height),
+		"hash":    hash,
+	}}
+}
+
+// goroutine which handles a single peer connection
+func (p *p2pPeer) handlePeer() {
+	defer func() {
+		close(p.quit)
+		p.conn.Close()
+		p.syncAbort()
+		p2pPeersLock.With(func() {
+			delete(p2pPeers, p)
+		})
+		p.log("Disconnected")
+	}()
+	p.log("Connected")
+
+	// Reader
+	go func() {
+		scanner := bufio.NewScanner(p.conn)
+		scanner.Buffer(make([]byte, 64*1024), p2pMaxMessageSize)
+		for scanner.Scan() {
+			var msg p2pMessage
+			err := json.Unmarshal(scanner.Bytes(), &msg)
+			if err != nil {
+				msg = p2pMessage{Type: "_err", Data: map[string]string{"error": err.Error()}}
+			}
+			select {
+			case p.fromPeer <- msg:
+			case <-p.quit:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+		err := scanner.Err()
+		if err == nil {
+			err = fmt.Errorf("Connection closed")
+		}
+		select {
+		case p.fromPeer <- p2pMessage{Type: "_err", Data: map[string]string{"error": err.Error()}}:
+		case <-p.quit:
+		}
+	}()
+
+	// Writer
+	go func() {
+		enc := json.NewEncoder(p.conn)
+		for {
+			select {
+			case msg := <-p.toPeer:
+				p.conn.SetWriteDeadline(time.Now().Add(p2pTimeout))
+				if err := enc.Encode(msg); err != nil {
+					p.log(err)
+					p.conn.Close()
+					return
+				}
+			case <-p.quit:
+				return
+			}
+		}
+	}()
+
+	p.send(getP2PHelloMessage())
+	pingTicker := time.NewTicker(p2pPingInterval)
+	defer pingTicker.Stop()
+	mempoolTicker := time.NewTicker(p2pMempoolAnnounceInterval)
+	defer mempoolTicker.Stop()
+	for {
+		select {
+		case msg := <-p.fromPeer:
+			p.timeLastFromPeer = time.Now()
+			if msg.Type == "_err" {
+				p.log(msg.Data["error"])
+				return
+			}
+			if !p.handshaked && msg.Type != "hello" {
+				p.log("Expecting hello, got", msg.Type)
+				return
+			}
+			if err := p.handleMessage(msg); err != nil {
+				p.log(err)
+				return
+			}
+		case <-pingTicker.C:
+			if time.Since(p.timeLastFromPeer) > p2pTimeout {
+				p.log("Timeout. Last message received at", p.timeLastFromPeer)
+				return
+			}
+			if p.syncStalled() {
+				p.log("Sync stalled")
+				return
+			}
+			p.send(p2pMessage{Type: "ping"})
+		case <-mempoolTicker.C:
+			p.announceMempool()
+		}
+	}
+}
+
+// Handles a message received from the peer. Returning an error drops the connection.
+func (p *p2pPeer) handleMessage(msg p2pMessage) error {
+	switch msg.Type {
+	case "hello":
+		return p.handleHello(msg)
+	case "ping":
+		p.send(p2pMessage{Type: "pong"})
+	case "pong":
+	case "inv":
+		p.handleInv(msg)
+	case "getdata":
+		p.handleGetData(msg)
+	case "getblocks":
+		p.handleGetBlocks(msg)
+	case "endblocks":
+		p.syncBatchDone()
+	case "block":
+		if msg.Block == nil {
+			return fmt.Errorf("Empty block message")
+		}
+		p.handleBlock(*msg.Block, msg.Height)
+	case "tx":
+		if msg.Tx == nil {
+			return fmt.Errorf("Empty tx message")
+		}
+		p.handleTx(*msg.Tx)
+	case "notfound":
+	default:
+		p.log("Unknown message type", msg.Type)
+	}
+	return nil
+}
+
+func (p *p2pPeer) handleHello(msg p2pMessage) error {
+	if p.handshaked {
+		return fmt.Errorf("Duplicate hello")
+	}
+	if msg.Data["genesis"] != GenesisBlock.BlockHeader.Hash {
+		return fmt.Errorf("Peer is on a different chain, genesis %s", msg.Data["genesis"])
+	}
+	if msg.Data["node"] == p2pNodeID {
+		return fmt.Errorf("Connected to self")
+	}
+	version, err := strconv.Atoi(msg.Data["version"])
+	if err != nil || version < 1 {
+		return fmt.Errorf("Invalid protocol version %s", msg.Data["version"])
+	}
+	height, err := strconv.Atoi(msg.Data["height"])
+	if err != nil {
+		return fmt.Errorf("Invalid height %s", msg.Data["height"])
+	}
+	p.updateHeight(height)
+	duplicate := false
+	p2pPeersLock.With(func() {
+		for other := range p2pPeers {
+			if other != p && other.handshaked && other.nodeID == msg.Data["node"] {
+				duplicate = true
+			}
+		}
+		p.nodeID = msg.Data["node"]
+		p.handshaked = !duplicate
+	})
+	if duplicate {
+		return fmt.Errorf("Already connected to node %s", msg.Data["node"])
+	}
+	p.log("Handshake ok, peer height", height)
+	p.announceMempool()
+	p.maybeSync()
+	return nil
+}
+
+func (p *p2pPeer) handleInv(msg p2pMessage) {
+	want := []p2pInvItem{}
+	lastHeight, _, err := dbGetLastBlock()
+	if err != nil {
+		p.log(err)
+		return
+	}
+	for _, item := range msg.Inv {
+		p.setKnown(item.Hash)
+		switch item.Type {
+		case p2pInvBlock:
+			p.updateHeight(item.Height)
+			if item.Height > lastHeight+1 {
+				// We're behind, the block can't be imported yet
+				continue
+			}
+			if !dbExistsBlockTree(item.Hash) {
+				want = append(want, item)
+			}
+		case p2pInvTx:
+			if !dbExistsUtx(item.Hash) && !dbIsDroppedUtx(item.Hash) {
+				want = append(want, item)
+			}
+		}
+	}
+	if len(want) > 0 {
+		p.send(p2pMessage{Type: "getdata", Inv: want})
+	}
+	p.maybeSync()
+}
+
+func (p *p2pPeer) handleGetData(msg p2pMessage) {
+	notFound := []p2pInvItem{}
+	for _, item := range msg.Inv {
+		switch item.Type {
+		case p2pInvBlock:
+			e, err := dbGetBlockTreeEntry(db, item.Hash)
+			if err != nil {
+				notFound = append(notFound, item)
+				continue
+			}
+			height := e.Height
+			b, err := dataDirLoadBlock(height, item.Hash)
+			if err != nil {
+				p.log("Cannot load block", item.Hash, err)
+				notFound = append(notFound, item)
+				continue
+			}
+			p.setKnown(item.Hash)
+			p.send(p2pMessage{Type: "block", Block: &b, Height: height})
+		case p2pInvTx:
+			btx, err := dbGetUtx(item.Hash)
+			if err != nil {
+				notFound = append(notFound, item)
+				continue
+			}
+			p.setKnown(item.Hash)
+			p.send(p2pMessage{Type: "tx", Tx: &btx})
+		}
+	}
+	if len(notFound) > 0 {
+		p.send(p2pMessage{Type: "notfound", Inv: notFound})
+	}
+}
+
+func (p *p2pPeer) handleBlock(b BlockWithHeader, height int) {
+	p.setKnown(b.BlockHeader.Hash)
+	p.updateHeight(height)
+	isNew := !dbExistsBlockTree(b.BlockHeader.Hash)
+	if isNew {
+		err := acceptBlock(b, height)
+		if err == errOrphanBlock {
+			// Ask for the missing previous block
+			p.send(p2pMessage{Type: "getdata", Inv: []p2pInvItem{p2pInvItem{Type: p2pInvBlock, Hash: b.PreviousBlockHash, Height: height - 1}}})
+		} else if err != nil {
+			p.log("Rejected block", b.BlockHeader.Hash, err)
+			isNew = false
+		}
+	}
+	p.syncBlockReceived(height, isNew)
+}
+
+func (p *p2pPeer) handleTx(btx BlockTransaction) {
+	p.setKnown(btx.TxHash)
+	if dbIsDroppedUtx(btx.TxHash) {
+		// Dropped txs aren't taken back from peers which still have them
+		return
+	}
+	added, err := acceptTx(btx)
+	if err != nil {
+		p.log("Rejected tx", btx.TxHash, err)
+		return
+	}
+	if added {
+		p2pAnnounceTx(btx.TxHash)
+	}
+}
+
+// Announces the pending transactions the peer doesn't already know about
+func (p *p2pPeer) announceMempool() {
+	hashes, err := dbGetUtxHashes()
+	if err != nil {
+		p.log(err)
+		return
+	}
+	inv := []p2pInvItem{}
+	for _, hash := range hashes {
+		if !p.isKnown(hash) {
+			p.setKnown(hash)
+			inv = append(inv, p2pInvItem{Type: p2pInvTx, Hash: hash})
+		}
+	}
+	if len(inv) > 0 {
+		p.send(p2pMessage{Type: "inv", Inv: inv})
+	}
+}
+
+func p2pAnnounce(item p2pInvItem) {
+	for _, p := range getP2PPeers() {
+		if !p.isKnown(item.Hash) {
+			p.setKnown(item.Hash)
+			p.trySend(p2pMessage{Type: "inv", Inv: []p2pInvItem{item}})
+		}
+	}
+}
+
+// Announces a new block to all peers which don't know about it
+func p2pAnnounceBlock(hash string, height int) {
+	p2pAnnounce(p2pInvItem{Type: p2pInvBlock, Hash: hash, Height: height})
+}
+
+// Announces a new pending transaction to all peers which don't know about it
+func p2pAnnounceTx(hash string) {
+	p2pAnnounce(p2pInvItem{Type: p2pInvTx, Hash: hash})
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The remote end of a connection to the node, driven by the test
+type testPeer struct {
+	t       *testing.T
+	conn    net.Conn
+	scanner *bufio.Scanner
+	enc     *json.Encoder
+}
+
+// Connects a peer to the node, and does the handshake with the given best block height
+func newTestPeer(t *testing.T, height int) *testPeer {
+	t.Helper()
+	conn, nodeConn := net.Pipe()
+	p := startPeer(nodeConn, "test", false)
+	tp := &testPeer{t: t, conn: conn, scanner: bufio.NewScanner(conn), enc: json.NewEncoder(conn)}
+	tp.scanner.Buffer(make([]byte, 64*1024), p2pMaxMessageSize)
+	t.Cleanup(func() {
+		// Wait for the peer to stop using the database
+		conn.Close()
+		for {
+			gone := false
+			p2pPeersLock.With(func() {
+				_, ok := p2pPeers[p]
+				gone = !ok
+			})
+			if gone {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	tp.expect("hello")
+	tp.send(p2pMessage{Type: "hello", Data: map[string]string{
+		"version": strconv.Itoa(p2pProtocolVersion),
+		"genesis": GenesisBlock.BlockHeader.Hash,
+		"node":    "test",
+		"height":  strconv.Itoa(height),
+	}})
+	return tp
+}
+
+func (tp *testPeer) send(msg p2pMessage) {
+	tp.t.Helper()
+	tp.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err := tp.enc.Encode(msg); err != nil {
+		tp.t.Fatal(err)
+	}
+}
+
+// Returns the next message from the node
+func (tp *testPeer) next() p2pMessage {
+	tp.t.Helper()
+	tp.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if !tp.scanner.Scan() {
+		tp.t.Fatal("No message from the node:", tp.scanner.Err())
+	}
+	msg := p2pMessage{}
+	if err := json.Unmarshal(tp.scanner.Bytes(), &msg); err != nil {
+		tp.t.Fatal(err)
+	}
+	return msg
+}
+
+// Returns the next message from the node, which must be of the given type
+func (tp *testPeer) expect(msgType string) p2pMessage {
+	tp.t.Helper()
+	msg := tp.next()
+	if msg.Type != msgType {
+		tp.t.Fatalf("Expecting a %s message from the node, got %+v", msgType, msg)
+	}
+	return msg
+}
+
+// Waits until the node has handled the messages sent so far
+func (tp *testPeer) sync() {
+	tp.t.Helper()
+	tp.send(p2pMessage{Type: "ping"})
+	tp.expect("pong")
+}
+
+func TestP2PGossip(t *testing.T) {
+	miner := getTestKey("miner")
+	alice := getTestKey("alice")
+	c := newTestChain(t)
+	b1 := c.mine(miner)
+
+	c = newTestChain(t)
+	tp := newTestPeer(t, 0)
+	tp.sync()
+
+	// A block announced by the peer is requested and imported. Since the peer is now
+	// ahead, the node also starts syncing from it.
+	tp.send(p2pMessage{Type: "inv", Inv: []p2pInvItem{{Type: p2pInvBlock, Hash: b1.BlockHeader.Hash, Height: 1}}})
+	if msg := tp.expect("getdata"); len(msg.Inv) != 1 || msg.Inv[0].Hash != b1.BlockHeader.Hash {
+		t.Fatal("Expecting a request for block 1, got", msg.Inv)
+	}
+	tp.expect("getblocks")
+	tp.send(p2pMessage{Type: "block", Block: &b1, Height: 1})
+	tp.send(p2pMessage{Type: "endblocks"})
+	tp.sync()
+	if c.height() != 1 {
+		t.Fatal("The block from the peer hasn't been imported")
+	}
+
+	// And so is a tx
+	btx := c.signTx(miner, Tx{Outputs: []TxOutput{{PubKey: alice.Public, Amount: OneCoin}}})
+	tp.send(p2pMessage{Type: "inv", Inv: []p2pInvItem{{Type: p2pInvTx, Hash: btx.TxHash}}})
+	if msg := tp.expect("getdata"); len(msg.Inv) != 1 || msg.Inv[0].Hash != btx.TxHash {
+		t.Fatal("Expecting a request for the tx, got", msg.Inv)
+	}
+	tp.send(p2pMessage{Type: "tx", Tx: &btx})
+	tp.sync()
+	if !dbExistsUtx(btx.TxHash) {
+		t.Fatal("The tx from the peer hasn't been added to the pool")
+	}
+
+	// The node's own txs are announced, and sent when requested
+	own := c.send(miner, Tx{Outputs: []TxOutput{{PubKey: alice.Public, Amount: OneCoin}}})
+	p2pAnnounceTx(own.TxHash)
+	if msg := tp.expect("inv"); len(msg.Inv) != 1 || msg.Inv[0].Hash != own.TxHash {
+		t.Fatal("Expecting the tx to be announced, got", msg.Inv)
+	}
+	tp.send(p2pMessage{Type: "getdata", Inv: []p2pInvItem{{Type: p2pInvTx, Hash: own.TxHash}, {Type: p2pInvTx, Hash: "unknown"}}})
+	if msg := tp.expect("tx"); msg.Tx == nil || msg.Tx.TxHash != own.TxHash {
+		t.Fatal("Expecting the tx, got", msg.Tx)
+	}
+	if msg := tp.expect("notfound"); len(msg.Inv) != 1 || msg.Inv[0].Hash != "unknown" {
+		t.Fatal("Expecting the unknown tx not to be found, got", msg.Inv)
+	}
+
+	// Items the peer has announced aren't announced back to it, but new blocks are
+	p2pAnnounceTx(btx.TxHash)
+	b2 := c.mine(miner)
+	if msg := tp.expect("inv"); len(msg.Inv) != 1 || msg.Inv[0].Hash != b2.BlockHeader.Hash || msg.Inv[0].Height != 2 {
+		t.Fatal("Expecting block 2 to be announced, got", msg.Inv)
+	}
+	tp.send(p2pMessage{Type: "getdata", Inv: []p2pInvItem{{Type: p2pInvBlock, Hash: b2.BlockHeader.Hash}}})
+	if msg := tp.expect("block"); msg.Block == nil || msg.Block.BlockHeader.Hash != b2.BlockHeader.Hash || msg.Height != 2 {
+		t.Fatal("Expecting block 2, got", msg.Block)
+	}
+}
+
+func TestP2PHandshake(t *testing.T) {
+	newTestChain(t)
+	for _, data := range []map[string]string{
+		{"version": "1", "genesis": "other", "node": "test", "height": "0"},
+		{"version": "1", "genesis": GenesisBlock.BlockHeader.Hash, "node": p2pNodeID, "height": "0"},
+		{"version": "0", "genesis": GenesisBlock.BlockHeader.Hash, "node": "test", "height": "0"},
+	} {
+		conn, nodeConn := net.Pipe()
+		startPeer(nodeConn, "test", false)
+		tp := &testPeer{t: t, conn: conn, scanner: bufio.NewScanner(conn), enc: json.NewEncoder(conn)}
+		tp.expect("hello")
+		tp.send(p2pMessage{Type: "hello", Data: data})
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if tp.scanner.Scan() {
+			t.Error("Expecting the node to disconnect after the hello", data)
+		}
+		conn.Close()
+	}
+}
+
+func TestP2PInitialSync(t *testing.T) {
+	miner := getTestKey("miner")
+	c := newTestChain(t)
+	blocks := []BlockWithHeader{GenesisBlock}
+	for i := 0; i < 5; i++ {
+		blocks = append(blocks, c.mine(miner))
+	}
+
+	// The node asks a peer which is ahead for the blocks after its last one, in batches
+	c = newTestChain(t)
+	tp := newTestPeer(t, 5)
+	msg := tp.expect("getblocks")
+	if msg.Data["locator"] != GenesisBlock.BlockHeader.Hash || msg.Data["count"] != strconv.Itoa(p2pSyncBatchSize) {
+		t.Fatal("Expecting a request for the blocks after the genesis block, got", msg.Data)
+	}
+	for height := 1; height <= 3; height++ {
+		tp.send(p2pMessage{Type: "block", Block: &blocks[height], Height: height})
+	}
+	tp.send(p2pMessage{Type: "endblocks"})
+	msg = tp.expect("getblocks")
+	if !strings.HasPrefix(msg.Data["locator"], blocks[3].BlockHeader.Hash+",") {
+		t.Fatal("Expecting a request for the blocks after block 3, got", msg.Data)
+	}
+	if syncing, target := getP2PSyncStatus(); !syncing || target != 5 {
+		t.Error("Expecting the node to be syncing to block 5, got", syncing, target)
+	}
+	for height := 4; height <= 5; height++ {
+		tp.send(p2pMessage{Type: "block", Block: &blocks[height], Height: height})
+	}
+	tp.send(p2pMessage{Type: "endblocks"})
+	tp.sync()
+	if c.height() != 5 {
+		t.Fatal("Expecting the node to be synced to block 5, got", c.height())
+	}
+	if syncing, _ := getP2PSyncStatus(); syncing {
+		t.Error("Expecting the sync to be complete")
+	}
+
+	// The node sends the blocks after the first block of the locator in its main chain
+	tp.send(p2pMessage{Type: "getblocks", Data: map[string]string{"locator": "unknown," + blocks[2].BlockHeader.Hash + "," + GenesisBlock.BlockHeader.Hash, "count": "2"}})
+	for height := 3; height <= 4; height++ {
+		if msg = tp.expect("block"); msg.Height != height || msg.Block.BlockHeader.Hash != blocks[height].BlockHeader.Hash {
+			t.Fatal("Expecting block", height, "got", msg.Height)
+		}
+	}
+	tp.expect("endblocks")
+}
+
+func TestP2PSyncStopsWithoutBlocks(t *testing.T) {
+	newTestChain(t)
+	tp := newTestPeer(t, 10)
+	tp.expect("getblocks")
+	tp.send(p2pMessage{Type: "endblocks"})
+
+	// The peer claimed blocks it doesn't send, so no more are requested
+	tp.sync()
+	if syncing, _ := getP2PSyncStatus(); syncing {
+		t.Error("Expecting the sync to stop")
+	}
+}
+
+func TestP2PIgnoresDroppedTxs(t *testing.T) {
+	miner := getTestKey("miner")
+	alice := getTestKey("alice")
+	c := newFundedTestChain(t, miner, alice)
+	expired := c.send(alice, Tx{Outputs: []TxOutput{{PubKey: miner.Public, Amount: 1}}})
+	if _, err := db.Exec("UPDATE utx SET ts=? WHERE hash=?", getNowUTC()-mempoolMaxAge-1, expired.TxHash); err != nil {
+		t.Fatal(err)
+	}
+	expireUtxs()
+
+	// A peer which still has the expired tx doesn't bring it back
+	tp := newTestPeer(t, c.height())
+	tp.send(p2pMessage{Type: "inv", Inv: []p2pInvItem{{Type: p2pInvTx, Hash: expired.TxHash}}})
+	tp.sync()
+	tp.send(p2pMessage{Type: "tx", Tx: &expired})
+	tp.sync()
+	if dbExistsUtx(expired.TxHash) {
+		t.Error("The expired tx has been taken back from the peer")
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Initial block download: when a peer has a higher block height than this node,
+// the missing blocks are requested from it in batches with "getblocks" messages,
+// and imported in order as they arrive. Only one peer is synced from at a time.
+// Since every imported block is saved into the data directory, the sync simply
+// continues from the last imported block if it is interrupted.
+//
+// The "getblocks" message contains a block locator: a list of hashes of blocks in
+// the main chain, dense near the last block and sparse towards the genesis block.
+// The peer sends the blocks following the first locator block which is in its
+// own main chain, so the sync also works if the peer is on a different fork,
+// followed by an "endblocks" message.
+
+const p2pSyncBatchSize = 100
+const p2pSyncStallTimeout = 60 * time.Second
+const p2pSyncProgressInterval = 5 * time.Second
+
+type p2pSyncState struct {
+	peer          *p2pPeer
+	batchPending  bool // a batch of blocks has been requested and not yet received
+	progressed    bool // new blocks were received in the current batch
+	targetHeight  int
+	startHeight   int
+	timeLastBlock time.Time
+	timeLastLog   time.Time
+}
+
+var p2pSyncLock = WithMutex{}
+var p2pSync = p2pSyncState{}
+
+// Starts or continues syncing from the peer if it has blocks this node doesn't
+func (p *p2pPeer) maybeSync() {
+	lastHeight, _, err := dbGetLastBlock()
+	if err != nil {
+		p.log(err)
+		return
+	}
+	peerHeight := p.getHeight()
+	request := false
+	p2pSyncLock.With(func() {
+		if p2pSync.peer != nil && p2pSync.peer != p {
+			// Already syncing from another peer
+			return
+		}
+		if p2pSync.peer == p && p2pSync.batchPending {
+			// The current batch is still arriving
+			return
+		}
+		if peerHeight <= lastHeight {
+			if p2pSync.peer == p {
+				log.Println("Sync complete at height", lastHeight)
+				p2pSync = p2pSyncState{}
+			}
+			return
+		}
+		if p2pSync.peer == p && !p2pSync.progressed {
+			log.Println("No new blocks received from", p.addr, ", stopping sync at height", lastHeight)
+			p2pSync = p2pSyncState{}
+			return
+		}
+		if p2pSync.peer == nil {
+			log.Println("Starting sync from", p.addr, "from height", lastHeight, "to", peerHeight)
+			p2pSync = p2pSyncState{peer: p, startHeight: lastHeight, timeLastLog: time.Now()}
+		}
+		p2pSync.batchPending = true
+		p2pSync.progressed = false
+		p2pSync.targetHeight = peerHeight
+		p2pSync.timeLastBlock = time.Now()
+		request = true
+	})
+	if request {
+		locator, err := dbGetBlockLocator()
+		if err != nil {
+			p.log(err)
+			return
+		}
+		p.send(p2pMessage{Type: "getblocks", Data: map[string]string{"locator": strings.Join(locator, ","), "count": strconv.Itoa(p2pSyncBatchSize)}})
+	}
+}
+
+// Called after a block has been received from the peer
+func (p *p2pPeer) syncBlockReceived(height int, isNew bool) {
+	p2pSyncLock.With(func() {
+		if p2pSync.peer != p {
+			return
+		}
+		p2pSync.timeLastBlock = time.Now()
+		p2pSync.progressed = p2pSync.progressed || isNew
+		if time.Since(p2pSync.timeLastLog) >= p2pSyncProgressInterval {
+			p2pSync.timeLastLog = time.Now()
+			log.Printf("Sync progress: block %d of %d (%.1f%%)\n", height, p2pSync.targetHeight, p2pSync.getProgress(height))
+		}
+	})
+}
+
+// Called when the peer has sent all the blocks in the requested batch
+func (p *p2pPeer) syncBatchDone() {
+	p2pSyncLock.With(func() {
+		if p2pSync.peer == p {
+			p2pSync.batchPending = false
+		}
+	})
+	p.maybeSync()
+}
+
+// Returns the sync progress in percent, for the given current height
+func (s *p2pSyncState) getProgress(height int) float64 {
+	if s.targetHeight <= s.startHeight {
+		return 100
+	}
+	return float64(height-s.startHeight) * 100 / float64(s.targetHeight-s.startHeight)
+}
+
+// Stops syncing from the peer, e.g. because it has disconnected
+func (p *p2pPeer) syncAbort() {
+	p2pSyncLock.With(func() {
+		if p2pSync.peer == p {
+			p2pSync = p2pSyncState{}
+		}
+	})
+	// Continue syncing from another peer
+	for _, other := range getP2PPeers() {
+		if other != p {
+			other.maybeSync()
+		}
+	}
+}
+
+// Returns true if the peer has stopped sending requested blocks
+func (p *p2pPeer) syncStalled() bool {
+	stalled := false
+	p2pSyncLock.With(func() {
+		stalled = p2pSync.peer == p && time.Since(p2pSync.timeLastBlock) > p2pSyncStallTimeout
+	})
+	return stalled
+}
+
+// Returns true if this node is currently syncing, with the current target height
+func getP2PSyncStatus() (bool, int) {
+	syncing := false
+	target := 0
+	p2pSyncLock.With(func() {
+		syncing = p2pSync.peer != nil
+		target = p2pSync.targetHeight
+	})
+	return syncing, target
+}
+
+// Returns a block locator for the main chain: the hashes of the last 10 blocks, then
+// of blocks in exponentially increasing steps, ending with the genesis block.
+func dbGetBlockLocator() ([]string, error) {
+	lastHeight, _, err := dbGetLastBlock()
+	if err != nil {
+		return nil, err
+	}
+	locator := []string{}
+	step := 1
+	for height := lastHeight; height > 0; height -= step {
+		hash, err := dbGetBlockHash(height)
+		if err != nil {
+			return nil, err
+		}
+		locator = append(locator, hash)
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+	return append(locator, GenesisBlock.BlockHeader.Hash), nil
+}
+
+// Sends the blocks from the main chain following the first known block in the locator
+func (p *p2pPeer) handleGetBlocks(msg p2pMessage) {
+	defer p.send(p2pMessage{Type: "endblocks"})
+	count, err := strconv.Atoi(msg.Data["count"])
+	if err != nil || count < 0 {
+		p.log("Invalid getblocks count:", msg.Data["count"])
+		return
+	}
+	if count > p2pSyncBatchSize {
+		count = p2pSyncBatchSize
+	}
+	from := 1
+	for _, hash := range strings.Split(msg.Data["locator"], ",") {
+		if height, err := dbGetBlockHeight(hash); err == nil {
+			from = height + 1
+			break
+		}
+	}
+	for height := from; height < from+count; height++ {
+		hash, err := dbGetBlockHash(height)
+		if err != nil {
+			break
+		}
+		b, err := dataDirLoadBlock(height, hash)
+		if err != nil {
+			p.log("Cannot load block", hash, err)
+			break
+		}
+		p.setKnown(hash)
+		p.send(p2pMessage{Type: "block", Block: &b, Height: height})
+	}
+}
+
+// Connects to the peers and imports blocks until this node has caught up with them
+func p2pSyncAndExit() {
+	if len(getP2PPeerAddresses()) == 0 {
+		log.Println("No peers specified, use the -peers flag")
+		os.Exit(1)
+	}
+	go p2pConnectPeers()
+	timeLastProgress := time.Now()
+	for {
+		time.Sleep(time.Second)
+		peers := getP2PPeers()
+		if len(peers) == 0 {
+			if time.Since(timeLastProgress) > p2pTimeout {
+				log.Println("Cannot connect to any peers")
+				os.Exit(1)
+			}
+			continue
+		}
+		syncing, _ := getP2PSyncStatus()
+		if syncing {
+			timeLastProgress = time.Now()
+			continue
+		}
+		if time.Since(timeLastProgress) > p2pTimeout {
+			log.Println("Cannot sync from any peers")
+			os.Exit(1)
+		}
+		lastHeight, lastHash, err := dbGetLastBlock()
+		if err != nil {
+			log.Fatal(err)
+		}
+		bestHeight := 0
+		for _, p := range peers {
+			if p.getHeight() > bestHeight {
+				bestHeight = p.getHeight()
+			}
+		}
+		if lastHeight >= bestHeight {
+			log.Println("Synced to block", lastHash, "at", lastHeight)
+			return
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// A proof that a transaction is in a block of the main chain: the block header, and
+// the Merkle proof of the transaction against the header's Merkle root. Anyone who
+// trusts the block hash (e.g. by having verified the chain of headers up to it) can
+// check it without having the block. Blocks older than version 2 have no Merkle root,
+// so the proof for them is the whole block.
+type txProof struct {
+	Height    int                `json:"height"`
+	BlockHash string             `json:"block_hash"`
+	Header    CompactBlockHeader `json:"header"`
+	Index     int                `json:"index"`
+	Tx        BlockTransaction   `json:"tx"`
+	Proof     []merkleProofStep  `json:"proof"`
+	Block     *Block             `json:"block,omitempty"` // for blocks older than version 2
+}
+
+// Returns the proof that the transaction is in the main chain, for the last block containing it
+func dbGetTxProof(txHash string) (*txProof, error) {
+	p := txProof{}
+	err := db.QueryRow("SELECT height, idx FROM block_tx WHERE hash=? ORDER BY height DESC LIMIT 1", txHash).Scan(&p.Height, &p.Index)
+	if err != nil {
+		return nil, err
+	}
+	p.BlockHash, err = dbGetBlockHash(p.Height)
+	if err != nil {
+		return nil, err
+	}
+	b, err := dataDirLoadBlock(p.Height, p.BlockHash)
+	if err != nil {
+		return nil, err
+	}
+	if p.Index >= len(b.Transactions) || b.Transactions[p.Index].TxHash != txHash {
+		return nil, fmt.Errorf("Tx %s is not at %d in block %s", txHash, p.Index, p.BlockHash)
+	}
+	hashes, err := b.getTxHashes()
+	if err != nil {
+		return nil, err
+	}
+	p.Header = b.CompactHeader()
+	p.Tx = b.Transactions[p.Index]
+	if b.Version < 2 {
+		p.Proof = []merkleProofStep{}
+		p.Block = &b.Block
+	} else {
+		p.Proof = getMerkleProof(hashes, p.Index)
+	}
+	return &p, nil
+}
+
+// Checks that the proof is consistent: the transaction data matches its hash, the
+// header matches the block hash, and the Merkle proof leads to the header's Merkle root.
+func (p *txProof) verify() error {
+	if getTxHashStr([]byte(p.Tx.TxData)) != p.Tx.TxHash {
+		return fmt.Errorf("Tx data doesn't match its hash %s", p.Tx.TxHash)
+	}
+	if p.Header.Version < 2 {
+		if p.Block == nil {
+			return fmt.Errorf("Missing block %s", p.BlockHash)
+		}
+		hash, err := p.Block.Hash()
+		if err != nil {
+			return err
+		}
+		if mustEncodeBase64URL(hash) != p.BlockHash {
+			return fmt.Errorf("Block doesn't match the block hash %s", p.BlockHash)
+		}
+		if p.Index >= len(p.Block.Transactions) || jsonifyWhatever(p.Block.Transactions[p.Index]) != jsonifyWhatever(p.Tx) {
+			return fmt.Errorf("Tx %s is not at %d in block %s", p.Tx.TxHash, p.Index, p.BlockHash)
+		}
+		return nil
+	}
+	hash, err := p.Header.Hash()
+	if err != nil {
+		return err
+	}
+	if mustEncodeBase64URL(hash) != p.BlockHash {
+		return fmt.Errorf("Block header doesn't match the block hash %s", p.BlockHash)
+	}
+	root, err := base64.RawURLEncoding.DecodeString(p.Header.MerkleRoot)
+	if err != nil {
+		return fmt.Errorf("Invalid Merkle root %s: %s", p.Header.MerkleRoot, err.Error())
+	}
+	txHash, err := base64.RawURLEncoding.DecodeString(p.Tx.TxHash)
+	if err != nil {
+		return fmt.Errorf("Invalid tx hash %s: %s", p.Tx.TxHash, err.Error())
+	}
+	return verifyMerkleProof(txHash, p.Proof, root)
+}
+
+// Handles /api/txproof?hash=<tx hash>
+func wwwGetTxProof(w http.ResponseWriter, r *http.Request) {
+	txHash := r.URL.Query().Get("hash")
+	p, err := dbGetTxProof(txHash)
+	if err == sql.ErrNoRows {
+		wwwWriteJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("Tx %s is not in the blockchain", txHash)})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		wwwWriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	wwwWriteJSON(w, http.StatusOK, p)
+}
+
+// A proof of a value in the state tree after the last block of the main chain: the
+// block header, whose state hash is the root of the state tree, and the proof of the
+// value against it.
+type blockStateProof struct {
+	Height    int                `json:"height"`
+	BlockHash string             `json:"block_hash"`
+	Header    CompactBlockHeader `json:"header"`
+	Proof     stateProof         `json:"proof"`
+}
+
+// Returns the proof of the value of the state tree key after the last block
+func dbGetBlockStateProof(key string) (*blockStateProof, error) {
+	dbtx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer dbtx.Rollback()
+	p := blockStateProof{}
+	err = dbtx.QueryRow("SELECT height, hash FROM block ORDER BY height DESC LIMIT 1").Scan(&p.Height, &p.BlockHash)
+	if err != nil {
+		return nil, err
+	}
+	b, err := dataDirLoadBlock(p.Height, p.BlockHash)
+	if err != nil {
+		return nil, err
+	}
+	if b.Version < 3 {
+		return nil, fmt.Errorf("Block %s at %d doesn't commit to the state tree", p.BlockHash, p.Height)
+	}
+	root, err := dbGetStateTreeRoot(dbtx, p.Height)
+	if err != nil {
+		return nil, err
+	}
+	proof, err := dbGetStateProof(dbtx, root, key)
+	if err != nil {
+		return nil, err
+	}
+	p.Header = b.CompactHeader()
+	p.Proof = *proof
+	return &p, nil
+}
+
+// Checks that the header matches the block hash, and that the proof leads to the
+// header's state hash.
+func (p *blockStateProof) verify() error {
+	hash, err := p.Header.Hash()
+	if err != nil {
+		return err
+	}
+	if mustEncodeBase64URL(hash) != p.BlockHash {
+		return fmt.Errorf("Block header doesn't match the block hash %s", p.BlockHash)
+	}
+	if p.Header.Version < 3 {
+		return fmt.Errorf("Block %s doesn't commit to the state tree", p.BlockHash)
+	}
+	root, err := base64.RawURLEncoding.DecodeString(p.Header.StateHash)
+	if err != nil {
+		return fmt.Errorf("Invalid state hash %s: %s", p.Header.StateHash, err.Error())
+	}
+	return p.Proof.verify(root)
+}
+
+// Handles /api/stateproof?key=<state tree key>, e.g. s:<pubkey> for an account state
+func wwwGetStateProof(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if !strings.HasPrefix(key, "s:") && !strings.HasPrefix(key, "k:") && !strings.HasPrefix(key, "d:") && !strings.HasPrefix(key, "h:") && key != getStateTreePublisherCountKey() {
+		wwwWriteJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Invalid state tree key: %s", key)})
+		return
+	}
+	p, err := dbGetBlockStateProof(key)
+	if err != nil {
+		log.Println(err)
+		wwwWriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	wwwWriteJSON(w, http.StatusOK, p)
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// A QR code encoder (ISO/IEC 18004), for the byte mode and the error correction level
+// M, which recovers about 15% of the codewords. The smallest version (1 to 40) which
+// fits the data is used, with the mask which gives the lowest penalty.
+
+// The error correction codewords per block, and the number of blocks and their data
+// codewords in the two groups of blocks, of each version at the level M
+var qrBlocksM = [41][5]int{
+	{},
+	{10, 1, 16, 0, 0}, {16, 1, 28, 0, 0}, {26, 1, 44, 0, 0}, {18, 2, 32, 0, 0}, {24, 2, 43, 0, 0},
+	{16, 4, 27, 0, 0}, {18, 4, 31, 0, 0}, {22, 2, 38, 2, 39}, {22, 3, 36, 2, 37}, {26, 4, 43, 1, 44},
+	{30, 1, 50, 4, 51}, {22, 6, 36, 2, 37}, {22, 8, 37, 1, 38}, {24, 4, 40, 5, 41}, {24, 5, 41, 5, 42},
+	{28, 7, 45, 3, 46}, {28, 10, 46, 1, 47}, {26, 9, 43, 4, 44}, {26, 3, 44, 11, 45}, {26, 3, 41, 13, 42},
+	{26, 17, 42, 0, 0}, {28, 17, 46, 0, 0}, {28, 4, 47, 14, 48}, {28, 6, 45, 14, 46}, {28, 8, 47, 13, 48},
+	{28, 19, 46, 4, 47}, {28, 22, 45, 3, 46}, {28, 3, 45, 23, 46}, {28, 21, 45, 7, 46}, {28, 19, 47, 10, 48},
+	{28, 2, 46, 29, 47}, {28, 10, 46, 23, 47}, {28, 14, 46, 21, 47}, {28, 14, 46, 23, 47}, {28, 12, 47, 26, 48},
+	{28, 6, 47, 34, 48}, {28, 29, 46, 14, 47}, {28, 13, 46, 32, 47}, {28, 40, 47, 7, 48}, {28, 18, 47, 31, 48},
+}
+
+// The format information bits of the level M
+const qrLevelM = 0
+
+// The width of the light border around the code, in modules
+const qrQuietZone = 4
+
+// A QR code, whose modules are true if they are dark
+type qrCode struct {
+	Version  int
+	Size     int
+	Mask     int
+	modules  [][]bool
+	function [][]bool // modules which are not data
+}
+
+// Encodes the data in a QR code
+func encodeQR(data []byte) (*qrCode, error) {
+	version := 1
+	for ; version <= 40; version++ {
+		countBits := 8
+		if version >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+len(data)*8 <= getQRDataCodewords(version)*8 {
+			break
+		}
+	}
+	if version > 40 {
+		return nil, fmt.Errorf("Data too long for a QR code: %d bytes", len(data))
+	}
+	codewords := getQRCodewords(version, data)
+
+	q := qrCode{Version: version, Size: version*4 + 17}
+	q.modules = make([][]bool, q.Size)
+	q.function = make([][]bool, q.Size)
+	for y := range q.modules {
+		q.modules[y] = make([]bool, q.Size)
+		q.function[y] = make([]bool, q.Size)
+	}
+	q.drawFunctionPatterns()
+	q.drawCodewords(codewords)
+
+	minPenalty := -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(mask)
+		if penalty := q.getPenalty(); minPenalty < 0 || penalty < minPenalty {
+			minPenalty = penalty
+			q.Mask = mask
+		}
+		q.applyMask(mask) // undoes it
+	}
+	q.applyMask(q.Mask)
+	q.drawFormatBits(q.Mask)
+	return &q, nil
+}
+
+// Returns the number of data codewords of the version
+func getQRDataCodewords(version int) int {
+	b := qrBlocksM[version]
+	return b[1]*b[2] + b[3]*b[4]
+}
+
+// Returns the data codewords in the byte mode, padded to the capacity of the version,
+// interleaved with their error correction codewords
+func getQRCodewords(version int, data []byte) []byte {
+	var bits []bool
+	appendBits := func(v, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, (v>>uint(i))&1 == 1)
+		}
+	}
+	countBits := 8
+	if version >= 10 {
+		countBits = 16
+	}
+	capacity := getQRDataCodewords(version) * 8
+	appendBits(0x4, 4)
+	appendBits(len(data), countBits)
+	for _, b := range data {
+		appendBits(int(b), 8)
+	}
+	for i := 0; i < 4 && len(bits) < capacity; i++ {
+		bits = append(bits, false)
+	}
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+	for pad := 0xec; len(bits) < capacity; pad ^= 0xec ^ 0x11 {
+		appendBits(pad, 8)
+	}
+	dataCodewords := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			dataCodewords[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+
+	b := qrBlocksM[version]
+	generator := getRSGenerator(b[0])
+	var blocks, ecBlocks [][]byte
+	for i, pos := 0, 0; i < b[1]+b[3]; i++ {
+		n := b[2]
+		if i >= b[1] {
+			n = b[4]
+		}
+		blocks = append(blocks, dataCodewords[pos:pos+n])
+		ecBlocks = append(ecBlocks, getRSRemainder(dataCodewords[pos:pos+n], generator))
+		pos += n
+	}
+	var result []byte
+	for _, bs := range [][][]byte{blocks, ecBlocks} {
+		for i := 0; i < len(bs[len(bs)-1]); i++ {
+			for _, block := range bs {
+				if i < len(block) {
+					result = append(result, block[i])
+				}
+			}
+		}
+	}
+	return result
+}
+
+// Multiplies in GF(2^8) with the QR code polynomial x^8 + x^4 + x^3 + x^2 + 1
+func gfMul(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11d)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+// Returns the coefficients of the Reed-Solomon generator polynomial of the degree,
+// from the highest power down, without the leading 1
+func getRSGenerator(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMul(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMul(root, 0x02)
+	}
+	return result
+}
+
+// Returns the Reed-Solomon error correction codewords of the data
+func getRSRemainder(data, generator []byte) []byte {
+	result := make([]byte, len(generator))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i := range result {
+			result[i] ^= gfMul(generator[i], factor)
+		}
+	}
+	return result
+}
+
+func (q *qrCode) setFunction(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+// Draws the finder, timing and alignment patterns, and the version information, and
+// reserves the modules of the format information
+func (q *qrCode) drawFunctionPatterns() {
+	for i := 0; i < q.Size; i++ {
+		q.setFunction(6, i, i%2 == 0)
+		q.setFunction(i, 6, i%2 == 0)
+	}
+	for _, c := range [][2]int{{3, 3}, {q.Size - 4, 3}, {3, q.Size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x < 0 || x >= q.Size || y < 0 || y >= q.Size {
+					continue
+				}
+				d := getQRDistance(dx, dy)
+				q.setFunction(x, y, d != 2 && d != 4)
+			}
+		}
+	}
+	positions := getQRAlignmentPositions(q.Version)
+	last := len(positions) - 1
+	for i, px := range positions {
+		for j, py := range positions {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue // the finder patterns
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.setFunction(px+dx, py+dy, getQRDistance(dx, dy) != 1)
+				}
+			}
+		}
+	}
+	q.drawFormatBits(0)
+	if q.Version >= 7 {
+		rem := q.Version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1f25)
+		}
+		bits := q.Version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := (bits>>uint(i))&1 == 1
+			a, b := q.Size-11+i%3, i/3
+			q.setFunction(a, b, dark)
+			q.setFunction(b, a, dark)
+		}
+	}
+}
+
+// Returns the distance of a module from the centre of a pattern, in rings
+func getQRDistance(dx, dy int) int {
+	if dx < 0 {
+		dx = -dx
+	}
+	if dy < 0 {
+		dy = -dy
+	}
+	if dx > dy {
+		return dx
+	}
+	return dy
+}
+
+// Returns the centre coordinates of the alignment patterns of the version
+func getQRAlignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	n := version/7 + 2
+	step := 26
+	if version != 32 {
+		step = (version*4 + n*2 + 1) / (n*2 - 2) * 2
+	}
+	result := make([]int, n)
+	result[0] = 6
+	for i, pos := n-1, version*4+10; i > 0; i, pos = i-1, pos-step {
+		result[i] = pos
+	}
+	return result
+}
+
+// Draws the two copies of the format information, with the level and the mask
+func (q *qrCode) drawFormatBits(mask int) {
+	data := qrLevelM<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return (bits>>uint(i))&1 == 1 }
+	for i := 0; i <= 5; i++ {
+		q.setFunction(8, i, bit(i))
+	}
+	q.setFunction(8, 7, bit(6))
+	q.setFunction(8, 8, bit(7))
+	q.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.setFunction(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.setFunction(q.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.setFunction(8, q.Size-15+i, bit(i))
+	}
+	q.setFunction(8, q.Size-8, true)
+}
+
+// Places the codewords in the data modules, in two-module wide columns zigzagging up
+// and down from the bottom right corner
+func (q *qrCode) drawCodewords(codewords []byte) {
+	i := 0
+	for right := q.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // the vertical timing pattern
+		}
+		for vert := 0; vert < q.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.Size - 1 - vert
+				}
+				if !q.function[y][x] && i < len(codewords)*8 {
+					q.modules[y][x] = (codewords[i/8]>>uint(7-i%8))&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+// Flips the data modules selected by the mask
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// Returns the penalty score of the code, by which the mask is chosen
+func (q *qrCode) getPenalty() int {
+	penalty := 0
+	dark := 0
+	finderLike := [][]bool{
+		{true, false, true, true, true, false, true, false, false, false, false},
+		{false, false, false, false, true, false, true, true, true, false, true},
+	}
+	for _, transpose := range []bool{false, true} {
+		at := func(i, j int) bool {
+			if transpose {
+				return q.modules[j][i]
+			}
+			return q.modules[i][j]
+		}
+		for i := 0; i < q.Size; i++ {
+			// Runs of five or more modules of the same colour
+			run := 1
+			for j := 1; j <= q.Size; j++ {
+				if j < q.Size && at(i, j) == at(i, j-1) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					penalty += run - 2
+				}
+				run = 1
+			}
+			// Patterns like those of the finders
+			for j := 0; j+11 <= q.Size; j++ {
+				for _, pattern := range finderLike {
+					match := true
+					for k, d := range pattern {
+						if at(i, j+k) != d {
+							match = false
+							break
+						}
+					}
+					if match {
+						penalty += 40
+					}
+				}
+			}
+		}
+	}
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 && q.modules[y][x] == q.modules[y-1][x] && q.modules[y][x] == q.modules[y][x-1] && q.modules[y][x] == q.modules[y-1][x-1] {
+				penalty += 3
+			}
+		}
+	}
+	// The deviation of the proportion of dark modules from 50%, by 5%
+	total := q.Size * q.Size
+	deviation := dark*20 - total*10
+	if deviation < 0 {
+		deviation = -deviation
+	}
+	penalty += deviation / total * 10
+	return penalty
+}
+
+// Returns the PNG image of the code, with the given number of pixels per module
+func (q *qrCode) PNG(scale int) []byte {
+	size := (q.Size + 2*qrQuietZone) * scale
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{color.White, color.Black})
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			if !q.modules[y][x] {
+				continue
+			}
+			for py := 0; py < scale; py++ {
+				for px := 0; px < scale; px++ {
+					img.SetColorIndex((x+qrQuietZone)*scale+px, (y+qrQuietZone)*scale+py, 1)
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		panic(err) // encoding to a buffer doesn't fail
+	}
+	return buf.Bytes()
+}
+
+// Returns the SVG image of the code, with the given number of pixels per module
+func (q *qrCode) SVG(scale int) []byte {
+	size := q.Size + 2*qrQuietZone
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size*scale, size*scale, size, size)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, size, size)
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			if !q.modules[y][x] {
+				continue
+			}
+			run := 1
+			for x+run < q.Size && q.modules[y][x+run] {
+				run++
+			}
+			fmt.Fprintf(&buf, "M%d %dh%dv1h-%dz", x+qrQuietZone, y+qrQuietZone, run, run)
+			x += run - 1
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestQRReedSolomon(t *testing.T) {
+	// The data codewords of HELLO WORLD in version 1-M, and their error correction codewords
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	ec := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if out := getRSRemainder(data, getRSGenerator(len(ec))); !bytes.Equal(out, ec) {
+		t.Errorf("Expecting %v, got %v", ec, out)
+	}
+}
+
+func TestQRVersion(t *testing.T) {
+	for _, v := range []struct {
+		length  int
+		version int
+	}{
+		{0, 1}, {14, 1}, {15, 2}, {26, 2}, {27, 3}, {180, 9}, {181, 10}, {213, 10}, {214, 11}, {2331, 40},
+	} {
+		q, err := encodeQR(bytes.Repeat([]byte("a"), v.length))
+		if err != nil {
+			t.Errorf("%d bytes: %s", v.length, err)
+			continue
+		}
+		if q.Version != v.version || q.Size != v.version*4+17 {
+			t.Errorf("%d bytes: expecting version %d, got %d of size %d", v.length, v.version, q.Version, q.Size)
+		}
+	}
+	if _, err := encodeQR(bytes.Repeat([]byte("a"), 2332)); err == nil {
+		t.Error("Expecting an error for 2332 bytes")
+	}
+}
+
+func TestQRAlignmentPositions(t *testing.T) {
+	for version, positions := range map[int][]int{
+		1:  nil,
+		2:  {6, 18},
+		7:  {6, 22, 38},
+		22: {6, 26, 50, 74, 98},
+		32: {6, 34, 60, 86, 112, 138},
+		40: {6, 30, 58, 86, 114, 142, 170},
+	} {
+		if out := getQRAlignmentPositions(version); !reflect.DeepEqual(out, positions) {
+			t.Errorf("Version %d: expecting %v, got %v", version, positions, out)
+		}
+	}
+}
+
+func TestQRFormatBits(t *testing.T) {
+	// The format information of the level M, by mask
+	formats := []string{
+		"101010000010010", "101000100100101", "101111001111100", "101101101001011",
+		"100010111111001", "100000011001110", "100111110010111", "100101010100000",
+	}
+	q, err := encodeQR([]byte("wot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for mask, format := range formats {
+		q.drawFormatBits(mask)
+		first, second := "", ""
+		for i := 14; i >= 0; i-- {
+			// The copy around the top left finder, and the one split between the others
+			var x, y int
+			switch {
+			case i <= 5:
+				x, y = 8, i
+			case i <= 7:
+				x, y = 8, i+1
+			case i == 8:
+				x, y = 7, 8
+			default:
+				x, y = 14-i, 8
+			}
+			first += fmt.Sprint(map[bool]int{false: 0, true: 1}[q.modules[y][x]])
+			if i < 8 {
+				x, y = q.Size-1-i, 8
+			} else {
+				x, y = 8, q.Size-15+i
+			}
+			second += fmt.Sprint(map[bool]int{false: 0, true: 1}[q.modules[y][x]])
+		}
+		if first != format || second != format {
+			t.Errorf("Mask %d: expecting %s, got %s and %s", mask, format, first, second)
+		}
+	}
+}
+
+func TestQRVersionBits(t *testing.T) {
+	q, err := encodeQR(bytes.Repeat([]byte("a"), 120))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Version != 7 {
+		t.Fatalf("Expecting version 7, got %d", q.Version)
+	}
+	bits := ""
+	for i := 17; i >= 0; i-- {
+		a, b := q.Size-11+i%3, i/3
+		if q.modules[b][a] != q.modules[a][b] {
+			t.Fatalf("The copies of the version information differ at bit %d", i)
+		}
+		bits += fmt.Sprint(map[bool]int{false: 0, true: 1}[q.modules[b][a]])
+	}
+	if bits != "000111110010010100" {
+		t.Errorf("Expecting 000111110010010100, got %s", bits)
+	}
+}
+
+// The modules of QR codes encoded by another encoder (rsc.io/qr), with the version
+// and the mask chosen by encodeQR
+func TestQRReference(t *testing.T) {
+	for _, v := range []struct {
+		data    string
+		version int
+		mask    int
+		rows    []string
+	}{
+		{"HELLO WORLD", 1, 4, []string{
+			"#######.##..#.#######",
+			"#.....#....#..#.....#",
+			"#.###.#..#.#..#.###.#",
+			"#.###.#.#..#..#.###.#",
+			"#.###.#.###.#.#.###.#",
+			"#.....#.#..#..#.....#",
+			"#######.#.#.#.#######",
+			"........#..##........",
+			"#...#.######.#####..#",
+			"...#....#.###....####",
+			"..######..##.##.#..#.",
+			"#####...##...#.......",
+			"#####.#.#.#.#.##..##.",
+			"........#.#.####.#.##",
+			"#######.###.#.#.##.#.",
+			"#.....#..#.###.##..##",
+			"#.###.#.##.#.##...##.",
+			"#.###.#..#..#...##.##",
+			"#.###.#..###...###...",
+			"#.....#....#.#.......",
+			"#######.#########.#.#",
+		}},
+		{"wot://tJ-JyMNi8PXN-0KydPIi23xSkZiI5Pir2PlcxKaJpog", 4, 2, []string{
+			"#######..#.#..###..###.#..#######",
+			"#.....#........#..#.##..#.#.....#",
+			"#.###.#.#####.##...#.###..#.###.#",
+			"#.###.#.#...#.....##.####.#.###.#",
+			"#.###.#.#..#..####..#..#..#.###.#",
+			"#.....#.#.#..#....##.#....#.....#",
+			"#######.#.#.#.#.#.#.#.#.#.#######",
+			"........####..#.#..######........",
+			"#.#####..###.##.##.#...##.#####..",
+			"...##....#.###..###.#.#......#...",
+			"...##.#.##.#######.........#.#.#.",
+			"#...##.#.##..#...##..#....#..###.",
+			".###..#....#..###...#.####..##..#",
+			".####...###..#.#..#...#..#.#....#",
+			"#...###.#....#.##...##..#.######.",
+			"####.#.#.##...##..#..#..#.##..###",
+			"....#.#.#.#.#####...#####...##.#.",
+			"...###.#.######....#.##...#..##.#",
+			"##..#.#.##.#.###..#.##......#.##.",
+			"#.##.#..###.........##..#...#.#.#",
+			"###.###.#..##.##..##..##.#..##..#",
+			"##..#...#...#####...##.#..#..####",
+			"#.#...#.....##....##.#...##..###.",
+			"#..#.......##...#.####.###.#####.",
+			"#..#..#.###.##..#..#.##.#######..",
+			"........#######..###..###...#..#.",
+			"#######..#..#..###....###.#.#..#.",
+			"#.....#.##...###.########...#.###",
+			"#.###.#.#...#...#..#..#.#####...#",
+			"#.###.#.#...#.##.##......#.##.###",
+			"#.###.#.##.....##.#.##.....#..#..",
+			"#.....#....#...#...###...##.###..",
+			"#######.##...###.#...####...#..#.",
+		}},
+	} {
+		q, err := encodeQR([]byte(v.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q.Version != v.version || q.Mask != v.mask {
+			t.Errorf("%s: expecting version %d with mask %d, got version %d with mask %d", v.data, v.version, v.mask, q.Version, q.Mask)
+			continue
+		}
+		for y, row := range v.rows {
+			for x, c := range row {
+				if q.modules[y][x] != (c == '#') {
+					t.Errorf("%s: module %d,%d differs", v.data, x, y)
+				}
+			}
+		}
+	}
+}
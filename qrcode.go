@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// A published transaction is given a QR code of its verification URI, which names the
+// chain by the hash of its genesis block, and the transaction by its hash, with the
+// block it's in, unless it's pending, and the key which signed it:
+//
+//   wot://<genesis block hash>/tx/<tx hash>?block=<block hash>&key=<public key>
+//
+// Whoever scans it can verify the transaction with any node of the chain, e.g. by
+// giving the URI to the verifydoc command, which also checks that it's still in the
+// same block.
+
+const qrDefaultScale = 8
+const qrMaxScale = 40
+
+// Returns the verification URI of the transaction. The block hash and the key are
+// optional.
+func getVerificationURI(txHash, blockHash, pubKey string) string {
+	q := url.Values{}
+	if blockHash != "" {
+		q.Set("block", blockHash)
+	}
+	if pubKey != "" {
+		q.Set("key", pubKey)
+	}
+	uri := fmt.Sprintf("wot://%s/tx/%s", GenesisBlock.BlockHeader.Hash, txHash)
+	if len(q) > 0 {
+		uri += "?" + q.Encode()
+	}
+	return uri
+}
+
+// Returns the transaction hash, and the block hash and the key if they're given, of a
+// verification URI of this chain
+func parseVerificationURI(uri string) (string, string, string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", "", "", err
+	}
+	if u.Scheme != "wot" {
+		return "", "", "", fmt.Errorf("Not a wot:// URI: %s", uri)
+	}
+	if u.Host != GenesisBlock.BlockHeader.Hash {
+		return "", "", "", fmt.Errorf("The URI is for another chain, with the genesis block %s", u.Host)
+	}
+	txHash := strings.TrimPrefix(u.Path, "/tx/")
+	if txHash == u.Path || txHash == "" || strings.Contains(txHash, "/") {
+		return "", "", "", fmt.Errorf("Expecting a /tx/<tx hash> path in %s", uri)
+	}
+	q := u.Query()
+	return txHash, q.Get("block"), q.Get("key"), nil
+}
+
+// Returns the verification URI of the transaction, which is in the main chain or pending
+func dbGetTxVerificationURI(txHash string) (string, error) {
+	blockHash := ""
+	pubKey := ""
+	err := db.QueryRow(`SELECT block.hash, block_tx.pubkey FROM block_tx JOIN block ON block.height=block_tx.height
+		WHERE block_tx.hash=? ORDER BY block_tx.height DESC LIMIT 1`, txHash).Scan(&blockHash, &pubKey)
+	if err == sql.ErrNoRows {
+		err = db.QueryRow("SELECT sender FROM utx WHERE hash=?", txHash).Scan(&pubKey)
+	}
+	if err != nil {
+		return "", err
+	}
+	return getVerificationURI(txHash, blockHash, pubKey), nil
+}
+
+// Returns the verification URI of the latest version of the publisher's document with the _id
+func dbGetDocumentVerificationURI(publisherID int, docID string) (string, error) {
+	docs, err := dbGetDocuments("document.publisher_id=? AND document.doc_id=? AND document.latest=1", publisherID, docID)
+	if err != nil {
+		return "", err
+	}
+	if len(docs) == 0 {
+		return "", sql.ErrNoRows
+	}
+	return dbGetTxVerificationURI(docs[0].TxHash)
+}
+
+// Returns the QR code image of the data in the format, png or svg
+func getQRImage(data, format string, scale int) ([]byte, string, error) {
+	if format != "png" && format != "svg" {
+		return nil, "", fmt.Errorf("Unknown image format: %s", format)
+	}
+	q, err := encodeQR([]byte(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if format == "svg" {
+		return q.SVG(scale), "image/svg+xml", nil
+	}
+	return q.PNG(scale), "image/png", nil
+}
+
+// Handles /api/qrcode?tx=<tx hash> and /api/qrcode?publisher=<publisher id>&id=<_id> (or
+// key=<any key or the @handle of the publisher> instead of publisher) for the QR code of
+// the verification URI of a transaction, or of the latest version of a document. The
+// format argument is png (by default) or svg, and the scale argument is the number of
+// pixels per module.
+func wwwGetQRCode(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	scale := qrDefaultScale
+	if q.Get("scale") != "" {
+		var err error
+		if scale, err = strconv.Atoi(q.Get("scale")); err != nil || scale < 1 || scale > qrMaxScale {
+			wwwWriteJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Invalid scale: %s", q.Get("scale"))})
+			return
+		}
+	}
+	format := q.Get("format")
+	if format == "" {
+		format = "png"
+	}
+	var uri string
+	var err error
+	if txHash := q.Get("tx"); txHash != "" {
+		uri, err = dbGetTxVerificationURI(txHash)
+		if err == sql.ErrNoRows {
+			wwwWriteJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("Tx %s is neither in the main chain nor pending", txHash)})
+			return
+		}
+	} else if docID, ok := q["id"]; ok {
+		publisherID, ok := getDocumentPublisherID(w, r)
+		if !ok {
+			return
+		}
+		uri, err = dbGetDocumentVerificationURI(publisherID, docID[0])
+		if err == sql.ErrNoRows {
+			wwwWriteJSON(w, http.StatusNotFound, map[string]string{"error": getDocumentNotFound(publisherID, docID[0], 0)})
+			return
+		}
+	} else {
+		wwwWriteJSON(w, http.StatusBadRequest, map[string]string{"error": "Expecting a tx argument, or a publisher or key argument and an id argument"})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		wwwWriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	img, contentType, err := getQRImage(uri, format, scale)
+	if err != nil {
+		wwwWriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	w.Header().Set("Content-type", contentType)
+	w.Header().Set("X-Verification-URI", uri)
+	w.WriteHeader(http.StatusOK)
+	w.Write(img)
+}
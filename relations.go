@@ -0,0 +1,258 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Following a publisher and trusting it are separate relationships: a publisher may
+// follow another to read what it publishes without trusting it, or trust one it doesn't
+// follow. A publisher follows another by publishing a document with the `_follow` key
+// set to the other's publisher id, and stops with `_unfollow`. It sets the level of its
+// trust in another, which is one of trustLevels as in OpenPGP, with `_trust` set to the
+// other's publisher id and `_trustlevel` to the level.
+//
+// Both relationships are kept with their history: every period during which a publisher
+// followed another, or trusted it at a certain level, is a row with the blocks in which
+// it began and ended; the current ones have no end block.
+
+// The trust levels, except "none", which ends the current trust level
+var trustLevels = map[string]bool{"marginal": true, "full": true}
+
+// A period during which a publisher followed another, as returned by /api/follows
+type follow struct {
+	FollowerID   int    `json:"follower_id"`
+	FollowerName string `json:"follower_name"`
+	TargetID     int    `json:"target_id"`
+	TargetName   string `json:"target_name"`
+	SinceBlock   int    `json:"since_block"`
+	ToBlock      int    `json:"to_block,omitempty"`
+	TxHash       string `json:"tx_hash"`
+}
+
+// A period during which a publisher trusted another at a level, as returned by /api/trustlevels
+type trustLevel struct {
+	TrusterID   int    `json:"truster_id"`
+	TrusterName string `json:"truster_name"`
+	TargetID    int    `json:"target_id"`
+	TargetName  string `json:"target_name"`
+	Level       string `json:"level"`
+	SinceBlock  int    `json:"since_block"`
+	ToBlock     int    `json:"to_block,omitempty"`
+	TxHash      string `json:"tx_hash"`
+}
+
+// Returns the publisher id in the value of the reserved key, which must be another existing publisher
+func dbGetRelationTarget(dbtx *sql.Tx, btx *BlockTransaction, publisher *Publisher, key, value string) (int, error) {
+	targetID, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s in %s: %s", key, btx.TxHash, value)
+	}
+	if targetID == publisher.ID {
+		return 0, fmt.Errorf("The %s in %s is the publisher itself", key, btx.TxHash)
+	}
+	count := 0
+	err = dbtx.QueryRow("SELECT COUNT(*) FROM publisher WHERE id=?", targetID).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		return 0, fmt.Errorf("The %s in %s is not a publisher: %d", key, btx.TxHash, targetID)
+	}
+	return targetID, nil
+}
+
+// Records that the publisher follows the target publisher from this block on
+func dbFollow(dbtx *sql.Tx, u *blockUndo, btx *BlockTransaction, publisher *Publisher, target string, height int) error {
+	targetID, err := dbGetRelationTarget(dbtx, btx, publisher, "_follow", target)
+	if err != nil {
+		return err
+	}
+	count := 0
+	err = dbtx.QueryRow("SELECT COUNT(*) FROM follow WHERE follower_id=? AND target_id=? AND to_block IS NULL", publisher.ID, targetID).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("Publisher %d already follows %d, in %s", publisher.ID, targetID, btx.TxHash)
+	}
+	res, err := dbtx.Exec("INSERT INTO follow (follower_id, target_id, since_block, tx_hash) VALUES (?, ?, ?, ?)", publisher.ID, targetID, height, btx.TxHash)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	u.inserted("follow", "id=?", id)
+	return nil
+}
+
+// Records that the publisher stopped following the target publisher in this block
+func dbUnfollow(dbtx *sql.Tx, u *blockUndo, btx *BlockTransaction, publisher *Publisher, target string, height int) error {
+	targetID, err := dbGetRelationTarget(dbtx, btx, publisher, "_unfollow", target)
+	if err != nil {
+		return err
+	}
+	id := 0
+	err = dbtx.QueryRow("SELECT id FROM follow WHERE follower_id=? AND target_id=? AND to_block IS NULL", publisher.ID, targetID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("Publisher %d doesn't follow %d, in %s", publisher.ID, targetID, btx.TxHash)
+	}
+	if err != nil {
+		return err
+	}
+	err = u.save(dbtx, "follow", "id=?", id)
+	if err != nil {
+		return err
+	}
+	_, err = dbtx.Exec("UPDATE follow SET to_block=? WHERE id=?", height, id)
+	return err
+}
+
+// Sets the level of the publisher's trust in the target publisher from this block on,
+// ending its current trust level
+func dbSetTrustLevel(dbtx *sql.Tx, u *blockUndo, btx *BlockTransaction, publisher *Publisher, target, level string, height int) error {
+	targetID, err := dbGetRelationTarget(dbtx, btx, publisher, "_trust", target)
+	if err != nil {
+		return err
+	}
+	if level != "none" && !trustLevels[level] {
+		return fmt.Errorf("Invalid _trustlevel in %s: %s", btx.TxHash, level)
+	}
+	id := 0
+	currentLevel := "none"
+	err = dbtx.QueryRow("SELECT id, level FROM trust_level WHERE truster_id=? AND target_id=? AND to_block IS NULL", publisher.ID, targetID).Scan(&id, &currentLevel)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if level == currentLevel {
+		return fmt.Errorf("The trust of publisher %d in %d is already %s, in %s", publisher.ID, targetID, level, btx.TxHash)
+	}
+	if id != 0 {
+		err = u.save(dbtx, "trust_level", "id=?", id)
+		if err != nil {
+			return err
+		}
+		_, err = dbtx.Exec("UPDATE trust_level SET to_block=? WHERE id=?", height, id)
+		if err != nil {
+			return err
+		}
+	}
+	if level == "none" {
+		return nil
+	}
+	res, err := dbtx.Exec("INSERT INTO trust_level (truster_id, target_id, level, since_block, tx_hash) VALUES (?, ?, ?, ?, ?)", publisher.ID, targetID, level, height, btx.TxHash)
+	if err != nil {
+		return err
+	}
+	lastID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	u.inserted("trust_level", "id=?", lastID)
+	return nil
+}
+
+// Returns the follows matching the where clause on the follow table
+func dbGetFollows(where string, args ...interface{}) ([]follow, error) {
+	rows, err := db.Query(fmt.Sprintf(`SELECT follow.follower_id, follower.name, follow.target_id, target.name, follow.since_block, follow.to_block, follow.tx_hash
+		FROM follow JOIN publisher follower ON follower.id=follow.follower_id JOIN publisher target ON target.id=follow.target_id
+		WHERE %s ORDER BY follow.id`, where), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	follows := []follow{}
+	for rows.Next() {
+		f := follow{}
+		toBlock := sql.NullInt64{}
+		if err = rows.Scan(&f.FollowerID, &f.FollowerName, &f.TargetID, &f.TargetName, &f.SinceBlock, &toBlock, &f.TxHash); err != nil {
+			return nil, err
+		}
+		f.ToBlock = int(toBlock.Int64)
+		follows = append(follows, f)
+	}
+	return follows, rows.Err()
+}
+
+// Returns the trust levels matching the where clause on the trust_level table
+func dbGetTrustLevels(where string, args ...interface{}) ([]trustLevel, error) {
+	rows, err := db.Query(fmt.Sprintf(`SELECT trust_level.truster_id, truster.name, trust_level.target_id, target.name, trust_level.level, trust_level.since_block, trust_level.to_block, trust_level.tx_hash
+		FROM trust_level JOIN publisher truster ON truster.id=trust_level.truster_id JOIN publisher target ON target.id=trust_level.target_id
+		WHERE %s ORDER BY trust_level.id`, where), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	levels := []trustLevel{}
+	for rows.Next() {
+		t := trustLevel{}
+		toBlock := sql.NullInt64{}
+		if err = rows.Scan(&t.TrusterID, &t.TrusterName, &t.TargetID, &t.TargetName, &t.Level, &t.SinceBlock, &toBlock, &t.TxHash); err != nil {
+			return nil, err
+		}
+		t.ToBlock = int(toBlock.Int64)
+		levels = append(levels, t)
+	}
+	return levels, rows.Err()
+}
+
+// Returns the where clause for the relationships to the publisher given by the "publisher"
+// argument, or from the one given by the fromArg argument, and its argument. The ended
+// relationships are included if the "history" argument is set.
+func getRelationWhere(r *http.Request, table, fromArg, fromColumn string) (string, int, error) {
+	q := r.URL.Query()
+	where := ""
+	id, err := strconv.Atoi(q.Get("publisher"))
+	if err == nil {
+		where = table + ".target_id=?"
+	} else if id, err = strconv.Atoi(q.Get(fromArg)); err == nil {
+		where = table + "." + fromColumn + "=?"
+	} else {
+		return "", 0, fmt.Errorf("Expecting a publisher or %s argument", fromArg)
+	}
+	if q.Get("history") == "" {
+		where += " AND " + table + ".to_block IS NULL"
+	}
+	return where, id, nil
+}
+
+// Handles /api/follows?publisher=<publisher id> for the followers of a publisher, and
+// /api/follows?follower=<publisher id> for the publishers it follows. With &history=1,
+// the ended follows are included.
+func wwwGetFollows(w http.ResponseWriter, r *http.Request) {
+	where, id, err := getRelationWhere(r, "follow", "follower", "follower_id")
+	if err != nil {
+		wwwWriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	follows, err := dbGetFollows(where, id)
+	if err != nil {
+		log.Println(err)
+		wwwWriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	wwwWriteJSON(w, http.StatusOK, follows)
+}
+
+// Handles /api/trustlevels?publisher=<publisher id> for the publishers which trust a
+// publisher, and /api/trustlevels?truster=<publisher id> for the publishers it trusts.
+// With &history=1, the ended trust levels are included.
+func wwwGetTrustLevels(w http.ResponseWriter, r *http.Request) {
+	where, id, err := getRelationWhere(r, "trust_level", "truster", "truster_id")
+	if err != nil {
+		wwwWriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	levels, err := dbGetTrustLevels(where, id)
+	if err != nil {
+		log.Println(err)
+		wwwWriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	wwwWriteJSON(w, http.StatusOK, levels)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestFollowsAndTrustLevels(t *testing.T) {
+	miner := getTestKey("miner")
+	alice := getTestKey("alice")
+	bob := getTestKey("bob")
+	c := newFundedTestChain(t, miner, alice, bob)
+	c.introduce(alice, "alice")
+	c.introduce(bob, "bob")
+	c.mine(miner)
+	aliceID, bobID := c.publisherID(alice), c.publisherID(bob)
+	url := c.serve(nil)
+
+	follow1 := c.publish(alice, PublishedData{"_id": "_follow", "_follow": fmt.Sprint(bobID)})
+	trust1 := c.publish(alice, PublishedData{"_id": "_trust", "_trust": fmt.Sprint(bobID), "_trustlevel": "marginal"})
+	c.mine(miner)
+	height1 := c.height()
+	trust2 := c.publish(alice, PublishedData{"_id": "_trust", "_trust": fmt.Sprint(bobID), "_trustlevel": "full"})
+	c.publish(alice, PublishedData{"_id": "_unfollow", "_unfollow": fmt.Sprint(bobID)})
+	c.mine(miner)
+	height2 := c.height()
+
+	// Following and trusting are separate: alice still trusts bob, but no longer follows it
+	follows := []follow{}
+	getTestJSON(t, fmt.Sprintf("%s/api/follows?follower=%d", url, aliceID), http.StatusOK, &follows)
+	if len(follows) != 0 {
+		t.Error("Expecting no current follows, got", follows)
+	}
+	follows = nil
+	getTestJSON(t, fmt.Sprintf("%s/api/follows?publisher=%d&history=1", url, bobID), http.StatusOK, &follows)
+	expectedFollows := []follow{{FollowerID: aliceID, FollowerName: "alice", TargetID: bobID, TargetName: "bob", SinceBlock: height1, ToBlock: height2, TxHash: follow1.TxHash}}
+	if !reflect.DeepEqual(follows, expectedFollows) {
+		t.Errorf("Expecting %+v, got %+v", expectedFollows, follows)
+	}
+	levels := []trustLevel{}
+	getTestJSON(t, fmt.Sprintf("%s/api/trustlevels?truster=%d&history=1", url, aliceID), http.StatusOK, &levels)
+	expectedLevels := []trustLevel{
+		{TrusterID: aliceID, TrusterName: "alice", TargetID: bobID, TargetName: "bob", Level: "marginal", SinceBlock: height1, ToBlock: height2, TxHash: trust1.TxHash},
+		{TrusterID: aliceID, TrusterName: "alice", TargetID: bobID, TargetName: "bob", Level: "full", SinceBlock: height2, TxHash: trust2.TxHash},
+	}
+	if !reflect.DeepEqual(levels, expectedLevels) {
+		t.Errorf("Expecting %+v, got %+v", expectedLevels, levels)
+	}
+	levels = nil
+	getTestJSON(t, fmt.Sprintf("%s/api/trustlevels?publisher=%d", url, bobID), http.StatusOK, &levels)
+	if !reflect.DeepEqual(levels, expectedLevels[1:]) {
+		t.Errorf("Expecting only the current trust level, got %+v", levels)
+	}
+	getTestJSON(t, url+"/api/follows", http.StatusBadRequest, &map[string]string{})
+
+	for _, doc := range []PublishedData{
+		{"_id": "_follow", "_follow": fmt.Sprint(aliceID)},
+		{"_id": "_follow", "_follow": "999"},
+		{"_id": "_follow", "_follow": "bob"},
+		{"_id": "_unfollow", "_unfollow": fmt.Sprint(bobID)},
+		{"_id": "_trust", "_trust": fmt.Sprint(bobID), "_trustlevel": "full"},
+		{"_id": "_trust", "_trust": fmt.Sprint(bobID), "_trustlevel": "ultimate"},
+		{"_id": "_trust", "_trustlevel": "full"},
+	} {
+		_, err := acceptTx(c.signTx(alice, Tx{Data: doc}))
+		if re, ok := err.(*txRejectError); !ok || re.Reason != txRejectPayload {
+			t.Errorf("Expecting %v to be rejected, got %v", doc, err)
+		}
+	}
+
+	// Trust level "none" ends the current one
+	c.publish(alice, PublishedData{"_id": "_trust", "_trust": fmt.Sprint(bobID), "_trustlevel": "none"})
+	c.mine(miner)
+	levels = nil
+	getTestJSON(t, fmt.Sprintf("%s/api/trustlevels?truster=%d", url, aliceID), http.StatusOK, &levels)
+	if len(levels) != 0 {
+		t.Error("Expecting no current trust levels, got", levels)
+	}
+}
@@ -25,6 +25,9 @@ func (s *RawAccountState) IncNonce() {
 
 type AccountStates map[string]*RawAccountState
 
+// Returns the state hash of blocks older than version 3, which hashes the account states
+// the block has changed. The hashed string isn't valid (or canonical) JSON, but the old
+// blocks commit to it as it is.
 func (states AccountStates) getHash() []byte {
 	keys := []string{}
 	for k := range states {
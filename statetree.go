@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The state tree is a sparse Merkle tree which authenticates the state of the
+// blockchain: account states, publisher keys and documents. Each of them is a leaf
+// whose key is a string naming the row it mirrors:
+//
+//   s:<pubkey>        the account state of the public key
+//   k:<pubkey>        the publisher the public key belongs to
+//   d:<publisher id>  the publisher's latest document, other than control transactions
+//   h:<handle>        the publisher the handle is registered to
+//   n:publishers      the number of publishers, which are numbered from 1 in the order
+//                     of their introduction, so their ids are given by the chain
+//
+// and whose value is the JSON encoding of the row (the canonical encoding since block
+// version 4). The position of a leaf is given by
+// the bits of the SHA-256 hash of its key, so the tree has 256 levels, most of which
+// are empty subtrees with known hashes. Since block version 3, the root of the tree
+// after the block's transactions are applied is the block's StateHash.
+//
+// A proof for a key consists of the sibling hashes on the path from the root to the
+// key's leaf, from which the root can be computed given the value (or the absence) of
+// the key. Empty siblings are omitted from the proof, and marked in a bitmap.
+//
+// Tree nodes are stored by their hash and never modified, so the tree after a block
+// is available from its root, which is kept in the block table. A subtree with a
+// single leaf is stored as one node with the leaf, rather than as the path of nodes
+// down to it, so a leaf takes about as many nodes as the depth at which it's the only
+// leaf, not 256. Every stateTreePruneInterval blocks, the nodes which are no longer in
+// the trees after the last stateTreeKeptRoots blocks are deleted, so the chain can't be
+// reorganised deeper than that.
+
+const stateTreeDepth = 256
+
+const stateTreeKeptRoots = 1000
+const stateTreePruneInterval = 100
+
+const stateTreeLeafPrefix = 0
+const stateTreeNodePrefix = 1
+
+// The hashes of empty subtrees, by the depth of their root
+var stateTreeEmptyHashes = getStateTreeEmptyHashes()
+
+func getStateTreeEmptyHashes() [][]byte {
+	hashes := make([][]byte, stateTreeDepth+1)
+	hashes[stateTreeDepth] = make([]byte, sha256.Size)
+	for d := stateTreeDepth - 1; d >= 0; d-- {
+		hashes[d] = stateTreeNodeHash(hashes[d+1], hashes[d+1])
+	}
+	return hashes
+}
+
+func stateTreeNodeHash(left, right []byte) []byte {
+	data := append([]byte{stateTreeNodePrefix}, left...)
+	h := sha256.Sum256(append(data, right...))
+	return h[:]
+}
+
+func stateTreeLeafHash(key, value string) []byte {
+	keyHash := sha256.Sum256([]byte(key))
+	valueHash := sha256.Sum256([]byte(value))
+	data := append([]byte{stateTreeLeafPrefix}, keyHash[:]...)
+	h := sha256.Sum256(append(data, valueHash[:]...))
+	return h[:]
+}
+
+// Returns the bit of the key hash at the given depth; 0 is the left branch
+func stateTreeBit(keyHash []byte, depth int) int {
+	return int(keyHash[depth/8]>>(7-uint(depth%8))) & 1
+}
+
+// The value of a publisher key leaf
+type stateTreePubKey struct {
+	PublisherID  int `json:"p"`
+	SinceBlock   int `json:"s"`
+	ToBlock      int `json:"t"`
+	RevokedBlock int `json:"r,omitempty"`
+}
+
+// Returns true if the key belonged to the publisher at the given block height
+func (k *stateTreePubKey) belongsAt(publisherID, height int) bool {
+	return k.PublisherID == publisherID && k.SinceBlock <= height && (k.ToBlock == 0 || height < k.ToBlock)
+}
+
+// Returns true if the key was revoked at the given block height
+func (k *stateTreePubKey) revokedAt(height int) bool {
+	return k.RevokedBlock != 0 && height >= k.RevokedBlock
+}
+
+// The value of a document leaf, the latest version of a publisher's document with an _id
+type stateTreeDocument struct {
+	ID      string `json:"i"`
+	Version int    `json:"v"`
+	Block   int    `json:"b"`
+	TxHash  string `json:"h"`
+}
+
+// The value of a handle leaf
+type stateTreeHandle struct {
+	PublisherID  int `json:"p"`
+	ExpiresBlock int `json:"e"`
+}
+
+// The value of the leaf of the number of publishers
+type stateTreePublisherCount struct {
+	Count int `json:"n"`
+}
+
+// Returns the state tree key of an account state
+func getStateTreeStateKey(pubKey string) string {
+	return "s:" + pubKey
+}
+
+// Returns the state tree key of a publisher key
+func getStateTreePubKeyKey(pubKey string) string {
+	return "k:" + pubKey
+}
+
+// Returns the state tree key of a publisher's document with the _id
+func getStateTreeDocumentKey(publisherID int, docID string) string {
+	return fmt.Sprintf("d:%d:%s", publisherID, docID)
+}
+
+// Returns the state tree key of a handle
+func getStateTreeHandleKey(name string) string {
+	return "h:" + name
+}
+
+// Returns the state tree key of the number of publishers
+func getStateTreePublisherCountKey() string {
+	return "n:publishers"
+}
+
+// Returns the value of the state tree key from the database, or "" if there is none,
+// in the canonical JSON encoding, or as encoding/json encodes it for leaves last
+// changed by blocks older than version 4
+func dbGetStateTreeValue(dbtx *sql.Tx, key string, canonical bool) (string, error) {
+	var value interface{}
+	var err error
+	switch {
+	case strings.HasPrefix(key, "s:"):
+		s := RawAccountState{}
+		err = dbtx.QueryRow("SELECT balance, nonce, data FROM state WHERE pubkey=?", key[2:]).Scan(&s.Balance, &s.Nonce, &s.Data)
+		value = s
+	case strings.HasPrefix(key, "k:"):
+		k := stateTreePubKey{}
+		toBlock := sql.NullInt64{}
+		revokedBlock := sql.NullInt64{}
+		err = dbtx.QueryRow("SELECT publisher_id, since_block, to_block, revoked_block FROM publisher_pubkey WHERE pubkey=? ORDER BY since_block DESC LIMIT 1", key[2:]).Scan(&k.PublisherID, &k.SinceBlock, &toBlock, &revokedBlock)
+		k.ToBlock = int(toBlock.Int64)
+		k.RevokedBlock = int(revokedBlock.Int64)
+		value = k
+	case strings.HasPrefix(key, "d:"):
+		d := stateTreeDocument{}
+		parts := strings.SplitN(key[2:], ":", 2)
+		var publisherID int
+		if len(parts) != 2 {
+			return "", fmt.Errorf("Invalid state tree key %s", key)
+		}
+		if publisherID, err = strconv.Atoi(parts[0]); err != nil {
+			return "", fmt.Errorf("Invalid state tree key %s", key)
+		}
+		err = dbtx.QueryRow("SELECT doc_id, version, block, tx_hash FROM document WHERE publisher_id=? AND doc_id=? AND latest=1", publisherID, parts[1]).Scan(&d.ID, &d.Version, &d.Block, &d.TxHash)
+		value = d
+	case key == getStateTreePublisherCountKey():
+		n := stateTreePublisherCount{}
+		err = dbtx.QueryRow("SELECT COUNT(*) FROM publisher").Scan(&n.Count)
+		value = n
+	case strings.HasPrefix(key, "h:"):
+		h := stateTreeHandle{}
+		err = dbtx.QueryRow("SELECT publisher_id, expires_block FROM handle WHERE name=?", key[2:]).Scan(&h.PublisherID, &h.ExpiresBlock)
+		value = h
+	default:
+		return "", fmt.Errorf("Invalid state tree key %s", key)
+	}
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if canonical {
+		data, err := canonicalJSON(value)
+		return string(data), err
+	}
+	return jsonifyWhatever(value), nil
+}
+
+// Returns the root of the state tree after the block at the given height
+func dbGetStateTreeRoot(q dbQueryer, height int) ([]byte, error) {
+	root := ""
+	err := q.QueryRow("SELECT state_root FROM block WHERE height=?", height).Scan(&root)
+	if err != nil {
+		return nil, err
+	}
+	return base64.RawURLEncoding.DecodeString(root)
+}
+
+// A subtree with a single leaf, which is stored as one node
+type stateTreeSingleLeaf struct {
+	keyHash []byte
+	leaf    []byte
+}
+
+// Returns the hash of the subtree whose root is at the given depth
+func (l *stateTreeSingleLeaf) hashAt(depth int) []byte {
+	node := l.leaf
+	for d := stateTreeDepth - 1; d >= depth; d-- {
+		if stateTreeBit(l.keyHash, d) == 0 {
+			node = stateTreeNodeHash(node, stateTreeEmptyHashes[d+1])
+		} else {
+			node = stateTreeNodeHash(stateTreeEmptyHashes[d+1], node)
+		}
+	}
+	return node
+}
+
+// Stores the subtree as a node whose root is at the given depth
+func (l *stateTreeSingleLeaf) dbSave(dbtx *sql.Tx, depth int) error {
+	_, err := dbtx.Exec("INSERT OR IGNORE INTO state_tree_node (hash, left, right, single) VALUES (?, ?, ?, 1)", l.hashAt(depth), l.keyHash, l.leaf)
+	return err
+}
+
+// Returns the children of the node with the given hash at the given depth, or the
+// node's only leaf if it's a subtree with a single leaf
+func dbGetStateTreeNode(dbtx *sql.Tx, hash []byte, depth int) ([]byte, []byte, *stateTreeSingleLeaf, error) {
+	if bytes.Equal(hash, stateTreeEmptyHashes[depth]) {
+		return stateTreeEmptyHashes[depth+1], stateTreeEmptyHashes[depth+1], nil, nil
+	}
+	var left, right []byte
+	single := false
+	err := dbtx.QueryRow("SELECT left, right, single FROM state_tree_node WHERE hash=?", hash).Scan(&left, &right, &single)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Cannot get state tree node %s: %s", mustEncodeBase64URL(hash), err.Error())
+	}
+	if single {
+		return nil, nil, &stateTreeSingleLeaf{keyHash: left, leaf: right}, nil
+	}
+	return left, right, nil, nil
+}
+
+// The path from the root of the tree to the leaf of a key
+type stateTreePath struct {
+	siblings [][]byte // the sibling hashes, from the root down
+	leaf     []byte
+	// If the path leaves a subtree with a single leaf, the rest of that subtree is a
+	// sibling which isn't stored as a node of its own
+	split      *stateTreeSingleLeaf
+	splitDepth int
+}
+
+// Returns the path from the root to the key's leaf
+func dbGetStateTreePath(dbtx *sql.Tx, root []byte, key string) (*stateTreePath, error) {
+	keyHash := sha256.Sum256([]byte(key))
+	p := stateTreePath{siblings: make([][]byte, stateTreeDepth)}
+	node := root
+	for d := 0; d < stateTreeDepth; d++ {
+		left, right, single, err := dbGetStateTreeNode(dbtx, node, d)
+		if err != nil {
+			return nil, err
+		}
+		if single != nil {
+			p.followSingleLeaf(single, keyHash[:], d)
+			return &p, nil
+		}
+		if stateTreeBit(keyHash[:], d) == 0 {
+			p.siblings[d], node = right, left
+		} else {
+			p.siblings[d], node = left, right
+		}
+	}
+	p.leaf = node
+	return &p, nil
+}
+
+// Completes the path through a subtree with a single leaf, whose root is at the given depth
+func (p *stateTreePath) followSingleLeaf(l *stateTreeSingleLeaf, keyHash []byte, depth int) {
+	for d := depth; d < stateTreeDepth; d++ {
+		if stateTreeBit(keyHash, d) != stateTreeBit(l.keyHash, d) {
+			// The key's side is empty from here on
+			p.siblings[d] = l.hashAt(d + 1)
+			p.split, p.splitDepth = l, d+1
+			for d++; d < stateTreeDepth; d++ {
+				p.siblings[d] = stateTreeEmptyHashes[d+1]
+			}
+			p.leaf = stateTreeEmptyHashes[stateTreeDepth]
+			return
+		}
+		p.siblings[d] = stateTreeEmptyHashes[d+1]
+	}
+	p.leaf = l.leaf
+}
+
+// Returns the subtree with a single leaf which the sibling at the given depth is, or nil
+// if it has more leaves
+func (p *stateTreePath) dbGetSingleLeafSibling(dbtx *sql.Tx, depth int) (*stateTreeSingleLeaf, error) {
+	if p.split != nil && p.splitDepth == depth+1 {
+		return p.split, nil
+	}
+	_, _, single, err := dbGetStateTreeNode(dbtx, p.siblings[depth], depth+1)
+	return single, err
+}
+
+// Updates the leaves of the given keys with their values from the database, starting
+// with the tree with the given root, and returns the new root. The values are in the
+// canonical JSON encoding if canonical is true.
+func dbUpdateStateTree(dbtx *sql.Tx, root []byte, keys []string, canonical bool) ([]byte, error) {
+	done := map[string]bool{}
+	for _, key := range keys {
+		if done[key] {
+			continue
+		}
+		done[key] = true
+		value, err := dbGetStateTreeValue(dbtx, key, canonical)
+		if err != nil {
+			return nil, err
+		}
+		p, err := dbGetStateTreePath(dbtx, root, key)
+		if err != nil {
+			return nil, err
+		}
+		keyHash := sha256.Sum256([]byte(key))
+		node := stateTreeEmptyHashes[stateTreeDepth]
+		// The subtree of the node if it has a single leaf, which is only stored at the
+		// top, where it meets another subtree or is the whole tree
+		var single *stateTreeSingleLeaf
+		if value != "" {
+			node = stateTreeLeafHash(key, value)
+			single = &stateTreeSingleLeaf{keyHash: keyHash[:], leaf: node}
+		}
+		for d := stateTreeDepth - 1; d >= 0; d-- {
+			sibling := p.siblings[d]
+			nodeEmpty := bytes.Equal(node, stateTreeEmptyHashes[d+1])
+			siblingEmpty := bytes.Equal(sibling, stateTreeEmptyHashes[d+1])
+			if nodeEmpty && siblingEmpty {
+				node = stateTreeEmptyHashes[d]
+				continue
+			}
+			if nodeEmpty {
+				// The sibling's subtree is all that's left
+				if single, err = p.dbGetSingleLeafSibling(dbtx, d); err != nil {
+					return nil, err
+				}
+			} else if !siblingEmpty {
+				if single != nil {
+					if err = single.dbSave(dbtx, d+1); err != nil {
+						return nil, err
+					}
+					single = nil
+				}
+				if p.split != nil && p.splitDepth == d+1 {
+					if err = p.split.dbSave(dbtx, d+1); err != nil {
+						return nil, err
+					}
+				}
+			}
+			left, right := node, sibling
+			if stateTreeBit(keyHash[:], d) == 1 {
+				left, right = right, left
+			}
+			node = stateTreeNodeHash(left, right)
+			if single != nil {
+				continue
+			}
+			_, err = dbtx.Exec("INSERT OR IGNORE INTO state_tree_node (hash, left, right) VALUES (?, ?, ?)", node, left, right)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if single != nil {
+			if err = single.dbSave(dbtx, 0); err != nil {
+				return nil, err
+			}
+		}
+		root = node
+	}
+	return root, nil
+}
+
+// Deletes the nodes which aren't in the trees after the last stateTreeKeptRoots blocks
+// up to the given height
+func dbPruneStateTree(dbtx *sql.Tx, height int) error {
+	rows, err := dbtx.Query("SELECT state_root FROM block WHERE height>? AND height<=? AND state_root IS NOT NULL", height-stateTreeKeptRoots, height)
+	if err != nil {
+		return err
+	}
+	roots := [][]byte{}
+	for rows.Next() {
+		root := ""
+		if err = rows.Scan(&root); err != nil {
+			rows.Close()
+			return err
+		}
+		if r, err := base64.RawURLEncoding.DecodeString(root); err == nil {
+			roots = append(roots, r)
+		}
+	}
+	rows.Close()
+
+	// The trees share most of their nodes, which are only walked once
+	live := map[string]bool{}
+	type stackEntry struct {
+		hash  []byte
+		depth int
+	}
+	stack := []stackEntry{}
+	for _, root := range roots {
+		stack = append(stack, stackEntry{root, 0})
+	}
+	for len(stack) > 0 {
+		e := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if e.depth == stateTreeDepth || bytes.Equal(e.hash, stateTreeEmptyHashes[e.depth]) || live[string(e.hash)] {
+			continue
+		}
+		live[string(e.hash)] = true
+		left, right, single, err := dbGetStateTreeNode(dbtx, e.hash, e.depth)
+		if err != nil {
+			return err
+		}
+		if single == nil {
+			stack = append(stack, stackEntry{left, e.depth + 1}, stackEntry{right, e.depth + 1})
+		}
+	}
+
+	dead := [][]byte{}
+	rows, err = dbtx.Query("SELECT hash FROM state_tree_node")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var hash []byte
+		if err = rows.Scan(&hash); err != nil {
+			rows.Close()
+			return err
+		}
+		if !live[string(hash)] {
+			dead = append(dead, hash)
+		}
+	}
+	rows.Close()
+	for _, hash := range dead {
+		if _, err = dbtx.Exec("DELETE FROM state_tree_node WHERE hash=?", hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A proof of the value of a key in the state tree, or of its absence if Value is ""
+type stateProof struct {
+	Key      string   `json:"key"`
+	Value    string   `json:"value"`
+	Siblings []string `json:"siblings"` // the non-empty sibling hashes, from the root down
+	Bitmap   string   `json:"bitmap"`   // bit d is set if the sibling at depth d is non-empty
+}
+
+// Returns the proof of the key's value in the tree with the given root
+func dbGetStateProof(dbtx *sql.Tx, root []byte, key string) (*stateProof, error) {
+	path, err := dbGetStateTreePath(dbtx, root, key)
+	if err != nil {
+		return nil, err
+	}
+	leaf := path.leaf
+	p := stateProof{Key: key, Siblings: []string{}}
+	if !bytes.Equal(leaf, stateTreeEmptyHashes[stateTreeDepth]) {
+		// The leaf's encoding depends on the version of the block which changed it last
+		if p.Value, err = dbGetStateTreeValue(dbtx, key, true); err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(leaf, stateTreeLeafHash(key, p.Value)) {
+			if p.Value, err = dbGetStateTreeValue(dbtx, key, false); err != nil {
+				return nil, err
+			}
+		}
+		if !bytes.Equal(leaf, stateTreeLeafHash(key, p.Value)) {
+			return nil, fmt.Errorf("The state tree doesn't match the database for %s", key)
+		}
+	}
+	bitmap := make([]byte, stateTreeDepth/8)
+	for d, sibling := range path.siblings {
+		if !bytes.Equal(sibling, stateTreeEmptyHashes[d+1]) {
+			bitmap[d/8] |= 1 << (7 - uint(d%8))
+			p.Siblings = append(p.Siblings, mustEncodeBase64URL(sibling))
+		}
+	}
+	p.Bitmap = mustEncodeBase64URL(bitmap)
+	return &p, nil
+}
+
+// Checks that the proof leads to the given state tree root
+func (p *stateProof) verify(root []byte) error {
+	bitmap, err := base64.RawURLEncoding.DecodeString(p.Bitmap)
+	if err != nil || len(bitmap) != stateTreeDepth/8 {
+		return fmt.Errorf("Invalid state proof bitmap")
+	}
+	siblings := make([][]byte, stateTreeDepth)
+	n := 0
+	for d := 0; d < stateTreeDepth; d++ {
+		if stateTreeBit(bitmap, d) == 0 {
+			siblings[d] = stateTreeEmptyHashes[d+1]
+			continue
+		}
+		if n >= len(p.Siblings) {
+			return fmt.Errorf("Too few siblings in the state proof")
+		}
+		if siblings[d], err = base64.RawURLEncoding.DecodeString(p.Siblings[n]); err != nil {
+			return fmt.Errorf("Invalid state proof hash %s", p.Siblings[n])
+		}
+		n++
+	}
+	if n != len(p.Siblings) {
+		return fmt.Errorf("Too many siblings in the state proof")
+	}
+	node := stateTreeEmptyHashes[stateTreeDepth]
+	if p.Value != "" {
+		node = stateTreeLeafHash(p.Key, p.Value)
+	}
+	keyHash := sha256.Sum256([]byte(p.Key))
+	for d := stateTreeDepth - 1; d >= 0; d-- {
+		if stateTreeBit(keyHash[:], d) == 0 {
+			node = stateTreeNodeHash(node, siblings[d])
+		} else {
+			node = stateTreeNodeHash(siblings[d], node)
+		}
+	}
+	if !bytes.Equal(node, root) {
+		return fmt.Errorf("State proof for %s doesn't lead to the state root %s", p.Key, mustEncodeBase64URL(root))
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// Returns a transaction on an in-memory database with the account state and state
+// tree tables
+func getStateTreeTestTx(t *testing.T) *sql.Tx {
+	testDB, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { testDB.Close() })
+	dbtx, err := testDB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbtx.Rollback() })
+	for _, table := range []string{"state", "state_tree_node"} {
+		if _, err = dbtx.Exec(dbTables[table]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dbtx
+}
+
+func setStateTreeTestBalance(t *testing.T, dbtx *sql.Tx, pubKey string, balance uint64) {
+	if _, err := dbtx.Exec("INSERT OR REPLACE INTO state (pubkey, balance, nonce) VALUES (?, ?, 1)", pubKey, balance); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStateTreeEmptyHashes(t *testing.T) {
+	if !bytes.Equal(stateTreeEmptyHashes[stateTreeDepth], make([]byte, sha256.Size)) {
+		t.Error("An empty leaf isn't 32 zero bytes")
+	}
+	for d := 0; d < stateTreeDepth; d++ {
+		h := sha256.Sum256(append(append([]byte{stateTreeNodePrefix}, stateTreeEmptyHashes[d+1]...), stateTreeEmptyHashes[d+1]...))
+		if !bytes.Equal(stateTreeEmptyHashes[d], h[:]) {
+			t.Fatalf("Wrong empty subtree hash at depth %d", d)
+		}
+	}
+}
+
+func TestStateTreeSingleLeaf(t *testing.T) {
+	dbtx := getStateTreeTestTx(t)
+	setStateTreeTestBalance(t, dbtx, "a", 5)
+	key := getStateTreeStateKey("a")
+	root, err := dbUpdateStateTree(dbtx, stateTreeEmptyHashes[0], []string{key}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The leaf with empty siblings all the way up
+	value := `{"b":5,"d":"","n":1}`
+	keyHash := sha256.Sum256([]byte(key))
+	valueHash := sha256.Sum256([]byte(value))
+	leaf := sha256.Sum256(append(append([]byte{stateTreeLeafPrefix}, keyHash[:]...), valueHash[:]...))
+	node := leaf[:]
+	for d := stateTreeDepth - 1; d >= 0; d-- {
+		if stateTreeBit(keyHash[:], d) == 0 {
+			node = stateTreeNodeHash(node, stateTreeEmptyHashes[d+1])
+		} else {
+			node = stateTreeNodeHash(stateTreeEmptyHashes[d+1], node)
+		}
+	}
+	if !bytes.Equal(root, node) {
+		t.Errorf("Expecting root %s, got %s", mustEncodeBase64URL(node), mustEncodeBase64URL(root))
+	}
+}
+
+func TestStateTreeProofs(t *testing.T) {
+	dbtx := getStateTreeTestTx(t)
+	keys := []string{}
+	for i, pubKey := range []string{"a", "b", "c", "d", "e"} {
+		setStateTreeTestBalance(t, dbtx, pubKey, uint64(i+1))
+		keys = append(keys, getStateTreeStateKey(pubKey))
+	}
+	root, err := dbUpdateStateTree(dbtx, stateTreeEmptyHashes[0], keys, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The root doesn't depend on the order in which the leaves are added
+	other := stateTreeEmptyHashes[0]
+	for i := len(keys) - 1; i >= 0; i-- {
+		if other, err = dbUpdateStateTree(dbtx, other, []string{keys[i]}, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(root, other) {
+		t.Error("The root depends on the order of the updates")
+	}
+
+	for _, key := range append(keys, getStateTreeStateKey("absent")) {
+		p, err := dbGetStateProof(dbtx, root, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (p.Value == "") != (key == getStateTreeStateKey("absent")) {
+			t.Errorf("Unexpected value of %s: %q", key, p.Value)
+		}
+		if err = p.verify(root); err != nil {
+			t.Errorf("Proof of %s: %s", key, err)
+		}
+		// A proof of another value, or of the absence of the value, doesn't verify
+		forged := *p
+		if forged.Value == "" {
+			forged.Value = `{"b":1,"d":"","n":1}`
+		} else {
+			forged.Value = ""
+		}
+		if forged.verify(root) == nil {
+			t.Errorf("Forged proof of %s verifies", key)
+		}
+	}
+
+	// Removing a leaf gives the root of the tree without it
+	if _, err = dbtx.Exec("DELETE FROM state WHERE pubkey='e'"); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := dbUpdateStateTree(dbtx, root, keys[4:], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	without, err := dbUpdateStateTree(dbtx, stateTreeEmptyHashes[0], keys[:4], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(removed, without) {
+		t.Error("Removing a leaf doesn't give the root of the tree without it")
+	}
+}
+
+// Returns the number of stored state tree nodes
+func countStateTreeNodes(t *testing.T, dbtx *sql.Tx) int {
+	count := 0
+	if err := dbtx.QueryRow("SELECT COUNT(*) FROM state_tree_node").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestStateTreeUpdates(t *testing.T) {
+	dbtx := getStateTreeTestTx(t)
+	rnd := rand.New(rand.NewSource(1))
+	balances := map[string]uint64{}
+	root := stateTreeEmptyHashes[0]
+	for i := 0; i < 300; i++ {
+		// Add, change or remove a few of 40 keys
+		keys := []string{}
+		for j := 0; j < 1+rnd.Intn(4); j++ {
+			pubKey := strconv.Itoa(rnd.Intn(40))
+			if rnd.Intn(3) == 0 {
+				delete(balances, pubKey)
+				if _, err := dbtx.Exec("DELETE FROM state WHERE pubkey=?", pubKey); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				balances[pubKey] = uint64(rnd.Intn(1000))
+				setStateTreeTestBalance(t, dbtx, pubKey, balances[pubKey])
+			}
+			keys = append(keys, getStateTreeStateKey(pubKey))
+		}
+		var err error
+		if root, err = dbUpdateStateTree(dbtx, root, keys, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The same tree built from scratch
+	all := []string{}
+	for pubKey := range balances {
+		all = append(all, getStateTreeStateKey(pubKey))
+	}
+	other, err := dbUpdateStateTree(dbtx, stateTreeEmptyHashes[0], all, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(root, other) {
+		t.Fatal("The updated tree differs from the tree built from its leaves")
+	}
+	for i := 0; i < 40; i++ {
+		key := getStateTreeStateKey(strconv.Itoa(i))
+		p, err := dbGetStateProof(dbtx, root, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := balances[strconv.Itoa(i)]; ok == (p.Value == "") {
+			t.Errorf("Unexpected value of %s: %q", key, p.Value)
+		}
+		if err = p.verify(root); err != nil {
+			t.Errorf("Proof of %s: %s", key, err)
+		}
+	}
+}
+
+func TestStateTreeStorage(t *testing.T) {
+	dbtx := getStateTreeTestTx(t)
+	keys := []string{}
+	for i := 0; i < 100; i++ {
+		setStateTreeTestBalance(t, dbtx, strconv.Itoa(i), 1)
+		keys = append(keys, getStateTreeStateKey(strconv.Itoa(i)))
+	}
+	root, err := dbUpdateStateTree(dbtx, stateTreeEmptyHashes[0], keys, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A leaf is only as deep as it needs to be to be apart from the others, so changing
+	// it stores about log2(100) nodes
+	n := countStateTreeNodes(t, dbtx)
+	setStateTreeTestBalance(t, dbtx, "0", 2)
+	if _, err = dbUpdateStateTree(dbtx, root, keys[:1], true); err != nil {
+		t.Fatal(err)
+	}
+	if added := countStateTreeNodes(t, dbtx) - n; added > 20 {
+		t.Errorf("%d nodes stored for a changed leaf", added)
+	}
+}
+
+func TestStateTreePruning(t *testing.T) {
+	c := newTestChain(t)
+	miner := getTestKey("miner")
+	for i := 0; i < 3; i++ {
+		c.mine(miner)
+	}
+	dbtx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbtx.Rollback()
+	kept := countStateTreeNodes(t, dbtx)
+	// A tree which isn't after any block, like those of block templates
+	setStateTreeTestBalance(t, dbtx, "unmined", 1)
+	root, err := dbGetStateTreeRoot(dbtx, c.height())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dbUpdateStateTree(dbtx, root, []string{getStateTreeStateKey("unmined")}, true); err != nil {
+		t.Fatal(err)
+	}
+	if countStateTreeNodes(t, dbtx) == kept {
+		t.Fatal("No nodes added")
+	}
+	if err = dbPruneStateTree(dbtx, c.height()); err != nil {
+		t.Fatal(err)
+	}
+	if n := countStateTreeNodes(t, dbtx); n != kept {
+		t.Errorf("Expecting %d nodes after pruning, got %d", kept, n)
+	}
+	for height := 0; height <= c.height(); height++ {
+		root, err := dbGetStateTreeRoot(dbtx, height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = dbGetStateTreePath(dbtx, root, getStateTreeStateKey(miner.Public)); err != nil {
+			t.Error("Tree after block", height, err)
+		}
+	}
+}
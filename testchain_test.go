@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// A node with its own data directory, whose blocks are mined at the genesis difficulty
+type testChain struct {
+	t *testing.T
+}
+
+// Bootstraps a new data directory with only the genesis block, and opens its database
+func newTestChain(t *testing.T) *testChain {
+	t.Helper()
+	*dataDir = t.TempDir()
+	*miningEmptyBlocks = true
+	initDataDir()
+	initDatabase()
+	setTrustGraph(nil)
+	chainDB := db
+	t.Cleanup(func() { chainDB.Close() })
+	return &testChain{t: t}
+}
+
+// Returns an unencrypted key derived from the name, so tests can refer to the same key
+// on different chains
+func getTestKey(name string) *WalletKey {
+	seed := sha256.Sum256([]byte(name))
+	wk := WalletKey{Name: name, Flags: []string{}}
+	wk.priv = ed25519.NewKeyFromSeed(seed[:])
+	wk.pub = wk.priv.Public().(ed25519.PublicKey)
+	wk.Public = string(PublicKeyPrefix) + base64.RawURLEncoding.EncodeToString(wk.pub)
+	return &wk
+}
+
+// Returns the key's next nonce, counting its pending transactions
+func (c *testChain) nextNonce(key *WalletKey) uint64 {
+	c.t.Helper()
+	dbtx, err := db.Begin()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer dbtx.Rollback()
+	nonce, err := dbGetNextNonce(dbtx, key.Public)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return nonce
+}
+
+// Signs the transaction with the key. The key's next nonce and the current transaction
+// version are used if they're not set.
+func (c *testChain) signTx(key *WalletKey, tx Tx) BlockTransaction {
+	c.t.Helper()
+	tx.SigningPubKey = key.Public
+	if tx.PubKeyNonce == 0 {
+		tx.PubKeyNonce = c.nextNonce(key)
+	}
+	if tx.Version == 0 {
+		tx.Version = CurrentTxVersion
+	}
+	if tx.Outputs == nil {
+		tx.Outputs = []TxOutput{}
+	}
+	txJSONBytes := mustCanonicalJSON(tx)
+	sig, err := key.SignRaw(txJSONBytes)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return BlockTransaction{TxHash: getTxHashStr(txJSONBytes), TxData: string(txJSONBytes), Signature: mustEncodeBase64URL(sig)}
+}
+
+// Signs the transaction and adds it to the pending transactions
+func (c *testChain) send(key *WalletKey, tx Tx) BlockTransaction {
+	c.t.Helper()
+	btx := c.signTx(key, tx)
+	if _, err := acceptTx(btx); err != nil {
+		c.t.Fatal(err)
+	}
+	return btx
+}
+
+// Signs a transaction with only the payload document and adds it to the pending
+// transactions
+func (c *testChain) publish(key *WalletKey, doc PublishedData) BlockTransaction {
+	c.t.Helper()
+	return c.send(key, Tx{Data: doc})
+}
+
+// Publishes the key's _intro document with the name
+func (c *testChain) introduce(key *WalletKey, name string) BlockTransaction {
+	c.t.Helper()
+	return c.publish(key, PublishedData{"_id": "_intro", "_key": key.Public, "_name": name})
+}
+
+// Returns the id of the key's publisher
+func (c *testChain) publisherID(key *WalletKey) int {
+	c.t.Helper()
+	id, err := dbResolvePublisherID(db, key.Public)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return id
+}
+
+// Returns a block template for the pending transactions on top of the main chain
+func (c *testChain) template(reward *WalletKey) *blockTemplate {
+	c.t.Helper()
+	t, err := getBlockTemplate(reward.Public)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return t
+}
+
+// Finds the block's nonce and sets its hash
+func (c *testChain) solve(t *blockTemplate) BlockWithHeader {
+	c.t.Helper()
+	b := t.Block
+	if len(b.Transactions) > 0 {
+		root, err := b.getMerkleRoot()
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		b.MerkleRoot = root
+	}
+	mineBlockNonce(&b.Block, t.Difficulty, func() bool { return false })
+	hash, err := b.Block.Hash()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	b.BlockHeader.Hash = mustEncodeBase64URL(hash)
+	return b
+}
+
+// Mines a block with all the pending transactions and adds it to the chain
+func (c *testChain) mine(reward *WalletKey) BlockWithHeader {
+	c.t.Helper()
+	t := c.template(reward)
+	b := c.solve(t)
+	if err := acceptBlock(b, t.Height); err != nil {
+		c.t.Fatal(err)
+	}
+	return b
+}
+
+// Returns the height of the main chain
+func (c *testChain) height() int {
+	c.t.Helper()
+	height, _, err := dbGetLastBlock()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return height
+}
+
+// Returns the key's balance
+func (c *testChain) balance(key *WalletKey) uint64 {
+	c.t.Helper()
+	balance := uint64(0)
+	err := db.QueryRow("SELECT balance FROM state WHERE pubkey=?", key.Public).Scan(&balance)
+	if err != nil && err != sql.ErrNoRows {
+		c.t.Fatal(err)
+	}
+	return balance
+}
+
+// Serves the node's API like the web server, with some of the handlers replaced, and
+// returns the server's URL
+func (c *testChain) serve(replaced map[string]http.HandlerFunc) string {
+	mux := http.NewServeMux()
+	for pattern, h := range map[string]http.HandlerFunc{
+		"/api/sendtx":      wwwSendTx,
+		"/api/txproof":     wwwGetTxProof,
+		"/api/stateproof":  wwwGetStateProof,
+		"/api/headers":     wwwGetHeaders,
+		"/api/document":    wwwGetDocument,
+		"/api/trust":       wwwGetTrust,
+		"/api/follows":     wwwGetFollows,
+		"/api/trustlevels": wwwGetTrustLevels,
+		"/api/handle":      wwwGetHandle,
+	} {
+		if r, ok := replaced[pattern]; ok {
+			h = r
+		}
+		mux.HandleFunc(pattern, h)
+	}
+	s := httptest.NewServer(mux)
+	c.t.Cleanup(s.Close)
+	return s.URL
+}
+
+// Gets the URL and decodes the JSON response into v, expecting the given status
+func getTestJSON(t *testing.T, url string, status int, v interface{}) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != status {
+		t.Fatalf("Expecting status %d from %s, got %d", status, url, resp.StatusCode)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
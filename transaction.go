@@ -4,7 +4,13 @@ import (
 	"crypto/sha256"
 )
 
-const CurrentTxVersion = 1
+// CurrentTxVersion is the version of new transactions. Since version 2, the JSON of
+// a transaction must be in the canonical encoding (see canonicaljson.go).
+const CurrentTxVersion = 2
+
+// MinTxVersion is the oldest version of transactions, other than coinbase transactions,
+// which blocks of version 4 or later and the pool of unconfirmed transactions take
+const MinTxVersion = 2
 
 // A transaction output
 type TxOutput struct {
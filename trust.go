@@ -0,0 +1,481 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// The trust graph has the publishers as nodes, and an edge from each publisher to
+// every publisher it vouches for (for any of its transactions), weighted by the
+// number of the vouched transactions. The trust of a viewer publisher in a target
+// publisher is computed over the graph by one of the trust algorithms:
+//
+//   path        the inverse of the length of the shortest path from the viewer
+//   flow        the maximum flow from the viewer to the target with a capacity of 1
+//               on every edge (i.e. the number of independent chains of vouches), as
+//               a fraction of the most there can be, which makes it hard for a
+//               single publisher to create trust by vouching for many sybils. It's
+//               only computed for the trustMaxFlowTargets publishers nearest to the
+//               viewer, since every target takes a max-flow computation.
+//   eigentrust  the EigenTrust score with the viewer as the only pre-trusted
+//               publisher, i.e. the chance that a random walk along the edges,
+//               which restarts at the viewer with probability trustRestartProbability
+//               at each step, is at the target
+//
+// The graph is loaded from the vouch table when it's first needed, and then the edges
+// of the publishers which vouch or withdraw vouches in the blocks connected to the main
+// chain are reloaded. After a reorganisation it's loaded again, since the disconnected
+// blocks may have removed publishers whose ids are then reused. The graph is replaced
+// rather than modified, so the trust is computed without holding trustGraphLock, and
+// the scores of each viewer are cached until the graph changes.
+
+const trustMaxPathLength = 6
+const trustMaxPaths = 20
+const trustMaxFlowTargets = 200
+const trustRestartProbability = 0.15
+const trustEigenTrustIterations = 100
+const trustEigenTrustEpsilon = 1e-9
+
+// voucher -> target -> number of vouched transactions
+type trustGraph map[int]map[int]int
+
+type trustAlgorithm struct {
+	// Returns the trust of the viewer in the publishers it trusts
+	scores func(g trustGraph, viewer int) map[int]float64
+	// Returns the paths along which the viewer trusts the target
+	paths func(g trustGraph, viewer, target int) [][]int
+}
+
+var trustAlgorithms = map[string]trustAlgorithm{
+	"path":       trustAlgorithm{scores: trustPathScores, paths: trustShortestPaths},
+	"flow":       trustAlgorithm{scores: trustFlowScores, paths: trustFlowPaths},
+	"eigentrust": trustAlgorithm{scores: trustEigenTrustScores, paths: trustShortestPaths},
+}
+
+var trustGraphLock = WithMutex{}
+var currentTrustGraph trustGraph // nil until loaded
+var trustGraphGeneration int     // incremented whenever the graph changes
+var trustScoreCache = map[trustScoreCacheKey]map[int]float64{}
+
+type trustScoreCacheKey struct {
+	algorithm string
+	viewer    int
+}
+
+// Returns the trust graph, loading it if needed, and its generation
+func getTrustGraph() (trustGraph, int, error) {
+	var g trustGraph
+	generation := 0
+	trustGraphLock.With(func() {
+		g = currentTrustGraph
+		generation = trustGraphGeneration
+	})
+	if g != nil {
+		return g, generation, nil
+	}
+	g = trustGraph{}
+	if err := dbLoadTrustEdges(g, "1=1"); err != nil {
+		return nil, 0, err
+	}
+	trustGraphLock.With(func() {
+		// Unless blocks have changed the graph while it was loading
+		if generation == trustGraphGeneration {
+			currentTrustGraph = g
+		}
+	})
+	return g, generation, nil
+}
+
+// Returns the trust graph, and the trust of the viewer in the publishers it trusts by
+// the named algorithm
+func getTrustScores(name string, viewer int) (trustGraph, map[int]float64, error) {
+	g, generation, err := getTrustGraph()
+	if err != nil {
+		return nil, nil, err
+	}
+	key := trustScoreCacheKey{algorithm: name, viewer: viewer}
+	var scores map[int]float64
+	trustGraphLock.With(func() {
+		if generation == trustGraphGeneration {
+			scores = trustScoreCache[key]
+		}
+	})
+	if scores != nil {
+		return g, scores, nil
+	}
+	scores = trustAlgorithms[name].scores(g, viewer)
+	trustGraphLock.With(func() {
+		if generation == trustGraphGeneration {
+			trustScoreCache[key] = scores
+		}
+	})
+	return g, scores, nil
+}
+
+// Replaces the trust graph, and drops the cached scores
+func setTrustGraph(g trustGraph) {
+	trustGraphLock.With(func() {
+		currentTrustGraph = g
+		trustGraphGeneration++
+		trustScoreCache = map[trustScoreCacheKey]map[int]float64{}
+	})
+}
+
+// Loads the edges of the vouches matching the where clause into the graph
+func dbLoadTrustEdges(g trustGraph, where string, args ...interface{}) error {
+	rows, err := db.Query(fmt.Sprintf("SELECT voucher_id, target_id, COUNT(*) FROM vouch WHERE target_id IS NOT NULL AND %s GROUP BY voucher_id, target_id", where), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var voucher, target, count int
+		if err = rows.Scan(&voucher, &target, &count); err != nil {
+			return err
+		}
+		if g[voucher] == nil {
+			g[voucher] = map[int]int{}
+		}
+		g[voucher][target] = count
+	}
+	return rows.Err()
+}
+
+// Updates the trust graph after the blocks have been connected to the main chain, by
+// reloading the edges of the publishers which have vouched or withdrawn vouches in them.
+func trustBlocksChanged(blocks []BlockWithHeader) {
+	var g trustGraph
+	trustGraphLock.With(func() {
+		g = currentTrustGraph
+	})
+	if g == nil {
+		setTrustGraph(nil)
+		return
+	}
+	keys := map[string]bool{}
+	for _, b := range blocks {
+		for _, btx := range b.Transactions {
+			tx := Tx{}
+			if json.Unmarshal([]byte(btx.TxData), &tx) != nil {
+				continue
+			}
+			if tx.Data.getString("_vouchtx") != "" || tx.Data.getString("_unvouchtx") != "" {
+				keys[tx.SigningPubKey] = true
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	updated := trustGraph{}
+	for voucher, edges := range g {
+		updated[voucher] = edges
+	}
+	for key := range keys {
+		voucher := 0
+		err := db.QueryRow("SELECT publisher_id FROM publisher_pubkey WHERE pubkey=?", key).Scan(&voucher)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err == nil {
+			delete(updated, voucher)
+			err = dbLoadTrustEdges(updated, "voucher_id=?", voucher)
+		}
+		if err != nil {
+			// Start over the next time the graph is needed
+			log.Println("Cannot update the trust graph:", err)
+			updated = nil
+			break
+		}
+	}
+	setTrustGraph(updated)
+}
+
+// Drops the trust graph after a reorganisation of the main chain, to be loaded again
+// the next time it's needed
+func trustChainReorganised() {
+	setTrustGraph(nil)
+}
+
+// Returns the shortest distances from the viewer to the publishers within trustMaxPathLength
+func (g trustGraph) distances(viewer int) map[int]int {
+	dist := map[int]int{viewer: 0}
+	queue := []int{viewer}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		if dist[p] >= trustMaxPathLength {
+			continue
+		}
+		for t := range g[p] {
+			if _, ok := dist[t]; !ok {
+				dist[t] = dist[p] + 1
+				queue = append(queue, t)
+			}
+		}
+	}
+	return dist
+}
+
+func trustPathScores(g trustGraph, viewer int) map[int]float64 {
+	scores := map[int]float64{}
+	for p, d := range g.distances(viewer) {
+		if p != viewer {
+			scores[p] = 1 / float64(d)
+		}
+	}
+	return scores
+}
+
+// Returns the graph with the edges reversed, with a weight of 1
+func (g trustGraph) reversed() trustGraph {
+	reversed := trustGraph{}
+	for p, edges := range g {
+		for t := range edges {
+			if reversed[t] == nil {
+				reversed[t] = map[int]int{}
+			}
+			reversed[t][p] = 1
+		}
+	}
+	return reversed
+}
+
+// Returns up to trustMaxPaths shortest paths from the viewer to the target
+func trustShortestPaths(g trustGraph, viewer, target int) [][]int {
+	// Distances to the target, over the reversed edges
+	dist := g.reversed().distances(target)
+	if _, ok := dist[viewer]; !ok {
+		return [][]int{}
+	}
+	paths := [][]int{}
+	var walk func(path []int)
+	walk = func(path []int) {
+		p := path[len(path)-1]
+		if p == target {
+			paths = append(paths, append([]int{}, path...))
+			return
+		}
+		next := []int{}
+		for t := range g[p] {
+			if d, ok := dist[t]; ok && d == dist[p]-1 {
+				next = append(next, t)
+			}
+		}
+		sort.Ints(next)
+		for _, t := range next {
+			if len(paths) >= trustMaxPaths {
+				return
+			}
+			walk(append(path, t))
+		}
+	}
+	walk([]int{viewer})
+	return paths
+}
+
+func trustFlowScores(g trustGraph, viewer int) map[int]float64 {
+	dist := g.distances(viewer)
+	targets := []int{}
+	for p := range dist {
+		if p != viewer {
+			targets = append(targets, p)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		if dist[targets[i]] != dist[targets[j]] {
+			return dist[targets[i]] < dist[targets[j]]
+		}
+		return targets[i] < targets[j]
+	})
+	if len(targets) > trustMaxFlowTargets {
+		targets = targets[:trustMaxFlowTargets]
+	}
+	reversed := g.reversed()
+	scores := map[int]float64{}
+	for _, p := range targets {
+		if s := trustFlowScore(g, reversed, viewer, p, nil); s > 0 {
+			scores[p] = s
+		}
+	}
+	return scores
+}
+
+func trustFlowPaths(g trustGraph, viewer, target int) [][]int {
+	paths := [][]int{}
+	trustFlowScore(g, g.reversed(), viewer, target, &paths)
+	return paths
+}
+
+// Returns the maximum flow from the viewer to the target with unit capacities, as a
+// fraction of the most there can be, and the paths of the flow if paths isn't nil.
+// reversed is the graph with the edges reversed.
+func trustFlowScore(g, reversed trustGraph, viewer, target int, paths *[][]int) float64 {
+	if viewer == target {
+		return 0
+	}
+	// The flow on every edge, which is 0 or 1, and -1 on the reverse edges
+	flow := map[[2]int]int{}
+	residual := func(p, t int) bool {
+		capacity := 0
+		if g[p][t] > 0 {
+			capacity = 1
+		}
+		return capacity-flow[[2]int{p, t}] > 0
+	}
+	total := 0
+	for {
+		// Edmonds-Karp: augment along the shortest path in the residual graph
+		prev := map[int]int{viewer: viewer}
+		queue := []int{viewer}
+		for len(queue) > 0 && prev[target] == 0 {
+			p := queue[0]
+			queue = queue[1:]
+			for _, edges := range []map[int]int{g[p], reversed[p]} {
+				for t := range edges {
+					if _, ok := prev[t]; !ok && residual(p, t) {
+						prev[t] = p
+						queue = append(queue, t)
+					}
+				}
+			}
+		}
+		if _, ok := prev[target]; !ok {
+			break
+		}
+		for t := target; t != viewer; t = prev[t] {
+			flow[[2]int{prev[t], t}]++
+			flow[[2]int{t, prev[t]}]--
+		}
+		total++
+	}
+	if paths != nil {
+		// Decompose the flow into paths
+		for i := 0; i < total; i++ {
+			path := []int{viewer}
+			for p := viewer; p != target; {
+				for t := range g[p] {
+					if flow[[2]int{p, t}] > 0 {
+						flow[[2]int{p, t}]--
+						p = t
+						break
+					}
+				}
+				path = append(path, p)
+			}
+			*paths = append(*paths, path)
+		}
+	}
+	most := len(g[viewer])
+	if len(reversed[target]) < most {
+		most = len(reversed[target])
+	}
+	if most == 0 {
+		return 0
+	}
+	return float64(total) / float64(most)
+}
+
+func trustEigenTrustScores(g trustGraph, viewer int) map[int]float64 {
+	trust := map[int]float64{viewer: 1}
+	for i := 0; i < trustEigenTrustIterations; i++ {
+		next := map[int]float64{viewer: trustRestartProbability}
+		for p, t := range trust {
+			total := 0
+			for _, w := range g[p] {
+				total += w
+			}
+			if total == 0 {
+				// Publishers which don't vouch for anyone give their trust back to the viewer
+				next[viewer] += (1 - trustRestartProbability) * t
+				continue
+			}
+			for target, w := range g[p] {
+				next[target] += (1 - trustRestartProbability) * t * float64(w) / float64(total)
+			}
+		}
+		diff := 0.0
+		for p := range next {
+			diff += math.Abs(next[p] - trust[p])
+		}
+		trust = next
+		if diff < trustEigenTrustEpsilon {
+			break
+		}
+	}
+	delete(trust, viewer)
+	return trust
+}
+
+// The trust of a viewer in a target, as returned by /api/trust
+type trustResult struct {
+	Viewer    int     `json:"viewer"`
+	Target    int     `json:"target"`
+	Algorithm string  `json:"algorithm"`
+	Score     float64 `json:"score"`
+	Paths     [][]int `json:"paths"`
+}
+
+// The trust of a viewer in the publishers it trusts, as returned by /api/trust
+type trustRanking struct {
+	Viewer    int          `json:"viewer"`
+	Algorithm string       `json:"algorithm"`
+	Scores    []trustScore `json:"scores"`
+}
+
+type trustScore struct {
+	Publisher int     `json:"publisher"`
+	Score     float64 `json:"score"`
+}
+
+// Handles /api/trust?viewer=<publisher id>[&target=<publisher id>][&algorithm=<algorithm>].
+// Without a target, returns the publishers the viewer trusts, by decreasing trust.
+func wwwGetTrust(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	viewer, err := strconv.Atoi(q.Get("viewer"))
+	if err != nil {
+		wwwWriteJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid viewer publisher"})
+		return
+	}
+	name := q.Get("algorithm")
+	if name == "" {
+		name = *trustAlgorithmName
+	}
+	algorithm, ok := trustAlgorithms[name]
+	if !ok {
+		wwwWriteJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Unknown trust algorithm: %s", name)})
+		return
+	}
+	g, scores, err := getTrustScores(name, viewer)
+	if err != nil {
+		log.Println(err)
+		wwwWriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if q.Get("target") != "" {
+		target, err := strconv.Atoi(q.Get("target"))
+		if err != nil {
+			wwwWriteJSON(w, http.StatusBadRequest, map[string]string{"error": "Invalid target publisher"})
+			return
+		}
+		wwwWriteJSON(w, http.StatusOK, trustResult{Viewer: viewer, Target: target, Algorithm: name, Score: scores[target], Paths: algorithm.paths(g, viewer, target)})
+		return
+	}
+	t := trustRanking{Viewer: viewer, Algorithm: name, Scores: []trustScore{}}
+	for p, s := range scores {
+		t.Scores = append(t.Scores, trustScore{Publisher: p, Score: s})
+	}
+	sort.Slice(t.Scores, func(i, j int) bool {
+		if t.Scores[i].Score != t.Scores[j].Score {
+			return t.Scores[i].Score > t.Scores[j].Score
+		}
+		return t.Scores[i].Publisher < t.Scores[j].Publisher
+	})
+	wwwWriteJSON(w, http.StatusOK, t)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+// 1 vouches for 2 and 3, which both vouch for 4, and 2 vouches for 5, which vouches
+// for 6 and 7
+func getTestTrustGraph() trustGraph {
+	return trustGraph{
+		1: {2: 1, 3: 1},
+		2: {4: 1, 5: 1},
+		3: {4: 1},
+		5: {6: 1, 7: 1},
+	}
+}
+
+func TestTrustPathScores(t *testing.T) {
+	scores := trustPathScores(getTestTrustGraph(), 1)
+	expected := map[int]float64{2: 1, 3: 1, 4: 0.5, 5: 0.5, 6: 1.0 / 3, 7: 1.0 / 3}
+	if !reflect.DeepEqual(scores, expected) {
+		t.Error("Expecting", expected, "got", scores)
+	}
+}
+
+func TestTrustFlowScores(t *testing.T) {
+	g := getTestTrustGraph()
+	scores := trustFlowScores(g, 1)
+	// 4 gets the most flow the viewer can give through 2 and 3, and 6 and 7 the most they
+	// can get through 5
+	expected := map[int]float64{2: 1, 3: 1, 4: 1, 5: 1, 6: 1, 7: 1}
+	if !reflect.DeepEqual(scores, expected) {
+		t.Error("Expecting", expected, "got", scores)
+	}
+
+	// Sybils of 5 vouching for 6 don't give it more flow than passes through 5
+	g[5] = map[int]int{6: 1, 8: 1, 9: 1}
+	g[8] = map[int]int{6: 1}
+	g[9] = map[int]int{6: 1}
+	if s := trustFlowScores(g, 1)[6]; s != 1.0/2 {
+		t.Error("Expecting a score of 0.5 for a publisher vouched for by sybils, got", s)
+	}
+
+	paths := trustFlowPaths(g, 1, 4)
+	if len(paths) != 2 {
+		t.Error("Expecting 2 paths to 4, got", paths)
+	}
+}
+
+func TestTrustFlowScoresCapped(t *testing.T) {
+	// The viewer vouches for 2, which vouches for many more publishers
+	g := trustGraph{1: {2: 1}, 2: {}}
+	for p := 3; p < 3+2*trustMaxFlowTargets; p++ {
+		g[2][p] = 1
+	}
+	scores := trustFlowScores(g, 1)
+	if len(scores) != trustMaxFlowTargets {
+		t.Fatal("Expecting", trustMaxFlowTargets, "scores, got", len(scores))
+	}
+	// The nearest publishers are scored first
+	if scores[2] != 1 || scores[3] != 1 || scores[3+2*trustMaxFlowTargets-1] != 0 {
+		t.Error("Expecting the nearest publishers to be scored, got", scores)
+	}
+}
+
+func TestTrustEigenTrustScores(t *testing.T) {
+	scores := trustEigenTrustScores(getTestTrustGraph(), 1)
+	if _, ok := scores[1]; ok {
+		t.Error("Expecting no score for the viewer")
+	}
+	total := 0.0
+	for _, s := range scores {
+		total += s
+	}
+	if total >= 1 {
+		t.Error("Expecting the scores to add up to less than 1, got", total)
+	}
+	// 4 gets trust from both 2 and 3, while 6 only gets half of what 5 gets from 2
+	if !(scores[4] > scores[3] && scores[2] > scores[5] && scores[5] > scores[6]) {
+		t.Error("Expecting scores ordered by the trust flowing to them, got", scores)
+	}
+}
+
+func TestTrustFromVouches(t *testing.T) {
+	miner := getTestKey("miner")
+	alice := getTestKey("alice")
+	bob := getTestKey("bob")
+	carol := getTestKey("carol")
+	c := newFundedTestChain(t, miner, alice, bob, carol)
+	c.introduce(alice, "alice")
+	c.introduce(bob, "bob")
+	c.introduce(carol, "carol")
+	bobPost := c.publish(bob, PublishedData{"_id": "post", "text": "hello"})
+	carolPost := c.publish(carol, PublishedData{"_id": "post", "text": "hello"})
+	c.mine(miner)
+	c.publish(alice, PublishedData{"_id": "_vouch", "_vouchtx": bobPost.TxHash})
+	c.publish(bob, PublishedData{"_id": "_vouch", "_vouchtx": carolPost.TxHash})
+	c.mine(miner)
+	aliceID, bobID, carolID := c.publisherID(alice), c.publisherID(bob), c.publisherID(carol)
+	url := c.serve(nil)
+
+	ranking := trustRanking{}
+	getTestJSON(t, fmt.Sprintf("%s/api/trust?viewer=%d&algorithm=path", url, aliceID), http.StatusOK, &ranking)
+	expected := []trustScore{{Publisher: bobID, Score: 1}, {Publisher: carolID, Score: 0.5}}
+	if !reflect.DeepEqual(ranking.Scores, expected) {
+		t.Error("Expecting", expected, "got", ranking.Scores)
+	}
+	result := trustResult{}
+	getTestJSON(t, fmt.Sprintf("%s/api/trust?viewer=%d&target=%d&algorithm=flow", url, aliceID, carolID), http.StatusOK, &result)
+	if result.Score != 1 || !reflect.DeepEqual(result.Paths, [][]int{{aliceID, bobID, carolID}}) {
+		t.Error("Expecting a flow of 1 through bob, got", result)
+	}
+	getTestJSON(t, url+"/api/trust?viewer=1&algorithm=unknown", http.StatusBadRequest, &map[string]string{})
+
+	// The cached scores are dropped when a vouch is withdrawn
+	c.publish(alice, PublishedData{"_id": "_unvouch", "_unvouchtx": bobPost.TxHash})
+	c.mine(miner)
+	ranking = trustRanking{}
+	getTestJSON(t, fmt.Sprintf("%s/api/trust?viewer=%d&algorithm=path", url, aliceID), http.StatusOK, &ranking)
+	if len(ranking.Scores) != 0 {
+		t.Error("Expecting no trust after the vouch is withdrawn, got", ranking.Scores)
+	}
+}
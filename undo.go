@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// blockUndo records how to revert the changes a block has made to the database,
+// so the block can be disconnected from the blockchain in a reorganisation. Before
+// a row is modified, the rows matching its key are saved, and reverting the block
+// replaces the rows matching the key with the saved ones, in reverse order.
+type blockUndo struct {
+	Entries []undoEntry `json:"e"`
+	seen    map[string]bool
+}
+
+type undoEntry struct {
+	Table string          `json:"t"`
+	Where string          `json:"w"`
+	Args  []interface{}   `json:"a"`
+	Cols  []string        `json:"c,omitempty"`
+	Rows  [][]interface{} `json:"r,omitempty"`
+}
+
+func (u *blockUndo) isSeen(table, where string, args []interface{}) bool {
+	if u.seen == nil {
+		u.seen = map[string]bool{}
+	}
+	key := table + "\x00" + where + "\x00" + jsonifyWhatever(args)
+	if u.seen[key] {
+		return true
+	}
+	u.seen[key] = true
+	return false
+}
+
+// Saves the rows of the table matching the where clause, before they are modified.
+// Only the first save of the same rows in a block is recorded, as it contains
+// the state before the block.
+func (u *blockUndo) save(dbtx *sql.Tx, table, where string, args ...interface{}) error {
+	if u.isSeen(table, where, args) {
+		return nil
+	}
+	rows, err := dbtx.Query(fmt.Sprintf("SELECT * FROM %s WHERE %s", table, where), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	e := undoEntry{Table: table, Where: where, Args: args}
+	e.Cols, err = rows.Columns()
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		values := make([]interface{}, len(e.Cols))
+		ptrs := make([]interface{}, len(e.Cols))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err = rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		e.Rows = append(e.Rows, values)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	u.Entries = append(u.Entries, e)
+	return nil
+}
+
+// Records that the rows matching the where clause have been inserted by the block
+func (u *blockUndo) inserted(table, where string, args ...interface{}) {
+	if u.isSeen(table, where, args) {
+		return
+	}
+	u.Entries = append(u.Entries, undoEntry{Table: table, Where: where, Args: args})
+}
+
+// Reverts the recorded changes
+func (u *blockUndo) revert(dbtx *sql.Tx) error {
+	for i := len(u.Entries) - 1; i >= 0; i-- {
+		e := u.Entries[i]
+		_, err := dbtx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s", e.Table, e.Where), e.Args...)
+		if err != nil {
+			return err
+		}
+		if len(e.Rows) == 0 {
+			continue
+		}
+		query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", e.Table, strings.Join(e.Cols, ","), strings.TrimSuffix(strings.Repeat("?,", len(e.Cols)), ","))
+		for _, row := range e.Rows {
+			_, err = dbtx.Exec(query, row...)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Decodes the undo data, restoring integer values which JSON would otherwise decode as floats
+func decodeBlockUndo(data []byte) (*blockUndo, error) {
+	u := blockUndo{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&u); err != nil {
+		return nil, err
+	}
+	for _, e := range u.Entries {
+		restoreUndoValues(e.Args)
+		for _, row := range e.Rows {
+			restoreUndoValues(row)
+		}
+	}
+	return &u, nil
+}
+
+func restoreUndoValues(values []interface{}) {
+	for i, v := range values {
+		n, ok := v.(json.Number)
+		if !ok {
+			continue
+		}
+		if iv, err := n.Int64(); err == nil {
+			values[i] = iv
+		} else if fv, err := n.Float64(); err == nil {
+			values[i] = fv
+		}
+	}
+}
+
+func dbSaveBlockUndo(dbtx *sql.Tx, height int, u *blockUndo) error {
+	_, err := dbtx.Exec("INSERT OR REPLACE INTO block_undo (height, data) VALUES (?, ?)", height, jsonifyWhatever(u))
+	return err
+}
+
+// Reverts the changes the block at the given height (which must be the last block) has
+// made to the database, and returns its transactions to the pool of unconfirmed transactions.
+// They are checked again by dbRevalidateDisconnectedUtxs once the new chain is connected.
+func dbDisconnectBlock(dbtx *sql.Tx, height int) (BlockWithHeader, error) {
+	b := BlockWithHeader{}
+	hash := ""
+	err := dbtx.QueryRow("SELECT hash FROM block WHERE height=?", height).Scan(&hash)
+	if err != nil {
+		return b, err
+	}
+	b, err = dataDirLoadBlock(height, hash)
+	if err != nil {
+		return b, err
+	}
+	data := ""
+	err = dbtx.QueryRow("SELECT data FROM block_undo WHERE height=?", height).Scan(&data)
+	if err != nil {
+		return b, fmt.Errorf("Cannot get undo data for block %s at %d: %s", hash, height, err.Error())
+	}
+	u, err := decodeBlockUndo([]byte(data))
+	if err != nil {
+		return b, err
+	}
+	if err = u.revert(dbtx); err != nil {
+		return b, err
+	}
+	_, err = dbtx.Exec("DELETE FROM block_undo WHERE height=?", height)
+	if err != nil {
+		return b, err
+	}
+	for _, btx := range b.Transactions {
+		tx := Tx{}
+		if err = json.Unmarshal([]byte(btx.TxData), &tx); err != nil {
+			return b, err
+		}
+		if inStringSlice("coinbase", tx.Flags) {
+			continue
+		}
+		_, err = dbInsertUtx(dbtx, btx, tx)
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
@@ -73,8 +73,8 @@ type WithMutex struct {
 // With executes the given function with the mutex locked
 func (m *WithMutex) With(f func()) {
 	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
 	f()
-	m.Mutex.Unlock()
 }
 
 // Converts the given Unix timestamp to time.Time
@@ -147,20 +147,17 @@ func mustEncodeBase64URL(b []byte) string {
 	return base64.RawURLEncoding.EncodeToString(b)
 }
 
+// Returns the number of leading zero bits in the byte slice
 func countStartZeroBits(b []byte) int {
 	nBits := 0
 	for i := 0; i < len(b); i++ {
-		if b[i] == 0 {
-			nBits += 8
-		} else {
-			for z := uint(7); z >= 0; z-- {
-				if b[i]&(1<<z) == 0 {
-					nBits++
-				} else {
-					break
-				}
+		if b[i] != 0 {
+			for z := uint(7); b[i]&(1<<z) == 0; z-- {
+				nBits++
 			}
+			break
 		}
+		nBits += 8
 	}
 	return nBits
 }
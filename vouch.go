@@ -0,0 +1,125 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// A publisher vouches for a transaction (usually one with a document) by publishing a
+// document with the `_vouchtx` key set to the transaction hash. The transaction must
+// be in an earlier block, and must not be signed by one of the publisher's own keys.
+// The vouch is recorded with the publisher of the transaction, if it has one, so that
+// the vouches for a publisher can be looked up as well as the vouches for a
+// transaction. A later document with `_unvouchtx` set to the transaction hash
+// withdraws the vouch.
+
+// A vouch, as returned by /api/vouches
+type vouch struct {
+	VoucherID   int    `json:"voucher_id"`
+	VoucherName string `json:"voucher_name"`
+	TxHash      string `json:"tx_hash"`
+	TargetID    int    `json:"target_id,omitempty"` // the publisher of the transaction
+	Block       int    `json:"block"`
+	VouchTxHash string `json:"vouch_tx_hash"`
+}
+
+// Records that the publisher vouches for the transaction
+func dbVouchTx(dbtx *sql.Tx, u *blockUndo, btx *BlockTransaction, publisher *Publisher, txHash string, height int) error {
+	signer := ""
+	err := dbtx.QueryRow("SELECT pubkey FROM block_tx WHERE hash=? ORDER BY height DESC LIMIT 1", txHash).Scan(&signer)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("The _vouchtx %s in %s is not in the blockchain", txHash, btx.TxHash)
+	}
+	if err != nil {
+		return err
+	}
+	targetID := sql.NullInt64{}
+	err = dbtx.QueryRow("SELECT publisher_id FROM publisher_pubkey WHERE pubkey=?", signer).Scan(&targetID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if targetID.Valid && int(targetID.Int64) == publisher.ID {
+		return fmt.Errorf("The _vouchtx %s in %s is the publisher's own", txHash, btx.TxHash)
+	}
+	count := 0
+	err = dbtx.QueryRow("SELECT COUNT(*) FROM vouch WHERE voucher_id=? AND tx_hash=?", publisher.ID, txHash).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("Publisher %d already vouches for %s, in %s", publisher.ID, txHash, btx.TxHash)
+	}
+	err = u.save(dbtx, "vouch", "voucher_id=? AND tx_hash=?", publisher.ID, txHash)
+	if err != nil {
+		return err
+	}
+	_, err = dbtx.Exec("INSERT INTO vouch (voucher_id, tx_hash, target_id, block, vouch_tx_hash) VALUES (?, ?, ?, ?, ?)", publisher.ID, txHash, targetID, height, btx.TxHash)
+	return err
+}
+
+// Withdraws the publisher's vouch for the transaction
+func dbUnvouchTx(dbtx *sql.Tx, u *blockUndo, btx *BlockTransaction, publisher *Publisher, txHash string) error {
+	count := 0
+	err := dbtx.QueryRow("SELECT COUNT(*) FROM vouch WHERE voucher_id=? AND tx_hash=?", publisher.ID, txHash).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("Publisher %d doesn't vouch for %s, in %s", publisher.ID, txHash, btx.TxHash)
+	}
+	err = u.save(dbtx, "vouch", "voucher_id=? AND tx_hash=?", publisher.ID, txHash)
+	if err != nil {
+		return err
+	}
+	_, err = dbtx.Exec("DELETE FROM vouch WHERE voucher_id=? AND tx_hash=?", publisher.ID, txHash)
+	return err
+}
+
+// Returns the vouches matching the where clause on the vouch table
+func dbGetVouches(where string, args ...interface{}) ([]vouch, error) {
+	rows, err := db.Query(fmt.Sprintf(`SELECT vouch.voucher_id, publisher.name, vouch.tx_hash, vouch.target_id, vouch.block, vouch.vouch_tx_hash
+		FROM vouch JOIN publisher ON publisher.id=vouch.voucher_id WHERE %s ORDER BY vouch.block`, where), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	vouches := []vouch{}
+	for rows.Next() {
+		v := vouch{}
+		targetID := sql.NullInt64{}
+		if err = rows.Scan(&v.VoucherID, &v.VoucherName, &v.TxHash, &targetID, &v.Block, &v.VouchTxHash); err != nil {
+			return nil, err
+		}
+		v.TargetID = int(targetID.Int64)
+		vouches = append(vouches, v)
+	}
+	return vouches, rows.Err()
+}
+
+// Handles /api/vouches?tx=<tx hash>, /api/vouches?publisher=<publisher id> for the
+// vouches for a transaction or a publisher, and /api/vouches?voucher=<publisher id>
+// for the vouches of a publisher
+func wwwGetVouches(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var vouches []vouch
+	var err error
+	if q.Get("tx") != "" {
+		vouches, err = dbGetVouches("vouch.tx_hash=?", q.Get("tx"))
+	} else if id, aerr := strconv.Atoi(q.Get("publisher")); aerr == nil {
+		vouches, err = dbGetVouches("vouch.target_id=?", id)
+	} else if id, aerr := strconv.Atoi(q.Get("voucher")); aerr == nil {
+		vouches, err = dbGetVouches("vouch.voucher_id=?", id)
+	} else {
+		wwwWriteJSON(w, http.StatusBadRequest, map[string]string{"error": "Expecting a tx, publisher or voucher argument"})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		wwwWriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	wwwWriteJSON(w, http.StatusOK, vouches)
+}
@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestVouches(t *testing.T) {
+	miner := getTestKey("miner")
+	alice := getTestKey("alice")
+	bob := getTestKey("bob")
+	c := newFundedTestChain(t, miner, alice, bob)
+	c.introduce(alice, "alice")
+	c.introduce(bob, "bob")
+	post := c.publish(bob, PublishedData{"_id": "post", "text": "hello"})
+
+	// The tx has to be in an earlier block
+	_, err := acceptTx(c.signTx(alice, Tx{Data: PublishedData{"_id": "_vouch", "_vouchtx": post.TxHash}}))
+	if re, ok := err.(*txRejectError); !ok || re.Reason != txRejectPayload {
+		t.Error("Expecting a vouch for a pending tx to be rejected, got", err)
+	}
+	c.mine(miner)
+	aliceID, bobID := c.publisherID(alice), c.publisherID(bob)
+	vouchTx := c.publish(alice, PublishedData{"_id": "_vouch", "_vouchtx": post.TxHash})
+	c.mine(miner)
+
+	for _, where := range []struct {
+		clause string
+		arg    interface{}
+	}{{"vouch.tx_hash=?", post.TxHash}, {"vouch.target_id=?", bobID}, {"vouch.voucher_id=?", aliceID}} {
+		vouches, err := dbGetVouches(where.clause, where.arg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := vouch{VoucherID: aliceID, VoucherName: "alice", TxHash: post.TxHash, TargetID: bobID, Block: c.height(), VouchTxHash: vouchTx.TxHash}
+		if len(vouches) != 1 || vouches[0] != expected {
+			t.Errorf("Expecting %+v for %s, got %+v", expected, where.clause, vouches)
+		}
+	}
+
+	for _, test := range []struct {
+		name string
+		key  *WalletKey
+		doc  PublishedData
+	}{
+		{"again", alice, PublishedData{"_id": "_vouch", "_vouchtx": post.TxHash}},
+		{"own tx", bob, PublishedData{"_id": "_vouch", "_vouchtx": post.TxHash}},
+		{"unknown tx", alice, PublishedData{"_id": "_vouch", "_vouchtx": "unknown"}},
+		{"not vouched", bob, PublishedData{"_id": "_unvouch", "_unvouchtx": vouchTx.TxHash}},
+	} {
+		_, err := acceptTx(c.signTx(test.key, Tx{Data: test.doc}))
+		if re, ok := err.(*txRejectError); !ok || re.Reason != txRejectPayload {
+			t.Errorf("Expecting the vouch %s to be rejected, got %v", test.name, err)
+		}
+	}
+
+	c.publish(alice, PublishedData{"_id": "_unvouch", "_unvouchtx": post.TxHash})
+	c.mine(miner)
+	if vouches, err := dbGetVouches("vouch.tx_hash=?", post.TxHash); err != nil || len(vouches) != 0 {
+		t.Error("Expecting the vouch to be withdrawn, got", vouches, err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -9,8 +10,6 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-const wwwBind = ":8002"
-
 // The JSON structure which goes over the wire in WebSockets (delimited by newlines)
 type wsMessage struct {
 	Type  string              `json:"type"`
@@ -28,6 +27,9 @@ type wsClient struct {
 	remoteAddr         string
 }
 
+// The maximum size of an API request body
+const wwwMaxRequestSize = 32 * 1024 * 1024
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -44,6 +46,41 @@ func wwwHome(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Hello, world!"))
 }
 
+// Writes a JSON response
+func wwwWriteJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonifyWhateverToBytes(data))
+}
+
+// Handles /api/sendtx, which adds a signed transaction to the pool of unconfirmed transactions
+func wwwSendTx(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		wwwWriteJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "Expecting a POST request"})
+		return
+	}
+	btx := BlockTransaction{}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, wwwMaxRequestSize)).Decode(&btx)
+	if err != nil {
+		wwwWriteJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Cannot decode tx: %s", err.Error()), "reason": txRejectInvalid})
+		return
+	}
+	added, err := acceptTx(btx)
+	if re, ok := err.(*txRejectError); ok {
+		wwwWriteJSON(w, http.StatusBadRequest, map[string]string{"error": re.Message, "reason": re.Reason})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		wwwWriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if added {
+		p2pAnnounceTx(btx.TxHash)
+	}
+	wwwWriteJSON(w, http.StatusOK, map[string]string{"hash": btx.TxHash})
+}
+
 // Switches to the WebSockets protocol
 func wwwServeWs(w http.ResponseWriter, r *http.Request) {
 	ws, err := upgrader.Upgrade(w, r, nil)
@@ -64,10 +101,26 @@ func wwwServeWs(w http.ResponseWriter, r *http.Request) {
 func webServer() {
 	http.HandleFunc("/", wwwHome)
 	http.HandleFunc("/ws", wwwServeWs)
-	log.Println("Web server listening on", wwwBind)
-	err := http.ListenAndServe(wwwBind, nil)
+	http.HandleFunc("/api/sendtx", wwwSendTx)
+	http.HandleFunc("/api/txproof", wwwGetTxProof)
+	http.HandleFunc("/api/stateproof", wwwGetStateProof)
+	http.HandleFunc("/api/headers", wwwGetHeaders)
+	http.HandleFunc("/api/document", wwwGetDocument)
+	http.HandleFunc("/api/docversions", wwwGetDocumentVersions)
+	http.HandleFunc("/api/docdiff", wwwGetDocumentDiff)
+	http.HandleFunc("/api/doccontent", wwwGetDocumentContent)
+	http.HandleFunc("/api/qrcode", wwwGetQRCode)
+	http.HandleFunc("/api/vouches", wwwGetVouches)
+	http.HandleFunc("/api/trust", wwwGetTrust)
+	http.HandleFunc("/api/follows", wwwGetFollows)
+	http.HandleFunc("/api/trustlevels", wwwGetTrustLevels)
+	http.HandleFunc("/api/handle", wwwGetHandle)
+	http.HandleFunc("/api/getblocktemplate", wwwGetBlockTemplate)
+	http.HandleFunc("/api/submitblock", wwwSubmitBlock)
+	log.Println("Web server listening on", *wwwBind)
+	err := http.ListenAndServe(*wwwBind, nil)
 	if err != nil {
-		log.Panic("Cannot listen on ", wwwBind, " for the web server")
+		log.Panic("Cannot listen on ", *wwwBind, " for the web server")
 	}
 }
 
@@ -131,7 +184,23 @@ func (wsc *wsClient) handleClient() {
 			case "ping":
 				wsc.toClient <- wsMessage{Type: "pong", Data: map[string]string{}}
 			case "get_status":
-				wsc.toClient <- wsMessage{Type: "status", Data: map[string]string{"uptime": fmt.Sprintf("%v", time.Since(startTime))}}
+				height, hash, _ := dbGetLastBlock()
+				syncing, syncTarget := getP2PSyncStatus()
+				difficulty := 0
+				if last, err := dbGetBlockTreeEntry(db, hash); err == nil {
+					difficulty, _ = getNextBlockDifficulty(db, last)
+				}
+				wsc.toClient <- wsMessage{Type: "status", Data: map[string]string{
+					"uptime":      fmt.Sprintf("%v", time.Since(startTime)),
+					"height":      fmt.Sprintf("%d", height),
+					"hash":        hash,
+					"peers":       fmt.Sprintf("%d", len(getP2PPeers())),
+					"syncing":     fmt.Sprintf("%v", syncing),
+					"sync_target": fmt.Sprintf("%d", syncTarget),
+					"orphans":     fmt.Sprintf("%d", getOrphanBlockCount()),
+					"difficulty":  fmt.Sprintf("%d", difficulty),
+					"hashrate":    fmt.Sprintf("%.0f", getMinerHashrate()),
+				}}
 			case "logout":
 				wsc.userID = 0
 				wsc.toClient <- wsMessage{Type: "logout_ok", Data: map[string]string{}}